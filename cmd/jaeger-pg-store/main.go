@@ -42,9 +42,10 @@ func main() {
 	store, f, err := pgstore.NewStore(&conf, logger)
 	if err != nil {
 		logger.Error("failed to create postgresql store", "error", err)
-		err := f()
-		if err != nil {
-			logger.Error("failed to close postgresql store", "error", err)
+		if f != nil {
+			if err := f(); err != nil {
+				logger.Error("failed to close postgresql store", "error", err)
+			}
 		}
 		os.Exit(1)
 	}
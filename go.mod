@@ -1,11 +1,14 @@
 module github.com/innovatrics/jaeger-postgresql
 
-go 1.12
+go 1.13
 
 require (
 	github.com/go-pg/pg/v9 v9.2.0
 	github.com/gogo/googleapis v1.2.0 // indirect
 	github.com/hashicorp/go-hclog v0.9.0
 	github.com/jaegertracing/jaeger v1.17.1
+	github.com/opentracing/opentracing-go v1.1.0
+	github.com/prometheus/client_golang v1.1.0
 	github.com/spf13/viper v1.6.2
+	github.com/testcontainers/testcontainers-go v0.5.1
 )
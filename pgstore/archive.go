@@ -0,0 +1,114 @@
+package pgstore
+
+import (
+	"context"
+	"io"
+
+	"github.com/go-pg/pg/v9"
+	hclog "github.com/hashicorp/go-hclog"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+// DefaultArchiveSchema is the schema holding archived traces unless another
+// one is given
+const DefaultArchiveSchema = "archive"
+
+var (
+	_ spanstore.Writer = (*ArchiveWriter)(nil)
+	_ io.Closer        = (*ArchiveReader)(nil)
+	_ io.Closer        = (*ArchiveWriter)(nil)
+)
+
+// archiveTables are copied into the archive schema, services and operations
+// stay shared with the main store
+var archiveTables = []string{"spans", "span_refs", "span_logs"}
+
+// MigrateArchive creates the archive schema with copies of the span tables
+// found in the search_path of db and brings copies made earlier up to date,
+// applying the archiveStatements of the migrations. It expects the main schema
+// to be migrated already and is safe to run at every startup.
+func MigrateArchive(ctx context.Context, db *pg.DB, schema string) error {
+	db = db.WithContext(ctx)
+	if _, err := db.Exec("CREATE SCHEMA IF NOT EXISTS ?", pg.Ident(schema)); err != nil {
+		return err
+	}
+	for _, table := range archiveTables {
+		if _, err := db.Exec("CREATE TABLE IF NOT EXISTS ?.? (LIKE ? INCLUDING ALL)",
+			pg.Ident(schema), pg.Ident(table), pg.Ident(table)); err != nil {
+			return err
+		}
+	}
+	return applyMigrations(db, schema, hclog.NewNullLogger())
+}
+
+// connectArchive opens a pool like db's whose connections resolve the span
+// tables in schema first, falling back to the search_path of db for services
+// and operations
+func connectArchive(db *pg.DB, schema string) *pg.DB {
+	opts := *db.Options()
+	onConnect := opts.OnConnect
+	opts.OnConnect = func(conn *pg.Conn) error {
+		if onConnect != nil {
+			if err := onConnect(conn); err != nil {
+				return err
+			}
+		}
+		_, err := conn.Exec("SELECT set_config('search_path', quote_ident(?) || ', ' || current_setting('search_path'), false)", schema)
+		return err
+	}
+	return pg.Connect(&opts)
+}
+
+// ArchiveReader loads traces from the archive schema
+type ArchiveReader struct {
+	db     *pg.DB
+	reader *Reader
+}
+
+// NewArchiveReader returns an ArchiveReader for the given schema, it opens
+// its own pool with the options of db which is released by Close
+func NewArchiveReader(db *pg.DB, logger hclog.Logger, schema string) *ArchiveReader {
+	archiveDB := connectArchive(db, schema)
+	return &ArchiveReader{
+		db:     archiveDB,
+		reader: NewReader(archiveDB, logger),
+	}
+}
+
+// GetTrace takes a traceID and returns the archived Trace associated with that traceID
+func (r *ArchiveReader) GetTrace(ctx context.Context, traceID model.TraceID) (*model.Trace, error) {
+	return r.reader.GetTrace(ctx, traceID)
+}
+
+// Close releases the archive pool
+func (r *ArchiveReader) Close() error {
+	return r.db.Close()
+}
+
+// ArchiveWriter saves spans into the archive schema
+type ArchiveWriter struct {
+	db     *pg.DB
+	writer *Writer
+}
+
+// NewArchiveWriter returns an ArchiveWriter for the given schema, it opens
+// its own pool with the options of db which is released by Close
+func NewArchiveWriter(db *pg.DB, logger hclog.Logger, schema string) *ArchiveWriter {
+	archiveDB := connectArchive(db, schema)
+	return &ArchiveWriter{
+		db:     archiveDB,
+		writer: NewWriter(archiveDB, logger),
+	}
+}
+
+// WriteSpan saves the span into the archive
+func (w *ArchiveWriter) WriteSpan(span *model.Span) error {
+	return w.writer.WriteSpan(span)
+}
+
+// Close releases the archive pool
+func (w *ArchiveWriter) Close() error {
+	return w.db.Close()
+}
@@ -0,0 +1,102 @@
+//go:build integration
+// +build integration
+
+package pgstore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	ctx := context.Background()
+	if err := MigrateArchive(ctx, db, DefaultArchiveSchema); err != nil {
+		t.Fatal(err)
+	}
+	logger := hclog.NewNullLogger()
+	archiveWriter := NewArchiveWriter(db, logger, DefaultArchiveSchema)
+	defer archiveWriter.Close()
+	archiveReader := NewArchiveReader(db, logger, DefaultArchiveSchema)
+	defer archiveReader.Close()
+
+	traceID := model.TraceID{Low: 1}
+	span := testSpan(traceID, 1, "frontend", "GET /", time.Now())
+	span.Logs = []model.Log{{Timestamp: span.StartTime, Fields: []model.KeyValue{model.String("event", "archived")}}}
+	writeTestSpans(t, archiveWriter, span)
+
+	trace, err := archiveReader.GetTrace(ctx, traceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trace.Spans) != 1 || len(trace.Spans[0].Logs) != 1 {
+		t.Errorf("archived trace = %v, want the span with its log", trace.Spans)
+	}
+	if _, err := NewReader(db, logger).GetTrace(ctx, traceID); !errors.Is(err, spanstore.ErrTraceNotFound) {
+		t.Errorf("main GetTrace() error = %v, want spanstore.ErrTraceNotFound", err)
+	}
+}
+
+func TestMigrateArchiveUpdatesOldCopies(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	ctx := context.Background()
+	logger := hclog.NewNullLogger()
+	start := time.Now().Truncate(time.Microsecond)
+	writeTestSpans(t, NewWriter(db, logger), testSpan(model.TraceID{Low: 1}, 1, "frontend", "GET /", start))
+
+	// a copy made before migration 3, its durations in nanoseconds, its zero
+	// trace id words NULL and its logs without the trace ids of migration 18
+	if _, err := db.Exec(`
+CREATE SCHEMA archive;
+CREATE TABLE archive.spans (id bigint, trace_id_low bigint, trace_id_high bigint, operation_id bigint, flags bigint,
+	start_time timestamptz, duration bigint, tags jsonb, service_id bigint, process_id text, process_tags jsonb,
+	warnings jsonb, PRIMARY KEY (id, start_time));
+CREATE TABLE archive.span_refs (id bigserial PRIMARY KEY, trace_id_low bigint, trace_id_high bigint,
+	source_span_id bigint, child_span_id bigint, ref_type integer);
+CREATE TABLE archive.span_logs (id bigserial PRIMARY KEY, span_id bigint, timestamp timestamptz, fields jsonb);
+INSERT INTO archive.spans (id, trace_id_low, trace_id_high, operation_id, flags, start_time, duration, service_id, process_id)
+	SELECT id, trace_id_low, NULL, operation_id, flags, start_time, duration * 1000, service_id, process_id FROM spans;
+INSERT INTO archive.span_logs (span_id, timestamp, fields) VALUES (1, now(), '{"event": "archived"}');
+`); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := MigrateArchive(ctx, db, DefaultArchiveSchema); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	archiveReader := NewArchiveReader(db, logger, DefaultArchiveSchema)
+	defer archiveReader.Close()
+	trace, err := archiveReader.GetTrace(ctx, model.TraceID{Low: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trace.Spans) != 1 || trace.Spans[0].Duration != time.Millisecond || len(trace.Spans[0].Logs) != 1 {
+		t.Errorf("archived trace = %v, want the span lasting 1ms with its log", trace.Spans)
+	}
+
+	archiveWriter := NewArchiveWriter(db, logger, DefaultArchiveSchema)
+	defer archiveWriter.Close()
+	span := testSpan(model.TraceID{Low: 2}, 2, "frontend", "GET /", start)
+	span.Logs = []model.Log{{Timestamp: start, Fields: []model.KeyValue{model.String("event", "archived")}}}
+	span.References = []model.SpanRef{model.NewChildOfRef(model.TraceID{Low: 2}, 1)}
+	// delivered twice, the old copy got the unique index the Writer needs
+	writeTestSpans(t, archiveWriter, span, span)
+	var spans int
+	if _, err := db.QueryOne(pg.Scan(&spans), "SELECT count(*) FROM archive.spans WHERE trace_id_low = 2"); err != nil {
+		t.Fatal(err)
+	}
+	if spans != 1 {
+		t.Errorf("%d archived rows of the span written twice, want 1", spans)
+	}
+}
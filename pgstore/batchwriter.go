@@ -0,0 +1,245 @@
+package pgstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+var _ spanstore.Writer = (*BatchWriter)(nil)
+var _ io.Closer = (*BatchWriter)(nil)
+
+var errBatchWriterClosed = errors.New("batch writer is closed")
+
+// BatchWriter buffers spans and saves them into PostgreSQL with multi-row inserts
+type BatchWriter struct {
+	writer *Writer
+
+	maxBatch int
+
+	mu       sync.Mutex
+	spans    []*Span
+	buffered map[spanKey]struct{}
+	// refs and logs of each of the spans
+	refs   [][]*SpanRef
+	logs   [][]*Log
+	closed bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewBatchWriter returns a BatchWriter flushing at maxBatch spans or every flushInterval
+func NewBatchWriter(w *Writer, maxBatch int, flushInterval time.Duration) *BatchWriter {
+	if maxBatch <= 0 {
+		maxBatch = 1
+	}
+	b := &BatchWriter{
+		writer:   w,
+		maxBatch: maxBatch,
+		spans:    make([]*Span, 0, maxBatch),
+		buffered: make(map[spanKey]struct{}, maxBatch),
+		done:     make(chan struct{}),
+	}
+
+	if flushInterval > 0 {
+		b.wg.Add(1)
+		go b.flushPeriodically(flushInterval)
+	}
+
+	return b
+}
+
+// spanKey identifies a span like the unique index idx_spans_trace_span_id,
+// the columns returned by the inserts of flush are scanned into it
+type spanKey struct {
+	ID          int64
+	TraceIDLow  int64
+	TraceIDHigh int64
+	TenantID    string
+}
+
+// WriteSpan buffers the span, flushing the batch once it is full. A span
+// buffered or written before is ignored. When the flush fails on a transient
+// error the batch stays buffered and is written by the next flush, the spans
+// written meanwhile are refused with the error until it succeeds. A span the
+// database refuses is dropped with an error log, see flush.
+func (b *BatchWriter) WriteSpan(span *model.Span) error {
+	dbSpan, err := b.writer.prepareSpan(context.Background(), span)
+	if err != nil || dbSpan == nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return errBatchWriterClosed
+	}
+	key := spanKey{TraceIDLow: dbSpan.TraceIDLow, TraceIDHigh: dbSpan.TraceIDHigh, ID: dbSpan.ID, TenantID: dbSpan.TenantID}
+	if _, found := b.buffered[key]; found {
+		return nil
+	}
+	if len(b.spans) >= b.maxBatch {
+		// a failed flush left the batch buffered, it is retried before the
+		// buffer takes more spans
+		if err := b.flush(); err != nil {
+			return err
+		}
+	}
+	b.buffered[key] = struct{}{}
+	b.spans = append(b.spans, dbSpan)
+	refs, logs := b.writer.spanDetails(span)
+	b.refs = append(b.refs, refs)
+	b.logs = append(b.logs, logs)
+	if len(b.spans) >= b.maxBatch {
+		return b.flush()
+	}
+	return nil
+}
+
+// Close stops the periodic flush and writes out any buffered spans, the
+// error tells how many of them were dropped
+func (b *BatchWriter) Close() error {
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return nil
+	}
+	b.closed = true
+	b.mu.Unlock()
+
+	close(b.done)
+	b.wg.Wait()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.flush(); err != nil {
+		return fmt.Errorf("pgstore: dropped %d buffered spans: %w", len(b.spans), err)
+	}
+	return nil
+}
+
+func (b *BatchWriter) flushPeriodically(interval time.Duration) {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			b.mu.Lock()
+			if err := b.flush(); err != nil {
+				b.writer.logger.Error("Couldn't flush span batch", "err", err)
+			}
+			b.mu.Unlock()
+		case <-b.done:
+			return
+		}
+	}
+}
+
+// flush writes the buffered rows in one transaction and empties the buffer.
+// A flush failing on a transient error, e.g. a lost connection, keeps them
+// buffered, after any other error the spans are written one by one. The
+// caller must hold b.mu.
+func (b *BatchWriter) flush() error {
+	if len(b.spans) == 0 {
+		return nil
+	}
+	spans := b.spans
+	err := b.writer.db.RunInTransaction(func(tx *pg.Tx) error {
+		var inserted []spanKey
+		if _, err := insertSpanColumns(tx.Model(&spans), b.writer.tagStorage).OnConflict(spanConflict).
+			Returning("id, trace_id_low, trace_id_high, tenant_id").Insert(&inserted); err != nil {
+			return err
+		}
+		refs, logs := b.insertedDetails(inserted)
+		if err := insertRefs(tx, refs); err != nil {
+			return err
+		}
+		return insertLogs(tx, logs)
+	})
+	if err != nil && isTransient(err) {
+		return err
+	}
+	if err != nil {
+		// a span the database refuses, e.g. with a tag jsonb can't hold,
+		// fails the whole batch. Written one by one, it doesn't hold back
+		// the others.
+		return b.writeEach(err)
+	}
+
+	b.reset(nil)
+	return nil
+}
+
+// writeEach writes the buffered spans one at a time after the batch failed
+// with batchErr. The spans refused are dropped with an error log, those
+// failing on a transient error stay buffered for the next flush. The caller
+// must hold b.mu.
+func (b *BatchWriter) writeEach(batchErr error) error {
+	var kept []int
+	var err error
+	dropped := 0
+	for i, span := range b.spans {
+		spanErr := b.writer.writeSpan(context.Background(), span, b.refs[i], b.logs[i])
+		switch {
+		case spanErr == nil:
+		case isTransient(spanErr):
+			kept = append(kept, i)
+			err = spanErr
+		default:
+			dropped++
+			b.writer.logger.Error("Dropped a span the database refused", "trace_id_low", span.TraceIDLow,
+				"trace_id_high", span.TraceIDHigh, "span_id", span.ID, "err", spanErr)
+		}
+	}
+	if dropped > 0 {
+		b.writer.logger.Error("Dropped spans of a failed batch", "dropped", dropped, "batch", len(b.spans), "err", batchErr)
+	}
+	b.reset(kept)
+	return err
+}
+
+// reset empties the buffer but for the spans at the indexes kept. The caller
+// must hold b.mu.
+func (b *BatchWriter) reset(kept []int) {
+	spans := make([]*Span, 0, b.maxBatch)
+	buffered := make(map[spanKey]struct{}, b.maxBatch)
+	var refs [][]*SpanRef
+	var logs [][]*Log
+	for _, i := range kept {
+		span := b.spans[i]
+		spans = append(spans, span)
+		buffered[spanKey{TraceIDLow: span.TraceIDLow, TraceIDHigh: span.TraceIDHigh, ID: span.ID, TenantID: span.TenantID}] = struct{}{}
+		refs = append(refs, b.refs[i])
+		logs = append(logs, b.logs[i])
+	}
+	b.spans, b.buffered, b.refs, b.logs = spans, buffered, refs, logs
+}
+
+// insertedDetails returns the refs and logs of the buffered spans which were
+// inserted, skipping those of the spans written before
+func (b *BatchWriter) insertedDetails(inserted []spanKey) ([]*SpanRef, []*Log) {
+	keys := make(map[spanKey]struct{}, len(inserted))
+	for _, key := range inserted {
+		keys[key] = struct{}{}
+	}
+	var refs []*SpanRef
+	var logs []*Log
+	for i, span := range b.spans {
+		if _, found := keys[spanKey{TraceIDLow: span.TraceIDLow, TraceIDHigh: span.TraceIDHigh, ID: span.ID, TenantID: span.TenantID}]; found {
+			refs = append(refs, b.refs[i]...)
+			logs = append(logs, b.logs[i]...)
+		}
+	}
+	return refs, logs
+}
@@ -0,0 +1,153 @@
+//go:build integration
+// +build integration
+
+package pgstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+)
+
+func TestBatchWriterFlushesFullBatch(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	batch := NewBatchWriter(NewWriter(db, hclog.NewNullLogger()), 2, 0)
+	defer batch.Close()
+
+	start := time.Now()
+	writeTestSpans(t, batch, testSpan(model.TraceID{Low: 1}, 1, "frontend", "GET /", start))
+	if count := countRows(t, db, (*Span)(nil)); count != 0 {
+		t.Fatalf("%d spans stored before the batch is full", count)
+	}
+	writeTestSpans(t, batch, testSpan(model.TraceID{Low: 1}, 2, "frontend", "GET /", start))
+	if count := countRows(t, db, (*Span)(nil)); count != 2 {
+		t.Fatalf("%d spans stored once the batch is full, want 2", count)
+	}
+}
+
+func TestBatchWriterFlushesPeriodically(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	batch := NewBatchWriter(NewWriter(db, hclog.NewNullLogger()), 100, 50*time.Millisecond)
+	defer batch.Close()
+
+	writeTestSpans(t, batch, testSpan(model.TraceID{Low: 1}, 1, "frontend", "GET /", time.Now()))
+	deadline := time.Now().Add(5 * time.Second)
+	for countRows(t, db, (*Span)(nil)) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the buffered span wasn't flushed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestBatchWriterDrainsOnClose(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	batch := NewBatchWriter(NewWriter(db, hclog.NewNullLogger()), 100, 0)
+
+	start := time.Now()
+	span := testSpan(model.TraceID{Low: 1}, 1, "frontend", "GET /", start)
+	span.Logs = []model.Log{{Timestamp: start, Fields: []model.KeyValue{model.String("event", "started")}}}
+	// buffered twice, stored once
+	writeTestSpans(t, batch, span, span, testSpan(model.TraceID{Low: 1}, 2, "frontend", "GET /", start))
+	if err := batch.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if count := countRows(t, db, (*Span)(nil)); count != 2 {
+		t.Errorf("%d spans stored on Close, want 2", count)
+	}
+	if count := countRows(t, db, (*Log)(nil)); count != 1 {
+		t.Errorf("%d logs stored on Close, want 1", count)
+	}
+	if err := batch.WriteSpan(span); !errors.Is(err, errBatchWriterClosed) {
+		t.Errorf("WriteSpan() after Close = %v, want errBatchWriterClosed", err)
+	}
+}
+
+// lostConnectionHook fails the transactions begun while fail is set as on a
+// lost connection
+type lostConnectionHook struct {
+	fail bool
+}
+
+func (h *lostConnectionHook) BeforeQuery(ctx context.Context, event *pg.QueryEvent) (context.Context, error) {
+	if h.fail && event.Query == "BEGIN" {
+		return ctx, io.ErrUnexpectedEOF
+	}
+	return ctx, nil
+}
+
+func (h *lostConnectionHook) AfterQuery(context.Context, *pg.QueryEvent) error {
+	return nil
+}
+
+func TestBatchWriterKeepsFailedBatch(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	hook := &lostConnectionHook{}
+	db.AddQueryHook(hook)
+	batch := NewBatchWriter(NewWriter(db, hclog.NewNullLogger()), 1, 0)
+
+	start := time.Now()
+	span := testSpan(model.TraceID{Low: 1}, 1, "frontend", "GET /", start)
+	span.Logs = []model.Log{{Timestamp: start, Fields: []model.KeyValue{model.String("event", "started")}}}
+	hook.fail = true
+	if err := batch.WriteSpan(span); err == nil {
+		t.Fatal("WriteSpan() succeeded without a connection")
+	}
+	if err := batch.WriteSpan(testSpan(model.TraceID{Low: 1}, 2, "frontend", "GET /", start)); err == nil {
+		t.Fatal("WriteSpan() buffered a span beyond the failed batch")
+	}
+	if count := countRows(t, db, (*Span)(nil)); count != 0 {
+		t.Fatalf("%d spans stored by the failed flush", count)
+	}
+
+	hook.fail = false
+	if err := batch.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if count := countRows(t, db, (*Span)(nil)); count != 1 {
+		t.Errorf("%d spans stored once the connection is back, want 1", count)
+	}
+	if count := countRows(t, db, (*Log)(nil)); count != 1 {
+		t.Errorf("%d logs stored once the connection is back, want 1", count)
+	}
+}
+
+func TestBatchWriterDropsRefusedSpan(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	batch := NewBatchWriter(NewWriter(db, hclog.NewNullLogger()), 3, 0)
+
+	start := time.Now()
+	bad := testSpan(model.TraceID{Low: 1}, 2, "frontend", "GET /", start)
+	// jsonb refuses \u0000
+	bad.Tags = []model.KeyValue{model.String("payload", "a\x00b")}
+	good := testSpan(model.TraceID{Low: 1}, 3, "frontend", "GET /", start)
+	good.Logs = []model.Log{{Timestamp: start, Fields: []model.KeyValue{model.String("event", "started")}}}
+	// the third span fills the batch
+	writeTestSpans(t, batch, testSpan(model.TraceID{Low: 1}, 1, "frontend", "GET /", start), bad, good)
+	if count := countRows(t, db, (*Span)(nil)); count != 2 {
+		t.Fatalf("%d spans stored by the failed batch, want all but the refused one", count)
+	}
+	if count := countRows(t, db, (*Log)(nil)); count != 1 {
+		t.Errorf("%d logs stored by the failed batch, want the one of the good span", count)
+	}
+
+	// the buffer is free for the next spans
+	writeTestSpans(t, batch, testSpan(model.TraceID{Low: 1}, 4, "frontend", "GET /", start))
+	if err := batch.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if count := countRows(t, db, (*Span)(nil)); count != 3 {
+		t.Errorf("%d spans stored on Close, want 3", count)
+	}
+}
@@ -0,0 +1,231 @@
+package pgstore
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// testCertificate is a certificate with its key, signed by parent or
+// self-signed when parent is nil
+type testCertificate struct {
+	cert *x509.Certificate
+	der  []byte
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCertificate(tb testing.TB, name string, parent *testCertificate) *testCertificate {
+	tb.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  parent == nil,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return &testCertificate{cert: cert, der: der, key: key}
+}
+
+// write stores the certificate and its key as PEM files in dir
+func (c *testCertificate) write(tb testing.TB, dir string, name string) (certPath, keyPath string) {
+	tb.Helper()
+	keyDER, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	certPath = filepath.Join(dir, name+".crt")
+	keyPath = filepath.Join(dir, name+".key")
+	if err := ioutil.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.der}), 0600); err != nil {
+		tb.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		tb.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgstore-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ca := newTestCertificate(t, "test-ca", nil)
+	caPath, _ := ca.write(t, dir, "ca")
+	clientCertPath, clientKeyPath := newTestCertificate(t, "jaeger", ca).write(t, dir, "client")
+	server := newTestCertificate(t, "db.example.com", ca)
+	stranger := newTestCertificate(t, "db.example.com", nil)
+
+	for _, mode := range []string{"", SSLModeDisable} {
+		tlsConfig, err := (&Configuration{SSLMode: mode, CACertPath: caPath}).tlsConfig()
+		if err != nil || tlsConfig != nil {
+			t.Errorf("tlsConfig() with sslMode %q = %v, %v, want no TLS", mode, tlsConfig, err)
+		}
+	}
+
+	tlsConfig, err := (&Configuration{SSLMode: SSLModeRequire, CACertPath: caPath}).tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !tlsConfig.InsecureSkipVerify || tlsConfig.RootCAs == nil {
+		t.Errorf("require: InsecureSkipVerify = %v, RootCAs = %v", tlsConfig.InsecureSkipVerify, tlsConfig.RootCAs)
+	}
+
+	tlsConfig, err = (&Configuration{SSLMode: SSLModeVerifyCA, CACertPath: caPath,
+		ClientCertPath: clientCertPath, ClientKeyPath: clientKeyPath}).tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tlsConfig.Certificates) != 1 {
+		t.Errorf("verify-ca: %d client certificates, want 1", len(tlsConfig.Certificates))
+	}
+	if err := tlsConfig.VerifyPeerCertificate([][]byte{server.der}, nil); err != nil {
+		t.Errorf("verify-ca rejected a server certificate of the CA: %v", err)
+	}
+	if err := tlsConfig.VerifyPeerCertificate([][]byte{stranger.der}, nil); err == nil {
+		t.Error("verify-ca accepted a self-signed server certificate")
+	}
+
+	tlsConfig, err = (&Configuration{SSLMode: SSLModeVerifyFull, CACertPath: caPath, Host: "db.example.com:5432"}).tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig.InsecureSkipVerify || tlsConfig.ServerName != "db.example.com" {
+		t.Errorf("verify-full: InsecureSkipVerify = %v, ServerName = %q", tlsConfig.InsecureSkipVerify, tlsConfig.ServerName)
+	}
+	if _, err := server.cert.Verify(x509.VerifyOptions{Roots: tlsConfig.RootCAs, DNSName: tlsConfig.ServerName}); err != nil {
+		t.Errorf("verify-full: the loaded CA doesn't verify the server: %v", err)
+	}
+	tlsConfig, err = (&Configuration{SSLMode: SSLModeVerifyFull, Host: "10.0.0.1:5432", ServerName: "db.example.com"}).tlsConfig()
+	if err != nil || tlsConfig.ServerName != "db.example.com" {
+		t.Errorf("verify-full with ServerName: %v, %v", tlsConfig, err)
+	}
+
+	opts, err := (&Configuration{Host: "db.example.com:5432", SSLMode: SSLModeVerifyFull, CACertPath: caPath}).pgOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.TLSConfig == nil || opts.TLSConfig.RootCAs == nil {
+		t.Errorf("pgOptions() TLSConfig = %v, want the CA loaded", opts.TLSConfig)
+	}
+
+	for name, conf := range map[string]Configuration{
+		"unknown sslMode":    {SSLMode: "prefer"},
+		"missing CA":         {SSLMode: SSLModeVerifyFull, CACertPath: filepath.Join(dir, "missing.crt")},
+		"CA without PEM":     {SSLMode: SSLModeVerifyFull, CACertPath: clientKeyPath},
+		"client without key": {SSLMode: SSLModeRequire, ClientCertPath: clientCertPath},
+	} {
+		if _, err := conf.tlsConfig(); err == nil {
+			t.Errorf("%s: tlsConfig() succeeded", name)
+		}
+	}
+}
+
+func TestInitFromViperServiceLookback(t *testing.T) {
+	var conf Configuration
+	conf.InitFromViper(viper.New())
+	if conf.ServiceLookback != 0 {
+		t.Errorf("default ServiceLookback = %s, want every service listed", conf.ServiceLookback)
+	}
+
+	v := viper.New()
+	v.Set(flagServiceLookback, "72h")
+	conf.InitFromViper(v)
+	if conf.ServiceLookback != 72*time.Hour {
+		t.Errorf("ServiceLookback = %s, want 72h", conf.ServiceLookback)
+	}
+}
+
+func TestInitFromViperStatementTimeout(t *testing.T) {
+	var conf Configuration
+	conf.InitFromViper(viper.New())
+	if conf.StatementTimeout != 0 {
+		t.Errorf("default StatementTimeout = %s, want none", conf.StatementTimeout)
+	}
+
+	v := viper.New()
+	v.Set(flagStatementTimeout, "30s")
+	conf.InitFromViper(v)
+	if conf.StatementTimeout != 30*time.Second {
+		t.Errorf("StatementTimeout = %s, want 30s", conf.StatementTimeout)
+	}
+}
+
+func TestInitFromViperTenant(t *testing.T) {
+	var conf Configuration
+	conf.InitFromViper(viper.New())
+	if conf.Tenant != "" {
+		t.Errorf("default Tenant = %q, want none", conf.Tenant)
+	}
+
+	v := viper.New()
+	v.Set(flagTenant, "shop")
+	conf.InitFromViper(v)
+	if conf.Tenant != "shop" {
+		t.Errorf("Tenant = %q, want shop", conf.Tenant)
+	}
+}
+
+func TestValidateServiceOrder(t *testing.T) {
+	tests := []struct {
+		order string
+		valid bool
+	}{
+		{order: "", valid: true},
+		{order: ServiceOrderName, valid: true},
+		{order: ServiceOrderRecent, valid: true},
+		{order: "Recent"},
+		{order: "count"},
+	}
+	for _, tt := range tests {
+		if err := (&Configuration{ServiceOrder: tt.order}).validateServiceOrder(); (err == nil) != tt.valid {
+			t.Errorf("validateServiceOrder(%q) = %v, want valid %t", tt.order, err, tt.valid)
+		}
+	}
+}
+
+func TestInitFromViperServiceOrder(t *testing.T) {
+	var conf Configuration
+	conf.InitFromViper(viper.New())
+	if conf.ServiceOrder != ServiceOrderName {
+		t.Errorf("default ServiceOrder = %q, want %q", conf.ServiceOrder, ServiceOrderName)
+	}
+
+	v := viper.New()
+	v.Set(flagServiceOrder, ServiceOrderRecent)
+	conf.InitFromViper(v)
+	if conf.ServiceOrder != ServiceOrderRecent {
+		t.Errorf("ServiceOrder = %q, want %q", conf.ServiceOrder, ServiceOrderRecent)
+	}
+}
@@ -0,0 +1,363 @@
+package pgstore
+
+import (
+	"encoding/base64"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// toModelSpan converts a stored span back into the Jaeger model. The times are
+// read from timestamptz columns with the offset of the session time zone and are
+// returned in UTC, the instant is the same whatever the time zone. A span
+// whose operation or service row is missing gets an empty name rather than
+// failing the whole trace.
+func toModelSpan(span Span) *model.Span {
+	return &model.Span{
+		SpanID:        model.SpanID(span.ID),
+		TraceID:       model.TraceID{Low: uint64(span.TraceIDLow), High: uint64(span.TraceIDHigh)},
+		OperationName: spanOperationName(span),
+		Flags:         span.Flags,
+		StartTime:     span.StartTime.UTC(),
+		Duration:      fromMicroseconds(span.Duration),
+		Tags:          normalizeOTelTags(toModelTags(span.Tags, span.TagsHstore, span.TagTypes)),
+		ProcessID:     span.ProcessID,
+		Process: &model.Process{
+			ServiceName: spanServiceName(span),
+			Tags:        toModelTags(span.ProcessTags, span.ProcessTagsHstore, span.ProcessTagTypes),
+		},
+		Warnings:   span.Warnings,
+		References: toModelSpanRef(span),
+		Logs:       toModelLogs(span),
+	}
+}
+
+// spanOperationName returns the name of the operation relation of the span,
+// empty when it wasn't loaded
+func spanOperationName(span Span) string {
+	if span.Operation == nil {
+		return ""
+	}
+	return span.Operation.OperationName
+}
+
+// spanServiceName returns the name of the service relation of the span,
+// empty when it wasn't loaded
+func spanServiceName(span Span) string {
+	if span.Service == nil {
+		return ""
+	}
+	return span.Service.ServiceName
+}
+
+// fromModelSpan converts a span of the Jaeger model for storage under the
+// resolved service and operation. A span without process, which the Writer
+// rejects, is converted without process tags.
+func fromModelSpan(span *model.Span, service *Service, operation *Operation) *Span {
+	tags, tagTypes := mapModelKV(span.Tags)
+	var processTags map[string]interface{}
+	var processTagTypes map[string]model.ValueType
+	if span.Process != nil {
+		processTags, processTagTypes = mapModelKV(span.Process.Tags)
+	}
+	return &Span{
+		ID:              int64(span.SpanID),
+		TraceIDLow:      int64(span.TraceID.Low),
+		TraceIDHigh:     int64(span.TraceID.High),
+		Operation:       operation,
+		OperationID:     operation.ID,
+		Flags:           span.Flags,
+		StartTime:       span.StartTime,
+		Duration:        toMicroseconds(span.Duration),
+		Tags:            tags,
+		TagTypes:        tagTypes,
+		Service:         service,
+		ServiceID:       service.ID,
+		ProcessID:       span.ProcessID,
+		ProcessTags:     processTags,
+		ProcessTagTypes: processTagTypes,
+		Warnings:        span.Warnings,
+		HasError:        spanHasError(span),
+	}
+}
+
+// Tags marking a failed span, the Jaeger one and the status of OpenTelemetry
+const (
+	errorTagKey      = "error"
+	otelStatusTagKey = "otel.status_code"
+)
+
+// spanHasError tells whether the span carries an error marker
+func spanHasError(span *model.Span) bool {
+	for _, tag := range span.Tags {
+		switch tag.Key {
+		case errorTagKey:
+			if (tag.VType == model.ValueType_BOOL && tag.VBool) || (tag.VType == model.ValueType_STRING && tag.VStr == "true") {
+				return true
+			}
+		case otelStatusTagKey:
+			if isOTelErrorStatus(tag) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// isOTelErrorStatus tells whether tag is the error status of a span ingested
+// through OpenTelemetry
+func isOTelErrorStatus(tag model.KeyValue) bool {
+	return tag.Key == otelStatusTagKey && tag.VType == model.ValueType_STRING && tag.VStr == "ERROR"
+}
+
+// normalizeOTelTags adds the error tag of Jaeger to the tags of a span
+// recorded through OpenTelemetry with an error status, so that the UI flags
+// it like a span of a Jaeger client
+func normalizeOTelTags(tags []model.KeyValue) []model.KeyValue {
+	failed := false
+	for _, tag := range tags {
+		if tag.Key == errorTagKey {
+			return tags
+		}
+		failed = failed || isOTelErrorStatus(tag)
+	}
+	if !failed {
+		return tags
+	}
+	return append(tags, model.Bool(errorTagKey, true))
+}
+
+// toMicroseconds converts a duration into the microseconds stored in the
+// database, dropping any sub-microsecond part
+func toMicroseconds(d time.Duration) int64 {
+	return int64(d / time.Microsecond)
+}
+
+func fromMicroseconds(us int64) time.Duration {
+	return time.Duration(us) * time.Microsecond
+}
+
+func toModelSpanRef(span Span) []model.SpanRef {
+	span_refs := make([]model.SpanRef, 0, len(span.SpanRefs))
+	for _, span_ref := range span.SpanRefs {
+		span_refs = append(span_refs, model.SpanRef{
+			TraceID: model.TraceID{Low: uint64(span_ref.TraceIDLow), High: uint64(span_ref.TraceIDHigh)},
+			SpanID:  model.SpanID(span_ref.ChildSpanID),
+			RefType: span_ref.RefType,
+		})
+	}
+	return span_refs
+}
+
+// toModelProcessMap returns one mapping per distinct ProcessID of the spans,
+// keeping the first process definition seen
+func toModelProcessMap(spans []Span) []model.Trace_ProcessMapping {
+	ret := make([]model.Trace_ProcessMapping, 0)
+	seen := make(map[string]bool)
+	for _, span := range spans {
+		if seen[span.ProcessID] {
+			continue
+		}
+		seen[span.ProcessID] = true
+		ret = append(ret, model.Trace_ProcessMapping{
+			ProcessID: span.ProcessID,
+			Process: model.Process{
+				ServiceName: spanServiceName(span),
+				Tags:        toModelTags(span.ProcessTags, span.ProcessTagsHstore, span.ProcessTagTypes),
+			},
+		})
+	}
+	return ret
+}
+
+func toModelLogs(span Span) []model.Log {
+	logs := make([]model.Log, 0, len(span.Logs))
+	for _, log := range span.Logs {
+		logs = append(logs, model.Log{
+			Timestamp: log.Timestamp.UTC(),
+			Fields:    mapToModelKV(log.Fields, log.FieldTypes),
+		})
+	}
+	return logs
+}
+
+// toModelTags rebuilds tags from whichever of the jsonb or hstore columns the
+// span was stored with
+func toModelTags(values map[string]interface{}, hstore map[string]string, types map[string]model.ValueType) []model.KeyValue {
+	if hstore != nil {
+		return hstoreToModelKV(hstore, types)
+	}
+	return mapToModelKV(values, types)
+}
+
+// hstoreModelKV returns the values of the key/values as the strings hstore
+// stores, along with the type of every value which isn't a string
+func hstoreModelKV(input []model.KeyValue) (map[string]string, map[string]model.ValueType) {
+	ret := make(map[string]string, len(input))
+	types := make(map[string]model.ValueType)
+	for _, kv := range input {
+		switch kv.VType {
+		case model.ValueType_STRING:
+			ret[kv.Key] = kv.VStr
+		case model.ValueType_BOOL:
+			ret[kv.Key] = strconv.FormatBool(kv.VBool)
+		case model.ValueType_INT64:
+			ret[kv.Key] = strconv.FormatInt(kv.VInt64, 10)
+		case model.ValueType_FLOAT64:
+			ret[kv.Key] = strconv.FormatFloat(kv.VFloat64, 'g', -1, 64)
+		case model.ValueType_BINARY:
+			ret[kv.Key] = base64.StdEncoding.EncodeToString(kv.VBinary)
+		default:
+			continue
+		}
+		if kv.VType != model.ValueType_STRING {
+			types[kv.Key] = kv.VType
+		}
+	}
+	if len(types) == 0 {
+		types = nil
+	}
+	return ret, types
+}
+
+// hstoreToModelKV rebuilds key/values from their hstore strings ordered by
+// key, values which don't parse as their type are returned as strings
+func hstoreToModelKV(input map[string]string, types map[string]model.ValueType) []model.KeyValue {
+	keys := make([]string, 0, len(input))
+	for k := range input {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ret := make([]model.KeyValue, 0, len(input))
+	for _, k := range keys {
+		v := input[k]
+		kv := model.String(k, v)
+		switch types[k] {
+		case model.ValueType_BOOL:
+			if vBool, err := strconv.ParseBool(v); err == nil {
+				kv = model.Bool(k, vBool)
+			}
+		case model.ValueType_INT64:
+			if vInt64, err := strconv.ParseInt(v, 10, 64); err == nil {
+				kv = model.Int64(k, vInt64)
+			}
+		case model.ValueType_FLOAT64:
+			if vFloat64, err := strconv.ParseFloat(v, 64); err == nil {
+				kv = model.Float64(k, vFloat64)
+			}
+		case model.ValueType_BINARY:
+			if vBytes, err := base64.StdEncoding.DecodeString(v); err == nil {
+				kv = model.Binary(k, vBytes)
+			}
+		}
+		ret = append(ret, kv)
+	}
+	return ret
+}
+
+// mapToModelKV rebuilds key/values from their stored values, types holds the
+// value type of the keys which aren't plain JSON strings, bools or numbers.
+// Rows written without types keep the type of their JSON value. The order of
+// the key/values isn't stored, they are returned ordered by key.
+func mapToModelKV(input map[string]interface{}, types map[string]model.ValueType) []model.KeyValue {
+	keys := make([]string, 0, len(input))
+	for k := range input {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	ret := make([]model.KeyValue, 0, len(input))
+	for _, k := range keys {
+		if kv, ok := toModelKV(k, input[k], types[k]); ok {
+			ret = append(ret, kv)
+		}
+	}
+	return ret
+}
+
+func toModelKV(k string, v interface{}, vType model.ValueType) (model.KeyValue, bool) {
+	switch vType {
+	case model.ValueType_INT64:
+		switch value := v.(type) {
+		case string:
+			if vInt64, err := strconv.ParseInt(value, 10, 64); err == nil {
+				return model.Int64(k, vInt64), true
+			}
+		case float64:
+			return model.Int64(k, int64(value)), true
+		}
+	case model.ValueType_BINARY:
+		if value, ok := v.(string); ok {
+			if vBytes, err := base64.StdEncoding.DecodeString(value); err == nil {
+				return model.Binary(k, vBytes), true
+			}
+		}
+	}
+
+	switch value := v.(type) {
+	case string:
+		return model.String(k, value), true
+	case []byte:
+		return model.Binary(k, value), true
+	case bool:
+		return model.Bool(k, value), true
+	case int64:
+		return model.Int64(k, value), true
+	case float64:
+		return model.Float64(k, value), true
+	}
+	return model.KeyValue{}, false
+}
+
+// mapModelKV returns the values of the key/values to be stored as JSON along
+// with the types JSON can't tell apart. Int64 values are stored as decimal
+// strings so that they survive beyond float64 precision, binary ones as base64.
+// Both compare as text the same way in tag searches.
+func mapModelKV(input []model.KeyValue) (map[string]interface{}, map[string]model.ValueType) {
+	ret := make(map[string]interface{})
+	types := make(map[string]model.ValueType)
+	var value interface{}
+	for _, kv := range input {
+		value = nil
+		if kv.VType == model.ValueType_STRING {
+			value = kv.VStr
+		} else if kv.VType == model.ValueType_BOOL {
+			value = kv.VBool
+		} else if kv.VType == model.ValueType_INT64 {
+			value = strconv.FormatInt(kv.VInt64, 10)
+			types[kv.Key] = kv.VType
+		} else if kv.VType == model.ValueType_FLOAT64 {
+			value = kv.VFloat64
+		} else if kv.VType == model.ValueType_BINARY {
+			value = base64.StdEncoding.EncodeToString(kv.VBinary)
+			types[kv.Key] = kv.VType
+		}
+		ret[kv.Key] = value
+	}
+	if len(types) == 0 {
+		types = nil
+	}
+	return ret, types
+}
+
+func toDBLogs(input *model.Span) []*Log {
+	ret := make([]*Log, 0, len(input.Logs))
+	for _, log := range input.Logs {
+		fields, fieldTypes := mapModelKV(log.Fields)
+		ret = append(ret, &Log{TraceIDLow: int64(input.TraceID.Low), TraceIDHigh: int64(input.TraceID.High), SpanID: int64(input.SpanID),
+			Timestamp: log.Timestamp, Fields: fields, FieldTypes: fieldTypes})
+	}
+	return ret
+}
+
+func toDBSpanRefs(input *model.Span) []*SpanRef {
+	ret := make([]*SpanRef, 0, len(input.References))
+	for i, ref := range input.References {
+		if ref.SpanID > 0 {
+			ret = append(ret, &SpanRef{SpanID: int64(input.SpanID), ChildSpanID: int64(ref.SpanID), TraceIDLow: int64(ref.TraceID.Low), TraceIDHigh: int64(ref.TraceID.High),
+				SpanTraceIDLow: int64(input.TraceID.Low), SpanTraceIDHigh: int64(input.TraceID.High), RefType: ref.RefType, Ordinal: i})
+		}
+	}
+	return ret
+}
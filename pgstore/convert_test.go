@@ -0,0 +1,296 @@
+package pgstore
+
+import (
+	"encoding/json"
+	"math"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// jsonRoundTrip passes v through JSON like the jsonb columns do
+func jsonRoundTrip(tb testing.TB, v interface{}, out interface{}) {
+	tb.Helper()
+	doc, err := json.Marshal(v)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if err := json.Unmarshal(doc, out); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestTagTypesRoundTrip(t *testing.T) {
+	// ordered by key like mapToModelKV returns them
+	tags := []model.KeyValue{
+		model.Binary("binary", []byte{0, 1, 0xfe, 0xff}),
+		model.Bool("bool", true),
+		model.Float64("float64", 0.25),
+		model.Int64("int64", math.MaxInt64),
+		model.Int64("negative", math.MinInt64),
+		model.String("string", "42"),
+	}
+	values, types := mapModelKV(tags)
+
+	hstore, hstoreTypes := hstoreModelKV(tags)
+	if got := hstoreToModelKV(hstore, hstoreTypes); !reflect.DeepEqual(got, tags) {
+		t.Errorf("hstore round trip = %v, want %v", got, tags)
+	}
+
+	var storedValues map[string]interface{}
+	jsonRoundTrip(t, values, &storedValues)
+	var storedTypes map[string]model.ValueType
+	jsonRoundTrip(t, types, &storedTypes)
+
+	got := mapToModelKV(storedValues, storedTypes)
+	if !reflect.DeepEqual(got, tags) {
+		t.Errorf("round trip = %v, want %v", got, tags)
+	}
+	for i, tag := range got {
+		if tag.VType != tags[i].VType {
+			t.Errorf("%s has type %s, want %s", tag.Key, tag.VType, tags[i].VType)
+		}
+	}
+}
+
+func TestToModelKVWithoutTypes(t *testing.T) {
+	// rows written before the types were stored keep the type of their JSON value
+	var stored map[string]interface{}
+	jsonRoundTrip(t, map[string]interface{}{"bool": false, "number": 7, "string": "x"}, &stored)
+	want := []model.KeyValue{model.Bool("bool", false), model.Float64("number", 7), model.String("string", "x")}
+	if got := mapToModelKV(stored, nil); !reflect.DeepEqual(got, want) {
+		t.Errorf("mapToModelKV() = %v, want %v", got, want)
+	}
+
+	// a value which doesn't parse as its type stays a string
+	if kv, ok := toModelKV("int64", "not a number", model.ValueType_INT64); !ok || kv.VType != model.ValueType_STRING {
+		t.Errorf("toModelKV() = %v, %v, want a string", kv, ok)
+	}
+	if _, ok := toModelKV("object", map[string]interface{}{}, model.ValueType_STRING); ok {
+		t.Error("toModelKV() converted a JSON object")
+	}
+}
+
+// testModelSpan returns a span of the Jaeger model using every part the
+// storage keeps, its tags and fields ordered by key like they are read back
+func testModelSpan() *model.Span {
+	traceID := model.TraceID{High: 1, Low: math.MaxUint64}
+	start := time.Date(2020, 3, 1, 12, 0, 0, 123456000, time.UTC)
+	// one of each value type
+	values := func(prefix string, extra ...model.KeyValue) []model.KeyValue {
+		kvs := append([]model.KeyValue{
+			model.Binary(prefix+"binary", []byte{0, 0xff}),
+			model.Bool(prefix+"bool", false),
+			model.Float64(prefix+"float64", -1.5),
+			model.Int64(prefix+"int64", math.MinInt64),
+			model.String(prefix+"string", "true"),
+		}, extra...)
+		sort.Slice(kvs, func(i, j int) bool { return kvs[i].Key < kvs[j].Key })
+		return kvs
+	}
+	return &model.Span{
+		TraceID:       traceID,
+		SpanID:        model.SpanID(math.MaxUint64),
+		OperationName: "GET /",
+		References: []model.SpanRef{
+			model.NewChildOfRef(traceID, 1),
+			model.NewFollowsFromRef(model.TraceID{Low: 2}, 3),
+		},
+		Flags:     model.Flags(3),
+		StartTime: start,
+		Duration:  1500 * time.Microsecond,
+		Tags:      values("", model.Bool("error", true)),
+		Logs: []model.Log{
+			{Timestamp: start, Fields: values("")},
+			{Timestamp: start.Add(time.Millisecond), Fields: []model.KeyValue{model.String("event", "done")}},
+		},
+		ProcessID: "p1",
+		Process:   model.NewProcess("frontend", values("process.")),
+		Warnings:  []string{"clock skew"},
+	}
+}
+
+func TestModelSpanRoundTrip(t *testing.T) {
+	for _, tagStorage := range []string{TagStorageJSONB, TagStorageHstore} {
+		t.Run(tagStorage, func(t *testing.T) {
+			want := testModelSpan()
+			service := &Service{ID: 1, ServiceName: want.Process.ServiceName}
+			operation := &Operation{ID: 2, ServiceID: 1, OperationName: want.OperationName}
+			stored := fromModelSpan(want, service, operation)
+			if stored.ServiceID != 1 || stored.OperationID != 2 || !stored.HasError || stored.Duration != 1500 {
+				t.Errorf("fromModelSpan() = service %d, operation %d, error %v, duration %d", stored.ServiceID, stored.OperationID, stored.HasError, stored.Duration)
+			}
+
+			// the columns as they are read back
+			if tagStorage == TagStorageHstore {
+				stored.Tags, stored.ProcessTags = nil, nil
+				stored.TagsHstore, stored.TagTypes = hstoreModelKV(want.Tags)
+				stored.ProcessTagsHstore, stored.ProcessTagTypes = hstoreModelKV(want.Process.Tags)
+			} else {
+				jsonRoundTrip(t, stored.Tags, &stored.Tags)
+				jsonRoundTrip(t, stored.ProcessTags, &stored.ProcessTags)
+			}
+			stored.SpanRefs, stored.Logs = toDBSpanRefs(want), toDBLogs(want)
+			for _, log := range stored.Logs {
+				var fields map[string]interface{}
+				jsonRoundTrip(t, log.Fields, &fields)
+				log.Fields = fields
+			}
+
+			if got := toModelSpan(*stored); !reflect.DeepEqual(got, want) {
+				t.Errorf("round trip = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestToDBSpanDetails(t *testing.T) {
+	span := testModelSpan()
+	span.References = append(span.References, model.SpanRef{TraceID: span.TraceID})
+	refs := toDBSpanRefs(span)
+	if len(refs) != 2 {
+		t.Fatalf("toDBSpanRefs() = %v, want the refs without the one to no span", refs)
+	}
+	for i, ref := range refs {
+		if ref.SpanID != int64(span.SpanID) || ref.ChildSpanID != int64(span.References[i].SpanID) || ref.Ordinal != i ||
+			ref.SpanTraceIDLow != int64(span.TraceID.Low) || ref.SpanTraceIDHigh != int64(span.TraceID.High) {
+			t.Errorf("ref %d = %+v, want held by the span at its position", i, ref)
+		}
+	}
+	if refs[1].TraceIDLow != 2 || refs[1].RefType != model.SpanRefType_FOLLOWS_FROM {
+		t.Errorf("ref to another trace = %+v", refs[1])
+	}
+
+	logs := toDBLogs(span)
+	if len(logs) != 2 {
+		t.Fatalf("toDBLogs() = %v, want both logs", logs)
+	}
+	for _, log := range logs {
+		if log.TraceIDLow != int64(span.TraceID.Low) || log.TraceIDHigh != 1 || log.SpanID != int64(span.SpanID) {
+			t.Errorf("log %+v isn't of the span", log)
+		}
+	}
+}
+
+func TestConvertEmpty(t *testing.T) {
+	got := toModelSpan(Span{})
+	if got.Process == nil || got.Process.ServiceName != "" || got.OperationName != "" {
+		t.Errorf("toModelSpan() of a span without relations = %+v, want empty names", got)
+	}
+	if len(got.Tags) != 0 || len(got.Process.Tags) != 0 || len(got.References) != 0 || len(got.Logs) != 0 {
+		t.Errorf("toModelSpan() of an empty span = %+v, want nothing attached", got)
+	}
+
+	stored := fromModelSpan(&model.Span{}, &Service{}, &Operation{})
+	if len(stored.Tags) != 0 || stored.TagTypes != nil || stored.ProcessTags != nil || stored.ProcessTagTypes != nil || stored.HasError {
+		t.Errorf("fromModelSpan() of an empty span without process = %+v", stored)
+	}
+	if refs, logs := toDBSpanRefs(&model.Span{}), toDBLogs(&model.Span{}); len(refs) != 0 || len(logs) != 0 {
+		t.Errorf("toDBSpanRefs() = %v, toDBLogs() = %v, want none", refs, logs)
+	}
+
+	for name, input := range map[string][]model.KeyValue{"nil": nil, "empty": {}} {
+		if values, types := mapModelKV(input); len(values) != 0 || types != nil {
+			t.Errorf("mapModelKV(%s) = %v, %v", name, values, types)
+		}
+		if values, types := hstoreModelKV(input); len(values) != 0 || types != nil {
+			t.Errorf("hstoreModelKV(%s) = %v, %v", name, values, types)
+		}
+	}
+	if got := mapToModelKV(nil, nil); got == nil || len(got) != 0 {
+		t.Errorf("mapToModelKV(nil) = %#v, want an empty slice", got)
+	}
+	if got := hstoreToModelKV(map[string]string{}, nil); got == nil || len(got) != 0 {
+		t.Errorf("hstoreToModelKV(empty) = %#v, want an empty slice", got)
+	}
+	if got := toModelTags(nil, nil, nil); len(got) != 0 {
+		t.Errorf("toModelTags() of no column = %v", got)
+	}
+}
+
+func TestToModelProcessMap(t *testing.T) {
+	frontend := &Service{ServiceName: "frontend"}
+	backend := &Service{ServiceName: "backend"}
+	spans := []Span{
+		{ID: 1, ProcessID: "p1", Service: frontend, ProcessTags: map[string]interface{}{"hostname": "host-1"}},
+		{ID: 2, ProcessID: "p2", Service: backend},
+		{ID: 3, ProcessID: "p1", Service: frontend, ProcessTags: map[string]interface{}{"hostname": "host-1"}},
+		// a later definition of a known ProcessID is ignored
+		{ID: 4, ProcessID: "p2", Service: backend, ProcessTags: map[string]interface{}{"hostname": "host-2"}},
+	}
+	want := []model.Trace_ProcessMapping{
+		{ProcessID: "p1", Process: model.Process{ServiceName: "frontend", Tags: []model.KeyValue{model.String("hostname", "host-1")}}},
+		{ProcessID: "p2", Process: model.Process{ServiceName: "backend", Tags: []model.KeyValue{}}},
+	}
+	if got := toModelProcessMap(spans); !reflect.DeepEqual(got, want) {
+		t.Errorf("toModelProcessMap() = %+v, want %+v", got, want)
+	}
+	if got := toModelProcessMap(nil); got == nil || len(got) != 0 {
+		t.Errorf("toModelProcessMap(nil) = %#v, want an empty map", got)
+	}
+}
+
+func TestNormalizeOTelTags(t *testing.T) {
+	errorStatus := model.String("otel.status_code", "ERROR")
+	tests := []struct {
+		name string
+		tags []model.KeyValue
+		want []model.KeyValue
+	}{
+		{name: "no tags", tags: nil, want: nil},
+		{name: "error status", tags: []model.KeyValue{errorStatus}, want: []model.KeyValue{errorStatus, model.Bool("error", true)}},
+		{name: "ok status", tags: []model.KeyValue{model.String("otel.status_code", "OK")},
+			want: []model.KeyValue{model.String("otel.status_code", "OK")}},
+		{name: "error tag kept", tags: []model.KeyValue{errorStatus, model.Bool("error", false)},
+			want: []model.KeyValue{errorStatus, model.Bool("error", false)}},
+		{name: "not a string", tags: []model.KeyValue{model.Int64("otel.status_code", 2)},
+			want: []model.KeyValue{model.Int64("otel.status_code", 2)}},
+		{name: "lower case", tags: []model.KeyValue{model.String("otel.status_code", "error")},
+			want: []model.KeyValue{model.String("otel.status_code", "error")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := normalizeOTelTags(tt.tags); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("normalizeOTelTags(%v) = %v, want %v", tt.tags, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSpanHasError(t *testing.T) {
+	tests := []struct {
+		name string
+		tags []model.KeyValue
+		want bool
+	}{
+		{name: "no tags", want: false},
+		{name: "error tag", tags: []model.KeyValue{model.Bool("error", true)}, want: true},
+		{name: "error string", tags: []model.KeyValue{model.String("error", "true")}, want: true},
+		{name: "error false", tags: []model.KeyValue{model.Bool("error", false)}, want: false},
+		{name: "error status", tags: []model.KeyValue{model.String("otel.status_code", "ERROR")}, want: true},
+		{name: "ok status", tags: []model.KeyValue{model.String("otel.status_code", "OK")}, want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := spanHasError(&model.Span{Tags: tt.tags}); got != tt.want {
+				t.Errorf("spanHasError(%v) = %v, want %v", tt.tags, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestToModelSpanUTC(t *testing.T) {
+	// as read with the session time zone of the server
+	tokyo := time.FixedZone("JST", 9*3600)
+	start := time.Date(2020, 3, 1, 21, 0, 0, 0, tokyo)
+	got := toModelSpan(Span{StartTime: start, Logs: []*Log{{Timestamp: start.Add(time.Second)}}})
+	if got.StartTime.Location() != time.UTC || !got.StartTime.Equal(start) {
+		t.Errorf("StartTime = %s, want %s in UTC", got.StartTime, start)
+	}
+	if len(got.Logs) != 1 || got.Logs[0].Timestamp.Location() != time.UTC || !got.Logs[0].Timestamp.Equal(start.Add(time.Second)) {
+		t.Errorf("logs = %v, want the timestamp in UTC", got.Logs)
+	}
+}
@@ -6,44 +6,132 @@ import (
 	"github.com/jaegertracing/jaeger/model"
 )
 
+// The trace and span ids of Jaeger are uint64 while the columns are signed
+// bigint, the ids are stored as their int64 two's complement so that the ones
+// with the high bit set fit and come back unchanged. A 64 bit trace id has a
+// zero TraceIDHigh, like in model.TraceID it is the same id as a 128 bit one
+// whose high word is zero, Jaeger doesn't tell them apart either. The words
+// are stored even when zero, the ORM would store NULL which no trace id
+// predicate matches.
+
 type Log struct {
 	ID        uint64
 	tableName struct{} `pg:"span_logs"`
-	SpanID    model.SpanID
-	Timestamp time.Time
-	Fields    map[string]interface{}
+	// trace of the span, NULL for the logs whose span was gone already when
+	// migration 18 added the columns
+	TraceIDLow  int64 `sql:",use_zero"`
+	TraceIDHigh int64 `sql:",use_zero"`
+	SpanID      int64
+	Timestamp   time.Time
+	Fields      map[string]interface{}
+	// value types of the fields JSON can't carry, see mapModelKV
+	FieldTypes map[string]model.ValueType
+	// tenant of the span, see Span.TenantID
+	TenantID string
 }
 type SpanRef struct {
-	ID           uint64
-	TraceIDLow   uint64
-	TraceIDHigh  uint64
-	SourceSpanID model.SpanID
-	ChildSpanID  model.SpanID
-	RefType      model.SpanRefType `sql:",use_zero"`
+	ID uint64
+	// trace of the referenced span, which differs from the one of the span
+	// holding the reference e.g. for a FOLLOWS_FROM into another trace
+	TraceIDLow  int64 `sql:",use_zero"`
+	TraceIDHigh int64 `sql:",use_zero"`
+	// trace of the span holding the reference, the refs of a span are read by
+	// it. It is the referenced trace for the refs stored before migration 22.
+	SpanTraceIDLow  int64 `sql:",use_zero"`
+	SpanTraceIDHigh int64 `sql:",use_zero"`
+	// span holding the reference
+	SpanID int64
+	// referenced span, the parent for CHILD_OF, of trace TraceIDLow/TraceIDHigh.
+	// It is no foreign key as the referenced span may arrive later or never,
+	// the reference is stored and returned as is either way.
+	ChildSpanID int64
+	RefType     model.SpanRefType `sql:",use_zero"`
+	// position among the references of the span, the first one usually being
+	// the parent. It is 0 for the references stored before migration 13.
+	Ordinal int
+	// tenant of the span holding the reference, see Span.TenantID
+	TenantID string
 }
 type Span struct {
-	ID          model.SpanID `pg:",pk"`
-	TraceIDLow  uint64
-	TraceIDHigh uint64
+	ID          int64 `pg:",pk"`
+	TraceIDLow  int64 `sql:",use_zero"`
+	TraceIDHigh int64 `sql:",use_zero"`
 	Operation   *Operation
-	OperationID uint
-	Flags       model.Flags
-	StartTime   time.Time `pg:",pk"`
-	Duration    time.Duration
-	Tags        map[string]interface{}
-	Service     *Service
-	ServiceID   uint
-	ProcessID   string
-	ProcessTags map[string]interface{}
-	Warnings    []string
-	SpanRefs    []*SpanRef `pg:",rel:has-many,fk:source_span_id"`
-	//Logs          []*Log `pg:"fk:span_id"`
+	OperationID int64
+	Flags       model.Flags `sql:",use_zero"`
+	StartTime   time.Time   `pg:",pk"`
+	// microseconds, the precision of Jaeger, a zero duration is stored as 0
+	// rather than NULL so that it matches DurationMax
+	Duration int64 `sql:",use_zero"`
+	Tags     map[string]interface{}
+	// value types of the tags JSON can't carry, see mapModelKV
+	TagTypes        map[string]model.ValueType
+	Service         *Service
+	ServiceID       int64
+	ProcessID       string
+	ProcessTags     map[string]interface{}
+	ProcessTagTypes map[string]model.ValueType
+	// used instead of Tags and ProcessTags with the hstore TagStorage, the
+	// columns only exist once MigrateHstore ran, see selectSpanColumns
+	TagsHstore        map[string]string `pg:",hstore"`
+	ProcessTagsHstore map[string]string `pg:",hstore"`
+	// stored as a jsonb array, NULL when the span carries no warnings
+	Warnings []string
+	// derived from the tags by spanHasError to search for failed spans
+	HasError bool `sql:",use_zero"`
+	// empty unless the Writer stores the spans of a tenant, see WithTenant.
+	// The trace and span ids are unique per tenant.
+	TenantID string
+	// loaded by loadSpanDetails, the composite primary key can't back a has-many relation
+	SpanRefs []*SpanRef `pg:"-"`
+	Logs     []*Log     `pg:"-"`
 }
 type Operation struct {
-	ID            uint
-	OperationName string `pg:",unique"`
+	ID            int64
+	ServiceID     int64  `pg:",unique:service_operation"`
+	OperationName string `pg:",unique:service_operation"`
+	SpanKind      string `pg:",unique:service_operation,use_zero"`
+	// set when OperationName was cut to Configuration.MaxOperationNameLength
+	Truncated bool `sql:",use_zero"`
 }
 type Service struct {
-	ID          uint
+	ID          int64
 	ServiceName string `pg:",unique"`
 }
+type Dependency struct {
+	ID        uint64
+	Ts        time.Time
+	Parent    string
+	Child     string
+	CallCount uint64 `sql:",use_zero"`
+	Source    string
+	// empty unless the DependencyWriter stores the links of a tenant, see
+	// WithDependencyTenant
+	TenantID string
+}
+
+// ServiceAlias makes Alias another name of service ServiceName, see
+// Writer.AddServiceAlias
+type ServiceAlias struct {
+	tableName   struct{} `pg:"service_aliases"`
+	Alias       string   `pg:",pk"`
+	ServiceName string
+}
+type SamplingThroughput struct {
+	ID            uint64
+	tableName     struct{} `pg:"sampling_throughput"`
+	Ts            time.Time
+	ServiceName   string
+	OperationName string
+	Count         int64 `sql:",use_zero"`
+	// the sampling probabilities seen, formatted as reported
+	Probabilities []string `pg:",array"`
+}
+type SamplingProbabilities struct {
+	ID            uint64
+	tableName     struct{} `pg:"sampling_probabilities"`
+	Ts            time.Time
+	Hostname      string
+	Probabilities map[string]map[string]float64
+	QPS           map[string]map[string]float64
+}
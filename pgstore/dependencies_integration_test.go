@@ -0,0 +1,222 @@
+//go:build integration
+// +build integration
+
+package pgstore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+)
+
+func TestGetDependenciesWindow(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	writer := NewWriter(db, hclog.NewNullLogger())
+	reader := NewReader(db, hclog.NewNullLogger())
+
+	endTs := time.Now().Truncate(time.Microsecond)
+	call := func(trace uint64, parentStart, childStart time.Time, parentService, childService string) {
+		traceID := model.TraceID{Low: trace}
+		child := testSpan(traceID, 2, childService, "query", childStart)
+		child.References = []model.SpanRef{model.NewChildOfRef(traceID, 1)}
+		writeTestSpans(t, writer, testSpan(traceID, 1, parentService, "GET /", parentStart), child)
+	}
+	// the window holds the callers: the callee started after endTs counts,
+	// the callee of a caller older than the lookback doesn't
+	call(1, endTs.Add(-time.Minute), endTs.Add(time.Second), "frontend", "backend")
+	call(2, endTs.Add(-2*time.Hour), endTs.Add(-time.Minute), "frontend", "payments")
+	call(3, endTs, endTs, "frontend", "search")
+	// a FOLLOWS_FROM link is no call
+	traceID := model.TraceID{Low: 4}
+	consumer := testSpan(traceID, 2, "worker", "consume", endTs.Add(-2*time.Minute))
+	consumer.References = []model.SpanRef{model.NewFollowsFromRef(traceID, 1)}
+	writeTestSpans(t, writer, testSpan(traceID, 1, "frontend", "publish", endTs.Add(-2*time.Minute)), consumer)
+
+	deps, err := reader.GetDependencies(endTs, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []model.DependencyLink{{Parent: "frontend", Child: "backend", CallCount: 1, Source: model.JaegerDependencyLinkSource}}
+	if !reflect.DeepEqual(deps, want) {
+		t.Errorf("GetDependencies() = %v, want %v", deps, want)
+	}
+}
+
+// naiveDependenciesQuery is liveDependenciesQuery joining every reference
+// before the window applies, the form BenchmarkLiveDependencies compares with
+const naiveDependenciesQuery = `SELECT parent_service.service_name AS parent, child_service.service_name AS child,
+	count(*) AS call_count, ? AS source
+FROM span_refs AS span_ref
+JOIN spans AS child_spans ON child_spans.id = span_ref.span_id
+	AND child_spans.trace_id_low = span_ref.span_trace_id_low AND child_spans.trace_id_high = span_ref.span_trace_id_high
+JOIN spans AS parent_spans ON parent_spans.id = span_ref.child_span_id
+	AND parent_spans.trace_id_low = span_ref.trace_id_low AND parent_spans.trace_id_high = span_ref.trace_id_high
+JOIN services AS child_service ON child_service.id = child_spans.service_id
+JOIN services AS parent_service ON parent_service.id = parent_spans.service_id
+WHERE parent_spans.start_time >= ? AND parent_spans.start_time < ?
+	AND (? = '' OR parent_spans.tenant_id = ?) AND span_ref.ref_type = ?
+GROUP BY parent_service.service_name, child_service.service_name
+ORDER BY parent ASC, child ASC`
+
+// benchmarkSpanRefs is the number of calls seeded for BenchmarkLiveDependencies,
+// one per second going back from now
+const benchmarkSpanRefs = 1000000
+
+// BenchmarkLiveDependencies computes the dependencies of the last hour out of
+// benchmarkSpanRefs calls with liveDependenciesQuery and with the naive join
+func BenchmarkLiveDependencies(b *testing.B) {
+	db, done := newTestDB(b)
+	defer done()
+	if _, err := db.Exec(`
+INSERT INTO services (id, service_name) VALUES (1, 'frontend'), (2, 'backend');
+INSERT INTO operations (id, service_id, operation_name, span_kind) VALUES (1, 1, 'GET /', ''), (2, 2, 'query', '');
+INSERT INTO spans (id, trace_id_low, trace_id_high, operation_id, flags, start_time, duration, service_id, process_id)
+	SELECT span.id, i, 0, span.id, 0, now() - i * interval '1 second', 1000, span.id, ''
+	FROM generate_series(1, ?) AS i, (VALUES (1), (2)) AS span (id);
+INSERT INTO span_refs (trace_id_low, trace_id_high, span_trace_id_low, span_trace_id_high, span_id, child_span_id, ref_type, ordinal)
+	SELECT i, 0, i, 0, 2, 1, ?, 0 FROM generate_series(1, ?) AS i;
+ANALYZE;
+`, benchmarkSpanRefs, model.SpanRefType_CHILD_OF, benchmarkSpanRefs); err != nil {
+		b.Fatal(err)
+	}
+	endTs := time.Now()
+	want := []model.DependencyLink{{Parent: "frontend", Child: "backend", Source: model.JaegerDependencyLinkSource}}
+
+	for name, query := range map[string]string{"Naive": naiveDependenciesQuery, "Windowed": liveDependenciesQuery} {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				var deps []model.DependencyLink
+				params := []interface{}{model.JaegerDependencyLinkSource, endTs.Add(-time.Hour), endTs, "", "", model.SpanRefType_CHILD_OF}
+				if _, err := db.QueryContext(context.Background(), &deps, query, params...); err != nil {
+					b.Fatal(err)
+				}
+				if len(deps) != 1 || deps[0].Parent != want[0].Parent || deps[0].Child != want[0].Child {
+					b.Fatalf("dependencies = %v, want %v", deps, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDependencyWriterRoundTrip(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	writer := NewDependencyWriter(db, hclog.NewNullLogger())
+	reader := NewReader(db, hclog.NewNullLogger())
+
+	endTs := time.Now().Truncate(time.Microsecond)
+	// two buckets within the window summed up, one older left out
+	buckets := map[time.Time][]model.DependencyLink{
+		endTs.Add(-time.Hour): {{Parent: "frontend", Child: "backend", CallCount: 2}},
+		endTs.Add(-time.Minute): {{Parent: "frontend", Child: "backend", CallCount: 3},
+			{Parent: "backend", Child: "db", CallCount: 1, Source: "spark"}},
+		endTs.Add(-3 * time.Hour): {{Parent: "frontend", Child: "search", CallCount: 5}},
+	}
+	for ts, links := range buckets {
+		if err := writer.WriteDependencies(ts, links); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.WriteDependencies(endTs, nil); err != nil {
+		t.Errorf("WriteDependencies() without links = %v", err)
+	}
+
+	deps, err := reader.GetDependencies(endTs, 2*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []model.DependencyLink{
+		{Parent: "backend", Child: "db", CallCount: 1, Source: "spark"},
+		{Parent: "frontend", Child: "backend", CallCount: 5, Source: model.JaegerDependencyLinkSource},
+	}
+	if !reflect.DeepEqual(deps, want) {
+		t.Errorf("GetDependencies() = %v, want %v", deps, want)
+	}
+}
+
+func TestGetDependenciesRefTypes(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	writer := NewWriter(db, hclog.NewNullLogger())
+	reader := NewReader(db, hclog.NewNullLogger())
+
+	// the worker is called by the scheduler and follows from the publisher
+	endTs := time.Now().Truncate(time.Microsecond)
+	traceID := model.TraceID{Low: 1}
+	start := endTs.Add(-time.Minute)
+	worker := testSpan(traceID, 3, "worker", "consume", start)
+	worker.References = []model.SpanRef{model.NewFollowsFromRef(traceID, 1), model.NewChildOfRef(traceID, 2)}
+	writeTestSpans(t, writer, testSpan(traceID, 1, "publisher", "publish", start), testSpan(traceID, 2, "scheduler", "run", start), worker)
+
+	deps, err := reader.GetDependencies(endTs, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []model.DependencyLink{{Parent: "scheduler", Child: "worker", CallCount: 1, Source: model.JaegerDependencyLinkSource}}
+	if !reflect.DeepEqual(deps, want) {
+		t.Errorf("GetDependencies() = %v, want %v", deps, want)
+	}
+
+	trace, err := reader.GetTrace(context.Background(), traceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, span := range trace.Spans {
+		if span.SpanID == 3 && !reflect.DeepEqual(span.References, worker.References) {
+			t.Errorf("worker references = %v, want %v", span.References, worker.References)
+		}
+	}
+}
+
+func TestGetDependenciesJoinsReferringSpan(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	writer := NewWriter(db, hclog.NewNullLogger())
+	reader := NewReader(db, hclog.NewNullLogger())
+
+	// the callee has the lower id, and another trace reuses both ids
+	endTs := time.Now().Truncate(time.Microsecond)
+	start := endTs.Add(-time.Minute)
+	traceID := model.TraceID{Low: 1}
+	callee := testSpan(traceID, 3, "backend", "query", start)
+	callee.References = []model.SpanRef{model.NewChildOfRef(traceID, 5)}
+	other := model.TraceID{Low: 2}
+	writeTestSpans(t, writer, testSpan(traceID, 5, "frontend", "GET /", start), callee,
+		testSpan(other, 3, "search", "index", start), testSpan(other, 5, "mail", "send", start))
+
+	deps, err := reader.GetDependencies(endTs, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []model.DependencyLink{{Parent: "frontend", Child: "backend", CallCount: 1, Source: model.JaegerDependencyLinkSource}}
+	if !reflect.DeepEqual(deps, want) {
+		t.Errorf("GetDependencies() = %v, want %v", deps, want)
+	}
+}
+
+func TestGetDependenciesCanceled(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	endTs := time.Now()
+	traceID := model.TraceID{Low: 1}
+	child := testSpan(traceID, 2, "backend", "query", endTs.Add(-time.Minute))
+	child.References = []model.SpanRef{model.NewChildOfRef(traceID, 1)}
+	writeTestSpans(t, NewWriter(db, hclog.NewNullLogger()), testSpan(traceID, 1, "frontend", "GET /", endTs.Add(-time.Minute)), child)
+
+	release := lockSpanTables(t, db)
+	defer release()
+	for name, conf := range map[string]*Configuration{"uncached": {}, "cached": {DependencyCacheTTL: time.Minute}} {
+		t.Run(name, func(t *testing.T) {
+			reader := NewReader(db, hclog.NewNullLogger(), WithConfiguration(conf))
+			assertCanceledPromptly(t, "GetDependenciesContext()", func(ctx context.Context) error {
+				_, err := reader.GetDependenciesContext(ctx, endTs, time.Hour)
+				return err
+			})
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package pgstore
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// dependencyKey identifies a GetDependencies window of a tenant, endTs is
+// truncated to the TTL so that polls of a moving window share an entry
+type dependencyKey struct {
+	tenant   string
+	endTs    int64
+	lookback time.Duration
+}
+
+type dependencyEntry struct {
+	links   []model.DependencyLink
+	expires time.Time
+}
+
+// dependencyCall is a computation in flight, waited for by the callers of the
+// same window instead of running it again
+type dependencyCall struct {
+	done  chan struct{}
+	links []model.DependencyLink
+	err   error
+	// canceled tells that the computation failed with the context of its
+	// caller done
+	canceled bool
+}
+
+// dependencyCache keeps the dependencies computed per window for
+// Configuration.DependencyCacheTTL
+type dependencyCache struct {
+	mu       sync.Mutex
+	entries  map[dependencyKey]dependencyEntry
+	inFlight map[dependencyKey]*dependencyCall
+}
+
+// get returns the cached links of the window of tenant or computes them once
+// with load, concurrent callers of the same window share the computation. A
+// computation given up by the context of its caller is run again by the
+// waiters whose context is still valid.
+func (c *dependencyCache) get(ctx context.Context, ttl time.Duration, tenant string, endTs time.Time, lookback time.Duration,
+	load func() ([]model.DependencyLink, error)) ([]model.DependencyLink, error) {
+	key := dependencyKey{tenant: tenant, endTs: endTs.Truncate(ttl).UnixNano(), lookback: lookback}
+	now := time.Now()
+
+	c.mu.Lock()
+	if entry, found := c.entries[key]; found && now.Before(entry.expires) {
+		c.mu.Unlock()
+		return copyLinks(entry.links), nil
+	}
+	call, found := c.inFlight[key]
+	if !found {
+		call = &dependencyCall{done: make(chan struct{})}
+		if c.inFlight == nil {
+			c.inFlight = make(map[dependencyKey]*dependencyCall)
+		}
+		c.inFlight[key] = call
+	}
+	c.mu.Unlock()
+
+	if found {
+		select {
+		case <-call.done:
+			if call.canceled && ctx.Err() == nil {
+				return c.get(ctx, ttl, tenant, endTs, lookback, load)
+			}
+			return copyLinks(call.links), call.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	call.links, call.err = load()
+	call.canceled = call.err != nil && ctx.Err() != nil
+	c.mu.Lock()
+	delete(c.inFlight, key)
+	if call.err == nil {
+		if c.entries == nil {
+			c.entries = make(map[dependencyKey]dependencyEntry)
+		}
+		for k, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.entries[key] = dependencyEntry{links: call.links, expires: time.Now().Add(ttl)}
+	}
+	c.mu.Unlock()
+	close(call.done)
+	return copyLinks(call.links), call.err
+}
+
+// copyLinks keeps the cached links safe from the changes of a caller
+func copyLinks(links []model.DependencyLink) []model.DependencyLink {
+	if links == nil {
+		return nil
+	}
+	return append(make([]model.DependencyLink, 0, len(links)), links...)
+}
@@ -0,0 +1,173 @@
+package pgstore
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+func TestDependencyCacheSharesLoad(t *testing.T) {
+	var cache dependencyCache
+	links := []model.DependencyLink{{Parent: "frontend", Child: "backend", CallCount: 3}}
+	endTs := time.Now()
+	var loads int32
+	started, release := make(chan struct{}), make(chan struct{})
+	load := func() ([]model.DependencyLink, error) {
+		if atomic.AddInt32(&loads, 1) == 1 {
+			close(started)
+		}
+		<-release
+		return links, nil
+	}
+
+	var wg sync.WaitGroup
+	results := make([][]model.DependencyLink, 10)
+	get := func(i int) {
+		defer wg.Done()
+		got, err := cache.get(context.Background(), time.Minute, "", endTs, time.Hour, load)
+		if err != nil {
+			t.Error(err)
+		}
+		results[i] = got
+	}
+	wg.Add(len(results))
+	go get(0)
+	<-started
+	for i := 1; i < len(results); i++ {
+		go get(i)
+	}
+	close(release)
+	wg.Wait()
+
+	if loads != 1 {
+		t.Errorf("%d loads for concurrent calls of one window, want 1", loads)
+	}
+	for i, got := range results {
+		if !reflect.DeepEqual(got, links) {
+			t.Errorf("call %d got %v, want %v", i, got, links)
+		}
+	}
+
+	// cached, and safe from the changes of a caller
+	results[0][0].CallCount = 100
+	got, err := cache.get(context.Background(), time.Minute, "", endTs, time.Hour, load)
+	if err != nil || !reflect.DeepEqual(got, links) || links[0].CallCount != 3 {
+		t.Errorf("cached get() = %v, %v, want %v", got, err, links)
+	}
+	if loads != 1 {
+		t.Errorf("%d loads within the TTL, want 1", loads)
+	}
+	// another lookback is another window
+	if _, err := cache.get(context.Background(), time.Minute, "", endTs, 2*time.Hour, load); err != nil || loads != 2 {
+		t.Errorf("get() of another lookback = %v after %d loads, want a new load", err, loads)
+	}
+}
+
+func TestDependencyCacheTenants(t *testing.T) {
+	var cache dependencyCache
+	endTs := time.Now()
+	load := func(tenant string) func() ([]model.DependencyLink, error) {
+		return func() ([]model.DependencyLink, error) {
+			return []model.DependencyLink{{Parent: tenant, Child: "backend", CallCount: 1}}, nil
+		}
+	}
+	for _, tenant := range []string{"a", "b", ""} {
+		if _, err := cache.get(context.Background(), time.Minute, tenant, endTs, time.Hour, load(tenant)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tenant := range []string{"a", "b", ""} {
+		got, err := cache.get(context.Background(), time.Minute, tenant, endTs, time.Hour, load("other"))
+		if err != nil || len(got) != 1 || got[0].Parent != tenant {
+			t.Errorf("cached get() of tenant %q = %v, %v, want its own links", tenant, got, err)
+		}
+	}
+}
+
+func TestDependencyCacheErrors(t *testing.T) {
+	var cache dependencyCache
+	endTs := time.Now()
+	errLoad := errors.New("load failed")
+	loads := 0
+	load := func() ([]model.DependencyLink, error) {
+		loads++
+		return nil, errLoad
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := cache.get(context.Background(), time.Minute, "", endTs, time.Hour, load); !errors.Is(err, errLoad) {
+			t.Errorf("get() error = %v, want the load error", err)
+		}
+	}
+	if loads != 2 {
+		t.Errorf("%d loads, want the failed one not cached", loads)
+	}
+}
+
+func TestDependencyCacheWaiterCanceled(t *testing.T) {
+	var cache dependencyCache
+	endTs := time.Now()
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	go cache.get(context.Background(), time.Minute, "", endTs, time.Hour, func() ([]model.DependencyLink, error) {
+		close(started)
+		<-release
+		return nil, nil
+	})
+	<-started
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := cache.get(ctx, time.Minute, "", endTs, time.Hour, func() ([]model.DependencyLink, error) {
+		t.Error("a second load ran while the first was in flight")
+		return nil, nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("get() error = %v, want context.Canceled", err)
+	}
+}
+
+func TestDependencyCacheLeaderCanceled(t *testing.T) {
+	var cache dependencyCache
+	endTs := time.Now()
+	links := []model.DependencyLink{{Parent: "frontend", Child: "backend", CallCount: 1}}
+	ctx, cancel := context.WithCancel(context.Background())
+	started, release := make(chan struct{}), make(chan struct{})
+	leaderErr := make(chan error)
+	go func() {
+		_, err := cache.get(ctx, time.Minute, "", endTs, time.Hour, func() ([]model.DependencyLink, error) {
+			close(started)
+			<-release
+			return nil, ctx.Err()
+		})
+		leaderErr <- err
+	}()
+	<-started
+
+	waiter := make(chan []model.DependencyLink)
+	go func() {
+		got, err := cache.get(context.Background(), time.Minute, "", endTs, time.Hour, func() ([]model.DependencyLink, error) {
+			return links, nil
+		})
+		if err != nil {
+			t.Errorf("get() of the waiter error = %v, want the links loaded again", err)
+		}
+		waiter <- got
+	}()
+	// let the waiter join the call in flight before the leader gives up
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	close(release)
+
+	if err := <-leaderErr; !errors.Is(err, context.Canceled) {
+		t.Errorf("get() of the leader error = %v, want context.Canceled", err)
+	}
+	if got := <-waiter; !reflect.DeepEqual(got, links) {
+		t.Errorf("get() of the waiter = %v, want %v", got, links)
+	}
+}
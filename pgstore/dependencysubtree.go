@@ -0,0 +1,63 @@
+package pgstore
+
+import (
+	"context"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// GetDependenciesForService returns the dependency links within the window
+// whose parent is service, the services it calls directly
+func (r *Reader) GetDependenciesForService(ctx context.Context, service string, endTs time.Time, lookback time.Duration) ([]model.DependencyLink, error) {
+	return r.GetDependenciesWithinHops(ctx, service, 1, endTs, lookback)
+}
+
+// GetDependenciesWithinHops returns the dependency links within the window
+// reachable from service following at most hops links from parent to child,
+// in the order of GetDependencies
+func (r *Reader) GetDependenciesWithinHops(ctx context.Context, service string, hops int, endTs time.Time, lookback time.Duration) (ret []model.DependencyLink, err error) {
+	defer r.metrics.observe("GetDependenciesWithinHops", time.Now(), &err)
+	ospan, ctx := r.startSpan(ctx, "GetDependenciesWithinHops")
+	defer finishSpan(ospan, &err)
+	ospan.SetTag("service_name", service)
+	ospan.SetTag("hops", hops)
+
+	links, err := r.GetDependenciesContext(ctx, endTs, lookback)
+	if err != nil {
+		return nil, err
+	}
+	ret = dependencySubtree(links, service, hops)
+	ospan.SetTag("result_count", len(ret))
+	return ret, nil
+}
+
+// dependencySubtree keeps the links reachable from service within hops links,
+// each link once whichever the number of paths leading to it
+func dependencySubtree(links []model.DependencyLink, service string, hops int) []model.DependencyLink {
+	reached := map[string]bool{service: true}
+	kept := make([]bool, len(links))
+	frontier := map[string]bool{service: true}
+	for hop := 0; hop < hops && len(frontier) > 0; hop++ {
+		next := make(map[string]bool)
+		for i, link := range links {
+			if kept[i] || !frontier[link.Parent] {
+				continue
+			}
+			kept[i] = true
+			if !reached[link.Child] {
+				reached[link.Child] = true
+				next[link.Child] = true
+			}
+		}
+		frontier = next
+	}
+
+	ret := make([]model.DependencyLink, 0)
+	for i, link := range links {
+		if kept[i] {
+			ret = append(ret, link)
+		}
+	}
+	return ret
+}
@@ -0,0 +1,72 @@
+package pgstore
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+func TestDependencySubtree(t *testing.T) {
+	link := func(parent, child string) model.DependencyLink {
+		return model.DependencyLink{Parent: parent, Child: child, CallCount: 1}
+	}
+	// frontend calls shop and auth, both calling db and shop calling
+	// payments, which calls shop back. cache calls db without being reached.
+	links := []model.DependencyLink{
+		link("auth", "db"),
+		link("cache", "db"),
+		link("frontend", "auth"),
+		link("frontend", "shop"),
+		link("payments", "shop"),
+		link("shop", "db"),
+		link("shop", "payments"),
+	}
+	tests := []struct {
+		name    string
+		service string
+		hops    int
+		want    []model.DependencyLink
+	}{
+		{name: "no hops", service: "frontend", hops: 0, want: []model.DependencyLink{}},
+		{name: "direct calls", service: "frontend", hops: 1,
+			want: []model.DependencyLink{link("frontend", "auth"), link("frontend", "shop")}},
+		{name: "two hops", service: "frontend", hops: 2,
+			want: []model.DependencyLink{link("auth", "db"), link("frontend", "auth"), link("frontend", "shop"),
+				link("shop", "db"), link("shop", "payments")}},
+		{name: "cycle followed once", service: "frontend", hops: 10,
+			want: []model.DependencyLink{link("auth", "db"), link("frontend", "auth"), link("frontend", "shop"),
+				link("payments", "shop"), link("shop", "db"), link("shop", "payments")}},
+		{name: "leaf", service: "db", hops: 3, want: []model.DependencyLink{}},
+		{name: "unknown service", service: "mail", hops: 1, want: []model.DependencyLink{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := dependencySubtree(links, tt.service, tt.hops); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("dependencySubtree(%s, %d) = %v, want %v", tt.service, tt.hops, got, tt.want)
+			}
+		})
+	}
+}
+
+func BenchmarkDependencySubtree(b *testing.B) {
+	// 1000 services each calling the 5 next ones, cycling back to the first
+	const services, calls = 1000, 5
+	links := make([]model.DependencyLink, 0, services*calls)
+	for parent := 0; parent < services; parent++ {
+		for i := 1; i <= calls; i++ {
+			links = append(links, model.DependencyLink{Parent: fmt.Sprintf("service-%d", parent),
+				Child: fmt.Sprintf("service-%d", (parent+i)%services), CallCount: 1})
+		}
+	}
+	for _, hops := range []int{1, 10, services} {
+		b.Run(fmt.Sprintf("%dHops", hops), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if subtree := dependencySubtree(links, "service-0", hops); len(subtree) == 0 {
+					b.Fatal("dependencySubtree() kept no link")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package pgstore
+
+import (
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	hclog "github.com/hashicorp/go-hclog"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/dependencystore"
+)
+
+var _ dependencystore.Writer = (*DependencyWriter)(nil)
+
+// DependencyWriter stores precomputed dependency links, e.g. from the spark
+// dependencies job, which GetDependencies prefers over computing them live
+type DependencyWriter struct {
+	db *pg.DB
+
+	logger hclog.Logger
+
+	// stored with every link, see WithDependencyTenant
+	tenant string
+}
+
+// DependencyWriterOption customizes a DependencyWriter built by NewDependencyWriter
+type DependencyWriterOption func(*DependencyWriter)
+
+// WithDependencyTenant makes the DependencyWriter store the links as those of
+// tenant, like WithTenant does for the spans of a Writer
+func WithDependencyTenant(tenant string) DependencyWriterOption {
+	return func(w *DependencyWriter) {
+		w.tenant = tenant
+	}
+}
+
+// NewDependencyWriter returns a DependencyWriter for the dependencies table
+// created by Migrate
+func NewDependencyWriter(db *pg.DB, logger hclog.Logger, opts ...DependencyWriterOption) *DependencyWriter {
+	w := &DependencyWriter{
+		db:     db,
+		logger: logger,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
+	return w
+}
+
+// WriteDependencies saves the links aggregated for the bucket starting at ts
+func (w *DependencyWriter) WriteDependencies(ts time.Time, dependencies []model.DependencyLink) error {
+	if len(dependencies) == 0 {
+		return nil
+	}
+	deps := make([]*Dependency, 0, len(dependencies))
+	for _, dep := range dependencies {
+		source := dep.Source
+		if len(source) == 0 {
+			source = model.JaegerDependencyLinkSource
+		}
+		deps = append(deps, &Dependency{
+			Ts:        ts,
+			Parent:    dep.Parent,
+			Child:     dep.Child,
+			CallCount: dep.CallCount,
+			Source:    source,
+			TenantID:  w.tenant,
+		})
+	}
+	_, err := w.db.Model(&deps).Insert()
+	return err
+}
@@ -0,0 +1,60 @@
+package pgstore
+
+import (
+	"context"
+	"strings"
+
+	"github.com/go-pg/pg/v9"
+	"github.com/go-pg/pg/v9/orm"
+)
+
+// hstoreColumns hold the tags with the hstore TagStorage
+var hstoreColumns = []string{"tags_hstore", "process_tags_hstore"}
+
+// MigrateHstore adds the hstore tag columns and their indexes, it is needed
+// by the hstore TagStorage only and safe to run at every startup
+func MigrateHstore(ctx context.Context, db *pg.DB) error {
+	return db.WithContext(ctx).RunInTransaction(func(tx *pg.Tx) error {
+		if err := withoutStatementTimeout(tx); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`
+CREATE EXTENSION IF NOT EXISTS hstore;
+ALTER TABLE spans ADD COLUMN IF NOT EXISTS tags_hstore hstore;
+ALTER TABLE spans ADD COLUMN IF NOT EXISTS process_tags_hstore hstore;
+CREATE INDEX IF NOT EXISTS idx_spans_tags_hstore ON spans USING gin (tags_hstore);
+CREATE INDEX IF NOT EXISTS idx_spans_process_tags_hstore ON spans USING gin (process_tags_hstore);
+`)
+		return err
+	})
+}
+
+// selectSpanColumns selects the columns the spans table has rather than all
+// fields of Span, as the hstore ones don't exist without MigrateHstore
+func selectSpanColumns(q *orm.Query) *orm.Query {
+	return q.ColumnExpr("span.*")
+}
+
+// insertSpanColumns leaves the hstore columns out of an insert into spans
+// unless they are in use
+func insertSpanColumns(q *orm.Query, tagStorage string) *orm.Query {
+	if tagStorage == TagStorageHstore {
+		return q
+	}
+	return q.ExcludeColumn(hstoreColumns...)
+}
+
+// hstoreTagPredicate matches a searched tag in the hstore columns of its
+// scope, see tagScope, among the spans stored with hstore
+func hstoreTagPredicate(key string, value string) (string, []interface{}) {
+	columns, keys := tagScope(key)
+	clauses := make([]string, 0, len(columns)*len(keys))
+	params := make([]interface{}, 0, 2*cap(clauses))
+	for _, column := range columns {
+		for _, k := range keys {
+			clauses = append(clauses, column.hstore+" @> hstore(?, ?)")
+			params = append(params, k, value)
+		}
+	}
+	return "(" + strings.Join(clauses, " OR ") + ")", params
+}
@@ -0,0 +1,60 @@
+//go:build integration
+// +build integration
+
+package pgstore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+func TestHstoreTagStorage(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	if err := MigrateHstore(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	// a second run at the next startup
+	if err := MigrateHstore(context.Background(), db); err != nil {
+		t.Fatalf("MigrateHstore() again = %v", err)
+	}
+	writer := NewWriter(db, hclog.NewNullLogger(), WithTagStorage(TagStorageHstore))
+	reader := NewReader(db, hclog.NewNullLogger(), WithConfiguration(&Configuration{TagStorage: TagStorageHstore}))
+
+	traceID := model.TraceID{Low: 1}
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	span := testSpan(traceID, 1, "frontend", "GET /", start)
+	// in key order as they are read back
+	span.Tags = []model.KeyValue{model.Bool("cached", true), model.String("http.method", "GET"), model.Int64("http.status_code", 200)}
+	writeTestSpans(t, writer, span, testSpan(model.TraceID{Low: 2}, 1, "frontend", "GET /", start))
+
+	trace, err := reader.GetTrace(context.Background(), traceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := trace.Spans[0]; !reflect.DeepEqual(got.Tags, span.Tags) || !reflect.DeepEqual(got.Process.Tags, span.Process.Tags) {
+		t.Errorf("read back the tags %v and process tags %v, want %v and %v", got.Tags, got.Process.Tags, span.Tags, span.Process.Tags)
+	}
+	tests := []struct {
+		tags map[string]string
+		want []uint64
+	}{
+		{tags: map[string]string{"http.method": "GET"}, want: []uint64{1}},
+		{tags: map[string]string{"http.status_code": "200", "cached": "true"}, want: []uint64{1}},
+		{tags: map[string]string{"hostname": "host-1"}, want: []uint64{1, 2}},
+		{tags: map[string]string{"http.method": "POST"}, want: []uint64{}},
+	}
+	for _, tt := range tests {
+		query := &spanstore.TraceQueryParameters{ServiceName: "frontend", Tags: tt.tags,
+			StartTimeMin: start.Add(-time.Minute), StartTimeMax: start.Add(time.Minute)}
+		if got := findTraceIDs(t, reader, query); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("traces tagged %v = %v, want %v", tt.tags, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,177 @@
+package pgstore
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+// purgedTables are the tables Purge deletes from
+var purgedTables = []string{"spans", "span_refs", "span_logs"}
+
+// Maintenance expires old data from PostgreSQL
+type Maintenance struct {
+	db *pg.DB
+
+	conf Configuration
+
+	logger hclog.Logger
+}
+
+// NewMaintenance returns a Maintenance applying the retention settings of the configuration
+func NewMaintenance(db *pg.DB, conf *Configuration, logger hclog.Logger) *Maintenance {
+	return &Maintenance{
+		db:     db,
+		conf:   *conf,
+		logger: logger,
+	}
+}
+
+// PurgeExpired deletes the spans older than the configured retention
+func (m *Maintenance) PurgeExpired(ctx context.Context) (int64, error) {
+	cutoff := m.conf.RetentionCutoff(time.Now())
+	if cutoff.IsZero() {
+		return 0, nil
+	}
+	return m.Purge(ctx, cutoff)
+}
+
+// Purge deletes the spans started before olderThan together with their refs
+// and logs. Rows are deleted in batches so that no lock is held for long.
+func (m *Maintenance) Purge(ctx context.Context, olderThan time.Time) (deleted int64, err error) {
+	batchSize := m.purgeBatchSize()
+
+	deleted, err = m.deleteInBatches(ctx, batchSize, `DELETE FROM spans WHERE (id, start_time) IN (
+		SELECT id, start_time FROM spans WHERE start_time < ? LIMIT ?)`, olderThan)
+	if err != nil {
+		return deleted, err
+	}
+	if err = m.deleteOrphans(ctx, batchSize); err != nil {
+		return deleted, err
+	}
+
+	m.logger.Info("Purged spans", "olderThan", olderThan, "deleted", deleted)
+	if m.conf.AnalyzeAfterPurge && deleted >= m.conf.AnalyzeThreshold {
+		m.analyze(ctx)
+	}
+	return deleted, nil
+}
+
+// purgeBatchSize is the number of rows a purge statement deletes at most
+func (m *Maintenance) purgeBatchSize() int {
+	if m.conf.PurgeBatchSize <= 0 {
+		return 10000
+	}
+	return m.conf.PurgeBatchSize
+}
+
+// deleteOrphans deletes the refs and logs left without their span
+func (m *Maintenance) deleteOrphans(ctx context.Context, batchSize int) error {
+	if _, err := m.deleteInBatches(ctx, batchSize, `DELETE FROM span_refs WHERE id IN (
+		SELECT span_ref.id FROM span_refs AS span_ref
+		WHERE NOT EXISTS (SELECT 1 FROM spans
+			WHERE spans.trace_id_low = span_ref.span_trace_id_low AND spans.trace_id_high = span_ref.span_trace_id_high AND spans.id = span_ref.span_id
+			AND spans.tenant_id = span_ref.tenant_id) LIMIT ?)`); err != nil {
+		return err
+	}
+	_, err := m.deleteInBatches(ctx, batchSize, `DELETE FROM span_logs WHERE id IN (
+		SELECT log.id FROM span_logs AS log
+		WHERE NOT EXISTS (SELECT 1 FROM spans
+			WHERE spans.trace_id_low = log.trace_id_low AND spans.trace_id_high = log.trace_id_high AND spans.id = log.span_id
+			AND spans.tenant_id = log.tenant_id) LIMIT ?)`)
+	return err
+}
+
+// spansPartitionsQuery lists the partitions of spans with the upper bound of
+// their start_time range, NULL for a DEFAULT or MAXVALUE partition
+const spansPartitionsQuery = `SELECT child.oid::regclass::text AS name,
+	substring(pg_get_expr(child.relpartbound, child.oid) FROM 'TO \(''([^'']*)''\)')::timestamptz AS upper_bound
+FROM pg_inherits
+JOIN pg_class AS child ON child.oid = pg_inherits.inhrelid
+WHERE pg_inherits.inhparent = 'spans'::regclass`
+
+// DropPartitionsOlderThan drops the partitions of spans, range partitioned by
+// start_time, whose whole range lies before olderThan, which is much cheaper
+// than deleting their rows. The refs and logs of the dropped spans are
+// deleted afterwards, the rows of a partition reaching past olderThan are
+// kept. When spans isn't partitioned that way, e.g. as a Timescale
+// hypertable, it falls back to Purge.
+func (m *Maintenance) DropPartitionsOlderThan(ctx context.Context, olderThan time.Time) error {
+	var partitionKey string
+	if _, err := m.db.QueryOneContext(ctx, pg.Scan(&partitionKey), "SELECT coalesce(pg_get_partkeydef('spans'::regclass), '')"); err != nil {
+		return err
+	}
+	if partitionKey != "RANGE (start_time)" {
+		_, err := m.Purge(ctx, olderThan)
+		return err
+	}
+
+	var partitions []struct {
+		Name       string
+		UpperBound time.Time
+	}
+	if _, err := m.db.QueryContext(ctx, &partitions, spansPartitionsQuery); err != nil {
+		return err
+	}
+	dropped := 0
+	for _, partition := range partitions {
+		if partition.UpperBound.IsZero() || partition.UpperBound.After(olderThan) {
+			continue
+		}
+		if _, err := m.db.ExecContext(ctx, "DROP TABLE ?", pg.Safe(partition.Name)); err != nil {
+			return err
+		}
+		m.logger.Info("Dropped spans partition", "partition", partition.Name, "upperBound", partition.UpperBound)
+		dropped++
+	}
+	if dropped == 0 {
+		return nil
+	}
+	if err := m.deleteOrphans(ctx, m.purgeBatchSize()); err != nil {
+		return err
+	}
+	if m.conf.AnalyzeAfterPurge {
+		m.analyze(ctx)
+	}
+	return nil
+}
+
+// analyze refreshes the statistics of the purged tables, reclaiming their
+// space first with VacuumAfterPurge. A failure is only logged as the purge
+// itself succeeded.
+func (m *Maintenance) analyze(ctx context.Context) {
+	if m.conf.AnalyzeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, m.conf.AnalyzeTimeout)
+		defer cancel()
+	}
+	command := "ANALYZE"
+	if m.conf.VacuumAfterPurge {
+		command = "VACUUM (ANALYZE)"
+	}
+	for _, table := range purgedTables {
+		if _, err := m.db.ExecContext(ctx, command+" ?", pg.Ident(table)); err != nil {
+			m.logger.Warn("Couldn't analyze purged table", "table", table, "err", err)
+			return
+		}
+	}
+}
+
+// deleteInBatches repeats the DELETE, whose last placeholder is the batch
+// size, until it deletes less than a full batch
+func (m *Maintenance) deleteInBatches(ctx context.Context, batchSize int, query string, params ...interface{}) (int64, error) {
+	params = append(params, batchSize)
+	var deleted int64
+	for {
+		res, err := m.db.ExecContext(ctx, query, params...)
+		if err != nil {
+			return deleted, err
+		}
+		deleted += int64(res.RowsAffected())
+		if res.RowsAffected() < batchSize {
+			return deleted, nil
+		}
+	}
+}
@@ -0,0 +1,215 @@
+//go:build integration
+// +build integration
+
+package pgstore
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// count returns the number of statements starting with prefix
+func (h *statementHook) count(prefix string) int {
+	count := 0
+	for _, statement := range h.statements {
+		if strings.HasPrefix(strings.TrimSpace(statement), prefix) {
+			count++
+		}
+	}
+	return count
+}
+
+// writeSpanWithDetails stores span trace+1 of trace calling span 1 and
+// logging once
+func writeSpanWithDetails(tb testing.TB, w *Writer, trace uint64, start time.Time) {
+	tb.Helper()
+	traceID := model.TraceID{Low: trace}
+	span := testSpan(traceID, model.SpanID(trace+1), "frontend", "GET /", start)
+	span.References = []model.SpanRef{model.NewChildOfRef(traceID, 1)}
+	span.Logs = []model.Log{{Timestamp: start, Fields: []model.KeyValue{model.String("event", "retry")}}}
+	writeTestSpans(tb, w, span)
+}
+
+func TestMaintenancePurge(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	writer := NewWriter(db, hclog.NewNullLogger())
+	now := time.Now()
+	for trace := uint64(1); trace <= 5; trace++ {
+		writeSpanWithDetails(t, writer, trace, now.Add(-48*time.Hour))
+	}
+	writeSpanWithDetails(t, writer, 6, now.Add(-time.Minute))
+
+	hook := &statementHook{}
+	db.AddQueryHook(hook)
+	maintenance := NewMaintenance(db, &Configuration{PurgeBatchSize: 2}, hclog.NewNullLogger())
+	deleted, err := maintenance.Purge(context.Background(), now.Add(-24*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if deleted != 5 {
+		t.Errorf("Purge() deleted %d spans, want 5", deleted)
+	}
+	// batches of 2, 2 and 1 spans, then 2, 2 and 1 orphans of each table
+	for _, table := range purgedTables {
+		if count := hook.count("DELETE FROM " + table + " "); count != 3 {
+			t.Errorf("%d DELETE statements on %s, want 3 batches", count, table)
+		}
+	}
+	for model, want := range map[interface{}]int{(*Span)(nil): 1, (*SpanRef)(nil): 1, (*Log)(nil): 1} {
+		if count := countRows(t, db, model); count != want {
+			t.Errorf("%T has %d rows after the purge, want %d", model, count, want)
+		}
+	}
+
+	// nothing left to purge
+	if deleted, err := maintenance.Purge(context.Background(), now.Add(-24*time.Hour)); err != nil || deleted != 0 {
+		t.Errorf("second Purge() = %d, %v, want nothing deleted", deleted, err)
+	}
+}
+
+func TestMaintenancePurgeKeepsRefsStoredBeforeMigration22(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	writer := NewWriter(db, hclog.NewNullLogger())
+	now := time.Now()
+	// a recent span following an old one of another trace
+	referenced := testSpan(model.TraceID{Low: 2}, 5, "backend", "query", now.Add(-48*time.Hour))
+	holder := testSpan(model.TraceID{Low: 1}, 1, "frontend", "GET /", now.Add(-time.Minute))
+	holder.References = []model.SpanRef{model.NewFollowsFromRef(referenced.TraceID, referenced.SpanID)}
+	writeTestSpans(t, writer, referenced, holder)
+	// the ref as it was stored before migration 22, without the trace of
+	// its span
+	if _, err := db.Exec("UPDATE span_refs SET span_trace_id_low = NULL, span_trace_id_high = NULL"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(spanRefTraceIDs); err != nil {
+		t.Fatal(err)
+	}
+
+	maintenance := NewMaintenance(db, &Configuration{}, hclog.NewNullLogger())
+	if _, err := maintenance.Purge(context.Background(), now.Add(-24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	trace, err := NewReader(db, hclog.NewNullLogger()).GetTrace(context.Background(), holder.TraceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trace.Spans) != 1 || !reflect.DeepEqual(trace.Spans[0].References, holder.References) {
+		t.Errorf("GetTrace() = %v, want the span with its ref into the purged trace", trace.Spans)
+	}
+}
+
+func TestMaintenanceAnalyzeAfterPurge(t *testing.T) {
+	tests := []struct {
+		name    string
+		conf    Configuration
+		command string
+		want    int
+	}{
+		{name: "analyze", conf: Configuration{AnalyzeAfterPurge: true, AnalyzeThreshold: 2}, command: "ANALYZE ", want: 3},
+		{name: "vacuum", conf: Configuration{AnalyzeAfterPurge: true, VacuumAfterPurge: true}, command: "VACUUM (ANALYZE) ", want: 3},
+		{name: "below the threshold", conf: Configuration{AnalyzeAfterPurge: true, AnalyzeThreshold: 3}, command: "ANALYZE ", want: 0},
+		{name: "disabled", conf: Configuration{}, command: "ANALYZE ", want: 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, done := newTestDB(t)
+			defer done()
+			writer := NewWriter(db, hclog.NewNullLogger())
+			for trace := uint64(1); trace <= 2; trace++ {
+				writeSpanWithDetails(t, writer, trace, time.Now().Add(-48*time.Hour))
+			}
+
+			hook := &statementHook{}
+			db.AddQueryHook(hook)
+			if _, err := NewMaintenance(db, &tt.conf, hclog.NewNullLogger()).Purge(context.Background(), time.Now().Add(-24*time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+			if count := hook.count(tt.command); count != tt.want {
+				t.Errorf("%d %s statements, want %d", count, tt.command, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaintenanceDropPartitionsFallsBackToPurge(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	writer := NewWriter(db, hclog.NewNullLogger())
+	now := time.Now()
+	writeSpanWithDetails(t, writer, 1, now.Add(-48*time.Hour))
+	writeSpanWithDetails(t, writer, 2, now.Add(-time.Minute))
+
+	hook := &statementHook{}
+	db.AddQueryHook(hook)
+	if err := NewMaintenance(db, &Configuration{}, hclog.NewNullLogger()).DropPartitionsOlderThan(context.Background(), now.Add(-24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if count := hook.count("DROP TABLE"); count != 0 {
+		t.Errorf("%d tables dropped, want spans purged as it isn't partitioned", count)
+	}
+	for model, want := range map[interface{}]int{(*Span)(nil): 1, (*SpanRef)(nil): 1, (*Log)(nil): 1} {
+		if count := countRows(t, db, model); count != want {
+			t.Errorf("%T has %d rows, want %d", model, count, want)
+		}
+	}
+}
+
+func TestMaintenanceDropPartitions(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	// a partition before the cutoff, one reaching past it and a default one
+	now := time.Now().Truncate(time.Second)
+	if _, err := db.Exec(`ALTER TABLE spans RENAME TO spans_unpartitioned;
+CREATE TABLE spans (LIKE spans_unpartitioned INCLUDING ALL) PARTITION BY RANGE (start_time);
+CREATE TABLE spans_old PARTITION OF spans FOR VALUES FROM (?) TO (?);
+CREATE TABLE spans_recent PARTITION OF spans FOR VALUES FROM (?) TO (?);
+CREATE TABLE spans_default PARTITION OF spans DEFAULT`,
+		now.Add(-72*time.Hour), now.Add(-36*time.Hour), now.Add(-36*time.Hour), now.Add(-12*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	writer := NewWriter(db, hclog.NewNullLogger())
+	writeSpanWithDetails(t, writer, 1, now.Add(-48*time.Hour))
+	writeSpanWithDetails(t, writer, 2, now.Add(-30*time.Hour))
+	writeSpanWithDetails(t, writer, 3, now.Add(-time.Minute))
+
+	hook := &statementHook{}
+	db.AddQueryHook(hook)
+	maintenance := NewMaintenance(db, &Configuration{}, hclog.NewNullLogger())
+	if err := maintenance.DropPartitionsOlderThan(context.Background(), now.Add(-24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if count := hook.count("DROP TABLE"); count != 1 {
+		t.Errorf("%d tables dropped, want only spans_old", count)
+	}
+	var dropped bool
+	if _, err := db.QueryOne(pg.Scan(&dropped), "SELECT to_regclass('spans_old') IS NULL"); err != nil {
+		t.Fatal(err)
+	}
+	if !dropped {
+		t.Error("spans_old is still there")
+	}
+	// the span of the partition reaching past the cutoff is kept
+	for model, want := range map[interface{}]int{(*Span)(nil): 2, (*SpanRef)(nil): 2, (*Log)(nil): 2} {
+		if count := countRows(t, db, model); count != want {
+			t.Errorf("%T has %d rows, want %d", model, count, want)
+		}
+	}
+
+	// nothing left to drop
+	hook.statements = nil
+	if err := maintenance.DropPartitionsOlderThan(context.Background(), now.Add(-24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if count := hook.count("DROP TABLE") + hook.count("DELETE"); count != 0 {
+		t.Errorf("%d statements dropping or deleting on the second run, want none", count)
+	}
+}
@@ -1,7 +1,7 @@
 package pgstore
 
 import (
-	"github.com/jaegertracing/jaeger/model"
+	"strings"
 )
 
 type whereBuilder struct {
@@ -17,100 +17,27 @@ func (r *whereBuilder) andWhere(param interface{}, where string) {
 	r.params = append(r.params, param)
 }
 
-func toModelSpan(span Span) *model.Span {
-
-	return &model.Span{
-		SpanID:        span.ID,
-		TraceID:       model.TraceID{Low: span.TraceIDLow, High: span.TraceIDHigh},
-		OperationName: span.Operation.OperationName,
-		Flags:         span.Flags,
-		StartTime:     span.StartTime,
-		Duration:      span.Duration,
-		Tags:          mapToModelKV(span.Tags),
-		ProcessID:     span.ProcessID,
-		Process: &model.Process{
-			ServiceName: span.Service.ServiceName,
-			Tags:        mapToModelKV(span.ProcessTags),
-		},
-		Warnings:   span.Warnings,
-		References: toModelSpanRef(span),
-		Logs:       make([]model.Log, 0),
-	}
-}
-
-func toModelSpanRef(span Span) []model.SpanRef {
-	span_refs := make([]model.SpanRef, 0, len(span.SpanRefs))
-	for _, span_ref := range span.SpanRefs {
-		span_refs = append(span_refs, model.SpanRef{
-			TraceID: model.TraceID{Low: span_ref.TraceIDLow, High: span_ref.TraceIDHigh},
-			SpanID:  span_ref.ChildSpanID,
-			RefType: span_ref.RefType,
-		})
+func (r *whereBuilder) andWhereParams(where string, params ...interface{}) {
+	if len(r.where) > 0 {
+		r.where += " AND "
 	}
-	return span_refs
+	r.where += where
+	r.params = append(r.params, params...)
 }
 
-func mapToModelKV(input map[string]interface{}) []model.KeyValue {
-	ret := make([]model.KeyValue, 0, len(input))
-	var kv model.KeyValue
-	for k, v := range input {
-		if vStr, ok := v.(string); ok {
-			kv = model.KeyValue{
-				Key:   k,
-				VType: model.ValueType_STRING,
-				VStr:  vStr,
-			}
-			ret = append(ret, kv)
-		} else if vBytes, ok := v.([]byte); ok {
-			kv = model.KeyValue{
-				Key:     k,
-				VType:   model.ValueType_BINARY,
-				VBinary: vBytes,
-			}
-			ret = append(ret, kv)
-		} else if vBool, ok := v.(bool); ok {
-			kv = model.KeyValue{
-				Key:   k,
-				VType: model.ValueType_BOOL,
-				VBool: vBool,
-			}
-			ret = append(ret, kv)
-		} else if vInt64, ok := v.(int64); ok {
-			kv = model.KeyValue{
-				Key:    k,
-				VType:  model.ValueType_INT64,
-				VInt64: vInt64,
-			}
-			ret = append(ret, kv)
-		} else if vFloat64, ok := v.(float64); ok {
-			kv = model.KeyValue{
-				Key:      k,
-				VType:    model.ValueType_FLOAT64,
-				VFloat64: vFloat64,
-			}
-			ret = append(ret, kv)
+// andWhereAny adds the alternatives as a single predicate matching any of
+// them, an alternative without predicates matches everything
+func (r *whereBuilder) andWhereAny(alternatives ...*whereBuilder) {
+	var where []string
+	var params []interface{}
+	for _, alternative := range alternatives {
+		if len(alternative.where) == 0 {
+			return
 		}
+		where = append(where, "("+alternative.where+")")
+		params = append(params, alternative.params...)
 	}
-	return ret
-}
-
-func mapModelKV(input []model.KeyValue) map[string]interface{} {
-	ret := make(map[string]interface{})
-	var value interface{}
-	for _, kv := range input {
-		value = nil
-		if kv.VType == model.ValueType_STRING {
-			value = kv.VStr
-		} else if kv.VType == model.ValueType_BOOL {
-			value = kv.VBool
-		} else if kv.VType == model.ValueType_INT64 {
-			value = kv.VInt64
-		} else if kv.VType == model.ValueType_FLOAT64 {
-			value = kv.VFloat64
-		} else if kv.VType == model.ValueType_BINARY {
-			value = kv.VBinary
-		}
-		ret[kv.Key] = value
+	if len(where) > 0 {
+		r.andWhereParams("("+strings.Join(where, " OR ")+")", params...)
 	}
-	return ret
 }
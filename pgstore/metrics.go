@@ -0,0 +1,109 @@
+package pgstore
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// readerMetrics counts Reader calls, their failures, latency and the rows
+// their statements returned per method
+type readerMetrics struct {
+	calls   *prometheus.CounterVec
+	errors  *prometheus.CounterVec
+	latency *prometheus.HistogramVec
+	rows    *prometheus.CounterVec
+}
+
+func newReaderMetrics(registerer prometheus.Registerer) (*readerMetrics, error) {
+	m := &readerMetrics{
+		calls: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "jaeger_pgstore",
+			Subsystem: "reader",
+			Name:      "calls_total",
+			Help:      "Number of Reader calls",
+		}, []string{"method"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "jaeger_pgstore",
+			Subsystem: "reader",
+			Name:      "errors_total",
+			Help:      "Number of Reader calls returning an error",
+		}, []string{"method"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "jaeger_pgstore",
+			Subsystem: "reader",
+			Name:      "latency_seconds",
+			Help:      "Latency of Reader calls",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method"}),
+		rows: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "jaeger_pgstore",
+			Subsystem: "reader",
+			Name:      "rows_returned_total",
+			Help:      "Number of rows returned by the statements of Reader calls",
+		}, []string{"method"}),
+	}
+	for _, collector := range []prometheus.Collector{m.calls, m.errors, m.latency, m.rows} {
+		if err := registerer.Register(collector); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// observe records a call of method started at start, it is meant to be
+// deferred with a pointer to the named error result. It's a no-op on nil.
+func (m *readerMetrics) observe(method string, start time.Time, err *error) {
+	if m == nil {
+		return
+	}
+	m.calls.WithLabelValues(method).Inc()
+	if *err != nil {
+		m.errors.WithLabelValues(method).Inc()
+	}
+	m.latency.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+// methodKey carries the Reader method a statement runs for, set by startSpan
+type methodKey struct{}
+
+// methodFromContext returns the Reader method running the statement, empty
+// outside of the Reader
+func methodFromContext(ctx context.Context) string {
+	method, _ := ctx.Value(methodKey{}).(string)
+	return method
+}
+
+// rowsHook adds the rows returned by every statement of a Reader method to
+// the rows_returned_total counter of the method
+type rowsHook struct {
+	metrics *readerMetrics
+}
+
+var _ pg.QueryHook = rowsHook{}
+
+// addRowsHook hooks the connections of the Reader, the replica too when it is
+// a distinct pool
+func (r *Reader) addRowsHook() {
+	hook := rowsHook{metrics: r.metrics}
+	r.ownHandles()
+	r.db.AddQueryHook(hook)
+	if r.replica != r.db {
+		r.replica.AddQueryHook(hook)
+	}
+}
+
+func (h rowsHook) BeforeQuery(ctx context.Context, _ *pg.QueryEvent) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h rowsHook) AfterQuery(ctx context.Context, event *pg.QueryEvent) error {
+	method := methodFromContext(ctx)
+	if len(method) == 0 || event.Err != nil || event.Result == nil {
+		return nil
+	}
+	h.metrics.rows.WithLabelValues(method).Add(float64(event.Result.RowsReturned()))
+	return nil
+}
@@ -0,0 +1,85 @@
+package pgstore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	"github.com/go-pg/pg/v9/orm"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestReaderMetricsObserve(t *testing.T) {
+	metrics, err := newReaderMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, callErr := range []error{nil, errors.New("boom"), nil} {
+		metrics.observe("GetTrace", time.Now(), &callErr)
+	}
+	if calls := testutil.ToFloat64(metrics.calls.WithLabelValues("GetTrace")); calls != 3 {
+		t.Errorf("calls_total = %v, want 3", calls)
+	}
+	if failures := testutil.ToFloat64(metrics.errors.WithLabelValues("GetTrace")); failures != 1 {
+		t.Errorf("errors_total = %v, want 1", failures)
+	}
+	if calls := testutil.ToFloat64(metrics.calls.WithLabelValues("GetServices")); calls != 0 {
+		t.Errorf("calls_total of another method = %v, want 0", calls)
+	}
+
+	// a Reader without metrics
+	var none *readerMetrics
+	none.observe("GetTrace", time.Now(), &err)
+}
+
+func TestNewReaderMetricsRegistersOnce(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	if _, err := newReaderMetrics(registry); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newReaderMetrics(registry); err == nil {
+		t.Error("newReaderMetrics() registered the collectors twice")
+	}
+}
+
+// testResult is an orm.Result of a statement returning rows
+type testResult struct {
+	rows int
+}
+
+func (r testResult) Model() orm.Model  { return nil }
+func (r testResult) RowsAffected() int { return 0 }
+func (r testResult) RowsReturned() int { return r.rows }
+
+func TestRowsHook(t *testing.T) {
+	metrics, err := newReaderMetrics(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook := rowsHook{metrics: metrics}
+	ctx := context.WithValue(context.Background(), methodKey{}, "GetTrace")
+	events := []*pg.QueryEvent{
+		{Result: testResult{rows: 3}},
+		{Result: testResult{rows: 2}},
+		{Result: testResult{rows: 5}, Err: errors.New("boom")},
+		{},
+	}
+	for _, event := range events {
+		if err := hook.AfterQuery(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a statement run outside of a Reader method
+	if err := hook.AfterQuery(context.Background(), &pg.QueryEvent{Result: testResult{rows: 7}}); err != nil {
+		t.Fatal(err)
+	}
+	if rows := testutil.ToFloat64(metrics.rows.WithLabelValues("GetTrace")); rows != 5 {
+		t.Errorf("rows of GetTrace = %v, want the 5 of the successful statements", rows)
+	}
+	if rows := testutil.ToFloat64(metrics.rows.WithLabelValues("")); rows != 0 {
+		t.Errorf("rows without a method = %v, want none counted", rows)
+	}
+}
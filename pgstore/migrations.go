@@ -0,0 +1,518 @@
+package pgstore
+
+import (
+	"context"
+
+	"github.com/go-pg/pg/v9"
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+// migration is one step of the schema, applied at most once
+type migration struct {
+	version    int
+	statements string
+	// the change of statements to the archive copies of the span tables,
+	// see MigrateArchive. They only touch spans, span_refs and span_logs and
+	// leave a copy made after the migration as is, a copy doesn't tell
+	// which migrations it was made at.
+	archiveStatements string
+}
+
+// zeroTraceIDWords is migration 17 of the main and the archive tables. The
+// zero words of the trace ids were stored as NULL, the spans told apart by
+// them only are duplicates once they are 0.
+const zeroTraceIDWords = `
+DELETE FROM spans AS dup USING spans AS span
+	WHERE dup.trace_id_high IS NULL AND span.trace_id_high IS NULL AND dup.trace_id_low = span.trace_id_low
+	AND dup.id = span.id AND dup.start_time > span.start_time;
+DELETE FROM spans AS dup USING spans AS span
+	WHERE dup.trace_id_low IS NULL AND span.trace_id_low IS NULL AND dup.trace_id_high = span.trace_id_high
+	AND dup.id = span.id AND dup.start_time > span.start_time;
+UPDATE spans SET trace_id_low = coalesce(trace_id_low, 0), trace_id_high = coalesce(trace_id_high, 0)
+	WHERE trace_id_low IS NULL OR trace_id_high IS NULL;
+UPDATE span_refs SET trace_id_low = coalesce(trace_id_low, 0), trace_id_high = coalesce(trace_id_high, 0)
+	WHERE trace_id_low IS NULL OR trace_id_high IS NULL;
+`
+
+// uniqueSpanIDs is migration 8 of the main and the archive tables. The spans
+// and refs stored again by a retrying collector go, the unique index keeps
+// them out from then on.
+const uniqueSpanIDs = `
+DELETE FROM spans AS dup USING spans AS span
+	WHERE dup.trace_id_low = span.trace_id_low AND dup.trace_id_high = span.trace_id_high
+	AND dup.id = span.id AND dup.start_time > span.start_time;
+DELETE FROM span_refs AS dup USING span_refs AS ref
+	WHERE dup.id > ref.id AND dup.span_id = ref.span_id AND dup.child_span_id = ref.child_span_id
+	AND dup.trace_id_low = ref.trace_id_low AND dup.trace_id_high = ref.trace_id_high AND dup.ref_type = ref.ref_type;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_spans_trace_span_id ON spans (trace_id_low, trace_id_high, id, start_time);
+DROP INDEX IF EXISTS idx_spans_trace_id;
+`
+
+// duplicateSpanLogs is migration 19 of the main and the archive tables. A
+// span stored again by a retrying collector before migration 8 got its logs
+// stored again, the copies with a later id go.
+const duplicateSpanLogs = `
+DELETE FROM span_logs AS dup USING span_logs AS log
+	WHERE dup.id > log.id AND dup.span_id = log.span_id AND dup.timestamp = log.timestamp
+	AND dup.trace_id_low IS NOT DISTINCT FROM log.trace_id_low AND dup.trace_id_high IS NOT DISTINCT FROM log.trace_id_high
+	AND dup.fields IS NOT DISTINCT FROM log.fields;
+`
+
+// tenantSpanDetails is the part of migration 21 shared with the archive
+// tables, it adds the tenant of their span to the refs and logs
+const tenantSpanDetails = `
+ALTER TABLE span_refs ADD COLUMN IF NOT EXISTS tenant_id text NOT NULL DEFAULT '';
+ALTER TABLE span_logs ADD COLUMN IF NOT EXISTS tenant_id text NOT NULL DEFAULT '';
+UPDATE span_refs SET tenant_id = span.tenant_id FROM spans AS span
+	WHERE span.tenant_id <> '' AND span_refs.tenant_id = '' AND span.trace_id_low = span_refs.trace_id_low
+	AND span.trace_id_high = span_refs.trace_id_high AND span.id = span_refs.span_id;
+UPDATE span_logs SET tenant_id = span.tenant_id FROM spans AS span
+	WHERE span.tenant_id <> '' AND span_logs.tenant_id = '' AND span.trace_id_low = span_logs.trace_id_low
+	AND span.trace_id_high = span_logs.trace_id_high AND span.id = span_logs.span_id;
+`
+
+// spanRefTraceIDs is the part of migration 22 shared with the archive tables.
+// The trace columns of the refs hold the referenced trace, the refs get the
+// trace of the span holding them. That isn't recorded for the refs stored
+// before, they get the referenced trace when it has a span with their span
+// id, else the trace of another span with it, e.g. the holder of a ref into
+// another trace, whose tenant the ref missed in migration 21. The refs
+// whose span is gone keep the referenced trace, deleteOrphans removes them.
+const spanRefTraceIDs = `
+ALTER TABLE span_refs ADD COLUMN IF NOT EXISTS span_trace_id_low bigint;
+ALTER TABLE span_refs ADD COLUMN IF NOT EXISTS span_trace_id_high bigint;
+UPDATE span_refs SET span_trace_id_low = trace_id_low, span_trace_id_high = trace_id_high
+	WHERE span_trace_id_low IS NULL AND EXISTS (SELECT 1 FROM spans AS span
+		WHERE span.trace_id_low = span_refs.trace_id_low AND span.trace_id_high = span_refs.trace_id_high
+		AND span.id = span_refs.span_id AND span.tenant_id = span_refs.tenant_id);
+UPDATE span_refs SET span_trace_id_low = span.trace_id_low, span_trace_id_high = span.trace_id_high,
+	tenant_id = span.tenant_id
+	FROM spans AS span WHERE span_refs.span_trace_id_low IS NULL AND span.id = span_refs.span_id
+	AND span_refs.tenant_id IN ('', span.tenant_id);
+UPDATE span_refs SET span_trace_id_low = trace_id_low, span_trace_id_high = trace_id_high
+	WHERE span_trace_id_low IS NULL;
+`
+
+// migrations must only ever be appended to, an applied version is never re-run
+var migrations = []migration{
+	{
+		version: 1,
+		statements: `
+CREATE TABLE IF NOT EXISTS services (
+	id bigserial PRIMARY KEY,
+	service_name text UNIQUE
+);
+CREATE TABLE IF NOT EXISTS operations (
+	id bigserial PRIMARY KEY,
+	service_id bigint,
+	operation_name text,
+	span_kind text,
+	UNIQUE (service_id, operation_name, span_kind)
+);
+CREATE TABLE IF NOT EXISTS spans (
+	id bigint,
+	trace_id_low bigint,
+	trace_id_high bigint,
+	operation_id bigint,
+	flags bigint,
+	start_time timestamptz,
+	duration bigint,
+	tags jsonb,
+	service_id bigint,
+	process_id text,
+	process_tags jsonb,
+	warnings jsonb,
+	PRIMARY KEY (id, start_time)
+);
+CREATE TABLE IF NOT EXISTS span_refs (
+	id bigserial PRIMARY KEY,
+	trace_id_low bigint,
+	trace_id_high bigint,
+	source_span_id bigint,
+	child_span_id bigint,
+	ref_type integer
+);
+CREATE TABLE IF NOT EXISTS span_logs (
+	id bigserial PRIMARY KEY,
+	span_id bigint,
+	timestamp timestamptz,
+	fields jsonb
+);
+CREATE TABLE IF NOT EXISTS dependencies (
+	id bigserial PRIMARY KEY,
+	ts timestamptz,
+	parent text,
+	child text,
+	call_count bigint,
+	source text
+);
+CREATE INDEX IF NOT EXISTS idx_spans_trace_id ON spans (trace_id_low, trace_id_high);
+CREATE INDEX IF NOT EXISTS idx_span_refs_source_span_id ON span_refs USING btree (source_span_id ASC NULLS LAST);
+CREATE INDEX IF NOT EXISTS idx_span_logs_span_id ON span_logs (span_id);
+CREATE INDEX IF NOT EXISTS idx_dependencies_ts ON dependencies (ts);
+`,
+	},
+	{
+		version: 2,
+		statements: `
+CREATE INDEX IF NOT EXISTS idx_spans_service_operation_start_time ON spans (service_id, operation_id, start_time);
+`,
+	},
+	{
+		version: 3,
+		statements: `
+ALTER TABLE span_refs RENAME COLUMN source_span_id TO span_id;
+ALTER INDEX idx_span_refs_source_span_id RENAME TO idx_span_refs_span_id;
+`,
+		archiveStatements: `
+DO $$ BEGIN
+	IF EXISTS (SELECT 1 FROM information_schema.columns
+		WHERE table_schema = current_schema() AND table_name = 'span_refs' AND column_name = 'source_span_id') THEN
+		ALTER TABLE span_refs RENAME COLUMN source_span_id TO span_id;
+	END IF;
+END $$;
+`,
+	},
+	{
+		version: 4,
+		statements: `
+ALTER TABLE spans ADD COLUMN IF NOT EXISTS tag_types jsonb;
+ALTER TABLE spans ADD COLUMN IF NOT EXISTS process_tag_types jsonb;
+ALTER TABLE span_logs ADD COLUMN IF NOT EXISTS field_types jsonb;
+`,
+		archiveStatements: `
+ALTER TABLE spans ADD COLUMN IF NOT EXISTS tag_types jsonb;
+ALTER TABLE spans ADD COLUMN IF NOT EXISTS process_tag_types jsonb;
+ALTER TABLE span_logs ADD COLUMN IF NOT EXISTS field_types jsonb;
+`,
+	},
+	{
+		version: 5,
+		statements: `
+UPDATE spans SET duration = duration / 1000;
+COMMENT ON COLUMN spans.duration IS 'microseconds';
+`,
+		// the comment, copied along with the table, tells the converted copies
+		archiveStatements: `
+DO $$ BEGIN
+	IF col_description('spans'::regclass, (SELECT attnum FROM pg_attribute
+		WHERE attrelid = 'spans'::regclass AND attname = 'duration')) IS DISTINCT FROM 'microseconds' THEN
+		UPDATE spans SET duration = duration / 1000;
+		COMMENT ON COLUMN spans.duration IS 'microseconds';
+	END IF;
+END $$;
+`,
+	},
+	{
+		version: 6,
+		statements: `
+CREATE INDEX IF NOT EXISTS idx_spans_tags ON spans USING gin (tags jsonb_path_ops);
+CREATE INDEX IF NOT EXISTS idx_spans_process_tags ON spans USING gin (process_tags jsonb_path_ops);
+`,
+	},
+	{
+		version: 7,
+		statements: `
+ALTER TABLE spans ADD COLUMN IF NOT EXISTS has_error boolean NOT NULL DEFAULT false;
+UPDATE spans SET has_error = true
+	WHERE tags @> '{"error": true}' OR tags @> '{"error": "true"}' OR tags @> '{"otel.status_code": "ERROR"}';
+CREATE INDEX IF NOT EXISTS idx_spans_has_error ON spans (start_time) WHERE has_error;
+`,
+		archiveStatements: `
+ALTER TABLE spans ADD COLUMN IF NOT EXISTS has_error boolean NOT NULL DEFAULT false;
+UPDATE spans SET has_error = true
+	WHERE NOT has_error AND (tags @> '{"error": true}' OR tags @> '{"error": "true"}' OR tags @> '{"otel.status_code": "ERROR"}');
+`,
+	},
+	{
+		// the unique index includes start_time as Timescale requires of every
+		// unique index of a hypertable
+		version:    8,
+		statements: uniqueSpanIDs,
+		// a copy made after the migration has the index under another name
+		archiveStatements: `
+DO $$ BEGIN
+	IF NOT EXISTS (SELECT 1 FROM pg_index WHERE indrelid = 'spans'::regclass AND indisunique
+		AND pg_get_indexdef(indexrelid) LIKE '%(trace_id_low, trace_id_high, id, start_time%') THEN
+` + uniqueSpanIDs + `
+	END IF;
+END $$;
+`,
+	},
+	{
+		version: 9,
+		statements: `
+CREATE TABLE IF NOT EXISTS sampling_throughput (
+	id bigserial PRIMARY KEY,
+	ts timestamptz,
+	service_name text,
+	operation_name text,
+	count bigint,
+	probabilities text[]
+);
+CREATE TABLE IF NOT EXISTS sampling_probabilities (
+	id bigserial PRIMARY KEY,
+	ts timestamptz,
+	hostname text,
+	probabilities jsonb,
+	qps jsonb
+);
+CREATE INDEX IF NOT EXISTS idx_sampling_throughput_ts ON sampling_throughput (ts);
+CREATE INDEX IF NOT EXISTS idx_sampling_probabilities_ts ON sampling_probabilities (ts);
+`,
+	},
+	{
+		version: 10,
+		statements: `
+CREATE INDEX IF NOT EXISTS idx_spans_start_time ON spans (start_time);
+`,
+	},
+	{
+		version: 11,
+		statements: `
+ALTER TABLE spans ADD COLUMN IF NOT EXISTS tenant_id text NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS idx_spans_tenant_start_time ON spans (tenant_id, start_time) WHERE tenant_id <> '';
+`,
+		archiveStatements: `
+ALTER TABLE spans ADD COLUMN IF NOT EXISTS tenant_id text NOT NULL DEFAULT '';
+`,
+	},
+	{
+		version: 12,
+		statements: `
+ALTER TABLE operations ADD COLUMN IF NOT EXISTS truncated boolean NOT NULL DEFAULT false;
+`,
+	},
+	{
+		version: 13,
+		statements: `
+ALTER TABLE span_refs ADD COLUMN IF NOT EXISTS ordinal integer NOT NULL DEFAULT 0;
+`,
+		archiveStatements: `
+ALTER TABLE span_refs ADD COLUMN IF NOT EXISTS ordinal integer NOT NULL DEFAULT 0;
+`,
+	},
+	{
+		version: 14,
+		statements: `
+CREATE TABLE IF NOT EXISTS service_aliases (
+	alias text PRIMARY KEY,
+	service_name text NOT NULL
+);
+`,
+	},
+	{
+		version: 15,
+		statements: `
+CREATE INDEX IF NOT EXISTS idx_span_logs_fields ON span_logs USING gin (fields);
+`,
+	},
+	{
+		// operations created by the ORM before migration 1 only have a unique
+		// operation_name, the writer needs the composite key of migration 1.
+		// Such an operation goes to the service of its first span, the other
+		// services of its spans get a copy their spans are moved to.
+		version: 16,
+		statements: `
+ALTER TABLE operations ADD COLUMN IF NOT EXISTS service_id bigint;
+ALTER TABLE operations ADD COLUMN IF NOT EXISTS span_kind text;
+ALTER TABLE operations DROP CONSTRAINT IF EXISTS operations_operation_name_key;
+UPDATE operations SET service_id = span.service_id
+	FROM (SELECT DISTINCT ON (operation_id) operation_id, service_id FROM spans ORDER BY operation_id, start_time) AS span
+	WHERE operations.service_id IS NULL AND span.operation_id = operations.id;
+UPDATE operations SET span_kind = '' WHERE span_kind IS NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS operations_service_id_operation_name_span_kind_key ON operations (service_id, operation_name, span_kind);
+INSERT INTO operations (service_id, operation_name, span_kind)
+	SELECT DISTINCT span.service_id, operation.operation_name, operation.span_kind
+	FROM spans AS span JOIN operations AS operation ON operation.id = span.operation_id
+	WHERE span.service_id <> operation.service_id
+	ON CONFLICT (service_id, operation_name, span_kind) DO NOTHING;
+UPDATE spans SET operation_id = copy.id
+	FROM operations AS operation, operations AS copy
+	WHERE operation.id = spans.operation_id AND spans.service_id <> operation.service_id
+		AND copy.service_id = spans.service_id AND copy.operation_name = operation.operation_name
+		AND copy.span_kind = operation.span_kind;
+`,
+	},
+	{
+		version:           17,
+		statements:        zeroTraceIDWords,
+		archiveStatements: zeroTraceIDWords,
+	},
+	{
+		// span ids are only unique within a trace, the logs stored before
+		// get the trace of a span with their span id
+		version: 18,
+		statements: `
+ALTER TABLE span_logs ADD COLUMN IF NOT EXISTS trace_id_low bigint;
+ALTER TABLE span_logs ADD COLUMN IF NOT EXISTS trace_id_high bigint;
+UPDATE span_logs SET trace_id_low = span.trace_id_low, trace_id_high = span.trace_id_high
+	FROM spans AS span WHERE span_logs.trace_id_low IS NULL AND span.id = span_logs.span_id;
+CREATE INDEX IF NOT EXISTS idx_span_logs_trace_span_id ON span_logs (trace_id_low, trace_id_high, span_id);
+DROP INDEX IF EXISTS idx_span_logs_span_id;
+`,
+		archiveStatements: `
+ALTER TABLE span_logs ADD COLUMN IF NOT EXISTS trace_id_low bigint;
+ALTER TABLE span_logs ADD COLUMN IF NOT EXISTS trace_id_high bigint;
+UPDATE span_logs SET trace_id_low = span.trace_id_low, trace_id_high = span.trace_id_high
+	FROM spans AS span WHERE span_logs.trace_id_low IS NULL AND span.id = span_logs.span_id;
+`,
+	},
+	{
+		version:           19,
+		statements:        duplicateSpanLogs,
+		archiveStatements: duplicateSpanLogs,
+	},
+	{
+		// live dependencies join the references to the callers in the window
+		version: 20,
+		statements: `
+CREATE INDEX IF NOT EXISTS idx_span_refs_trace_child_span_id ON span_refs (trace_id_low, trace_id_high, child_span_id);
+`,
+	},
+	{
+		// trace and span ids are only unique within a tenant, the refs and
+		// logs stored before get the tenant of their span. The primary key on
+		// (id, start_time) goes as it would refuse the ids of another tenant.
+		version: 21,
+		statements: tenantSpanDetails + `
+ALTER TABLE spans DROP CONSTRAINT IF EXISTS spans_pkey;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_spans_trace_span_tenant_id ON spans (trace_id_low, trace_id_high, id, start_time, tenant_id);
+DROP INDEX IF EXISTS idx_spans_trace_span_id;
+ALTER INDEX idx_spans_trace_span_tenant_id RENAME TO idx_spans_trace_span_id;
+`,
+		archiveStatements: tenantSpanDetails,
+	},
+	{
+		// a span may reference one of another trace, e.g. FOLLOWS_FROM, the
+		// refs are found by the trace of the span holding them
+		version: 22,
+		statements: spanRefTraceIDs + `
+CREATE INDEX IF NOT EXISTS idx_span_refs_span_trace_span_id ON span_refs (span_trace_id_low, span_trace_id_high, span_id);
+DROP INDEX IF EXISTS idx_span_refs_span_id;
+`,
+		archiveStatements: spanRefTraceIDs,
+	},
+	{
+		// the Writer names the unique index of migration 21 as its conflict
+		// target, the archive copies made before lack it. The main tables
+		// have it already.
+		version: 23,
+		archiveStatements: `
+DO $$ BEGIN
+	IF NOT EXISTS (SELECT 1 FROM pg_index WHERE indrelid = 'spans'::regclass AND indisunique
+		AND pg_get_indexdef(indexrelid) LIKE '%(trace_id_low, trace_id_high, id, start_time, tenant_id)') THEN
+		DELETE FROM spans AS dup USING spans AS span
+			WHERE dup.trace_id_low = span.trace_id_low AND dup.trace_id_high = span.trace_id_high
+			AND dup.id = span.id AND dup.tenant_id = span.tenant_id AND dup.start_time > span.start_time;
+		ALTER TABLE spans DROP CONSTRAINT IF EXISTS spans_pkey;
+		DROP INDEX IF EXISTS idx_spans_trace_span_id;
+		CREATE UNIQUE INDEX idx_spans_trace_span_id ON spans (trace_id_low, trace_id_high, id, start_time, tenant_id);
+	END IF;
+END $$;
+`,
+	},
+	{
+		// precomputed dependencies are those of a tenant like the spans
+		version: 24,
+		statements: `
+ALTER TABLE dependencies ADD COLUMN IF NOT EXISTS tenant_id text NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS idx_dependencies_tenant_ts ON dependencies (tenant_id, ts);
+`,
+	},
+}
+
+// migrationsLockID serializes concurrent Migrate calls, e.g. several plugin
+// instances starting at once
+const migrationsLockID = 4320903824
+
+// Migrate brings the schema up to date. It is idempotent and safe to run at
+// every startup, each pending migration is applied in its own transaction and
+// recorded in the schema_migrations table. Configuration.StatementTimeout
+// doesn't apply to the migrations.
+func Migrate(ctx context.Context, db *pg.DB, logger hclog.Logger) error {
+	if err := applyMigrations(db.WithContext(ctx), "", logger); err != nil {
+		return err
+	}
+
+	err := db.WithContext(ctx).RunInTransaction(func(tx *pg.Tx) error {
+		if err := withoutStatementTimeout(tx); err != nil {
+			return err
+		}
+		_, err := tx.Exec("SELECT * from create_hypertable('spans', 'start_time', if_not_exists => TRUE);")
+		return err
+	})
+	if err != nil {
+		logger.Warn("Couldn't use Timescale, queries will be slower...", "err", err)
+	}
+	return nil
+}
+
+// withoutStatementTimeout lifts the statement_timeout of the connection for
+// the rest of tx, the migrations rewrite and index whole tables
+func withoutStatementTimeout(tx *pg.Tx) error {
+	_, err := tx.Exec("SET LOCAL statement_timeout = 0")
+	return err
+}
+
+// applyMigrations applies the pending migrations, or with an archive schema
+// their archiveStatements to the tables of that schema. The applied versions
+// are recorded in the schema_migrations table of the schema.
+func applyMigrations(db *pg.DB, archiveSchema string, logger hclog.Logger) error {
+	versions := pg.Ident("schema_migrations")
+	if len(archiveSchema) > 0 {
+		versions = pg.Ident(archiveSchema + ".schema_migrations")
+	}
+	err := db.RunInTransaction(func(tx *pg.Tx) error {
+		if err := withoutStatementTimeout(tx); err != nil {
+			return err
+		}
+		_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS ? (
+		version integer PRIMARY KEY,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`, versions)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		statements := m.statements
+		if len(archiveSchema) > 0 {
+			statements = m.archiveStatements
+		}
+		err := db.RunInTransaction(func(tx *pg.Tx) error {
+			// waiting for the lock, e.g. while another instance migrates, is
+			// no timeout either
+			if err := withoutStatementTimeout(tx); err != nil {
+				return err
+			}
+			if _, err := tx.Exec("SELECT pg_advisory_xact_lock(?)", migrationsLockID); err != nil {
+				return err
+			}
+			var applied int
+			if _, err := tx.QueryOne(pg.Scan(&applied), "SELECT count(*) FROM ? WHERE version = ?", versions, m.version); err != nil || applied > 0 {
+				return err
+			}
+			if len(statements) > 0 {
+				logger.Info("Applying schema migration", "version", m.version, "archiveSchema", archiveSchema)
+				if len(archiveSchema) > 0 {
+					// only the archive copies may be touched
+					if _, err := tx.Exec("SET LOCAL search_path TO ?", pg.Ident(archiveSchema)); err != nil {
+						return err
+					}
+				}
+				if _, err := tx.Exec(statements); err != nil {
+					return err
+				}
+			}
+			_, err := tx.Exec("INSERT INTO ? (version) VALUES (?)", versions, m.version)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
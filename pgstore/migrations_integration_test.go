@@ -0,0 +1,179 @@
+//go:build integration
+// +build integration
+
+package pgstore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+func TestMigrateCreatesSchema(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	// a second run finds every migration applied
+	if err := Migrate(context.Background(), db, hclog.NewNullLogger()); err != nil {
+		t.Fatal(err)
+	}
+
+	var tables []string
+	if _, err := db.Query(&tables, "SELECT table_name FROM information_schema.tables WHERE table_schema = current_schema()"); err != nil {
+		t.Fatal(err)
+	}
+	var indexes []string
+	if _, err := db.Query(&indexes, "SELECT indexname FROM pg_indexes WHERE schemaname = current_schema()"); err != nil {
+		t.Fatal(err)
+	}
+	assertContains(t, "table", tables, "schema_migrations", "services", "operations", "spans", "span_refs", "span_logs",
+		"dependencies", "sampling_throughput", "sampling_probabilities", "service_aliases")
+	assertContains(t, "index", indexes, "idx_spans_trace_span_id", "idx_spans_service_operation_start_time",
+		"idx_spans_start_time", "idx_spans_tags", "idx_spans_process_tags", "idx_spans_has_error",
+		"idx_span_refs_span_trace_span_id", "idx_span_refs_trace_child_span_id", "idx_span_logs_trace_span_id", "idx_span_logs_fields", "idx_dependencies_ts",
+		"idx_dependencies_tenant_ts", "operations_service_id_operation_name_span_kind_key")
+
+	var versions int
+	if _, err := db.QueryOne(pg.Scan(&versions), "SELECT count(*) FROM schema_migrations"); err != nil {
+		t.Fatal(err)
+	}
+	if versions != len(migrations) {
+		t.Errorf("%d migrations recorded, want %d", versions, len(migrations))
+	}
+
+	// with Timescale, as in the test image, every unique index has to allow
+	// spans to become a hypertable
+	var timescale bool
+	if _, err := db.QueryOne(pg.Scan(&timescale), "SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'timescaledb')"); err != nil {
+		t.Fatal(err)
+	}
+	if timescale {
+		var hypertables int
+		if _, err := db.QueryOne(pg.Scan(&hypertables), "SELECT count(*) FROM _timescaledb_catalog.hypertable WHERE table_name = 'spans'"); err != nil {
+			t.Fatal(err)
+		}
+		if hypertables != 1 {
+			t.Error("spans is no hypertable")
+		}
+	}
+}
+
+// assertContains fails the test for each of want missing from got
+func assertContains(tb testing.TB, kind string, got []string, want ...string) {
+	tb.Helper()
+	found := make(map[string]bool, len(got))
+	for _, name := range got {
+		found[name] = true
+	}
+	for _, name := range want {
+		if !found[name] {
+			tb.Errorf("%s %s is missing", kind, name)
+		}
+	}
+}
+
+func TestMigrateOperationsOfTheORM(t *testing.T) {
+	conf, done := newTestConfiguration(t)
+	defer done()
+	opts, err := conf.pgOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := pg.Connect(opts)
+	defer db.Close()
+
+	// the tables as the ORM created them before migration 1
+	if _, err := db.Exec(`
+CREATE TABLE services (id bigserial PRIMARY KEY, service_name text UNIQUE);
+CREATE TABLE operations (id bigserial PRIMARY KEY, operation_name text UNIQUE);
+CREATE TABLE spans (id bigint, trace_id_low bigint, trace_id_high bigint, operation_id bigint, flags bigint,
+	start_time timestamptz, duration bigint, tags jsonb, service_id bigint, process_id text, process_tags jsonb,
+	warnings jsonb, PRIMARY KEY (id, start_time));
+CREATE TABLE span_refs (id bigserial PRIMARY KEY, trace_id_low bigint, trace_id_high bigint,
+	source_span_id bigint, child_span_id bigint, ref_type integer);
+CREATE TABLE span_logs (id bigserial PRIMARY KEY, span_id bigint, timestamp timestamptz, fields jsonb);
+INSERT INTO services (id, service_name) VALUES (1, 'frontend'), (2, 'backend');
+-- the operation name is shared by the spans of both services
+INSERT INTO operations (id, operation_name) VALUES (1, 'GET /');
+INSERT INTO spans (id, trace_id_low, trace_id_high, operation_id, start_time, duration, service_id)
+	VALUES (1, 1, 0, 1, now() - interval '1 second', 1000000, 1), (2, 1, 0, 1, now(), 1000000, 2);
+-- a log stored twice by a retried write
+INSERT INTO span_logs (span_id, timestamp, fields) VALUES (1, '2020-03-01 12:00:00Z', '{"event": "retried"}'),
+	(1, '2020-03-01 12:00:00Z', '{"event": "retried"}'), (1, '2020-03-01 12:00:01Z', '{"event": "retried"}');
+`); err != nil {
+		t.Fatal(err)
+	}
+	if err := Migrate(context.Background(), db, hclog.NewNullLogger()); err != nil {
+		t.Fatal(err)
+	}
+
+	var operation Operation
+	if err := db.Model(&operation).Where("id = 1").Select(); err != nil {
+		t.Fatal(err)
+	}
+	if operation.ServiceID != 1 || operation.SpanKind != "" {
+		t.Errorf("the ORM operation got service %d and span kind %q, want 1 and none", operation.ServiceID, operation.SpanKind)
+	}
+	var backendOperation Operation
+	if err := db.Model(&backendOperation).Where("id = (SELECT operation_id FROM spans WHERE id = 2)").Select(); err != nil {
+		t.Fatal(err)
+	}
+	if backendOperation.ServiceID != 2 || backendOperation.OperationName != "GET /" {
+		t.Errorf("the span of backend has the operation %+v, want GET / of backend", backendOperation)
+	}
+	if count := countRows(t, db, (*Log)(nil)); count != 2 {
+		t.Errorf("%d logs after the migrations, want the copy of the retried one gone", count)
+	}
+	// the writer finds the operation of each service
+	writeTestSpans(t, NewWriter(db, hclog.NewNullLogger()),
+		testSpan(model.TraceID{Low: 2}, 3, "frontend", "GET /", time.Now()),
+		testSpan(model.TraceID{Low: 3}, 4, "backend", "GET /", time.Now()))
+	if count := countRows(t, db, (*Operation)(nil)); count != 2 {
+		t.Errorf("%d operations, want the ORM one and the one of backend", count)
+	}
+	operations, err := NewReader(db, hclog.NewNullLogger()).GetOperations(context.Background(), spanstore.OperationQueryParameters{ServiceName: "backend"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []spanstore.Operation{{Name: "GET /"}}; !reflect.DeepEqual(operations, want) {
+		t.Errorf("GetOperations(backend) = %v, want %v", operations, want)
+	}
+}
+
+func TestMigrateWithStatementTimeout(t *testing.T) {
+	conf, done := newTestConfiguration(t)
+	defer done()
+	conf.StatementTimeout = 10 * time.Millisecond
+	opts, err := conf.pgOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := pg.Connect(opts)
+	defer db.Close()
+	if _, err := db.Exec("SELECT pg_sleep(0.1)"); err == nil {
+		t.Fatal("the statement timeout doesn't apply to the connection")
+	}
+
+	// a slow migration holding the lock the others wait for
+	lockDB := pg.Connect(opts)
+	defer lockDB.Close()
+	tx, err := lockDB.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Exec("SET LOCAL statement_timeout = 0; SELECT pg_advisory_xact_lock(?)", migrationsLockID); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		tx.Rollback()
+	}()
+	if err := Migrate(context.Background(), db, hclog.NewNullLogger()); err != nil {
+		t.Fatalf("Migrate() with a statement timeout: %v", err)
+	}
+}
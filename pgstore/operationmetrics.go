@@ -0,0 +1,141 @@
+package pgstore
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+// OperationMetrics are the call count and latency quantiles of an operation
+type OperationMetrics struct {
+	Operation string
+	SpanKind  string
+	Count     int64
+	P50       time.Duration
+	P95       time.Duration
+	P99       time.Duration
+}
+
+// operationMetricsQuery aggregates the spans of a service and its aliases
+// started within the window, of the tenant unless it is empty. The quantiles are interpolated
+// between the stored durations.
+const operationMetricsQuery = `SELECT operation.operation_name, operation.span_kind, count(*) AS count,
+	percentile_cont(ARRAY[0.5, 0.95, 0.99]) WITHIN GROUP (ORDER BY span.duration) AS quantiles
+FROM spans AS span
+JOIN operations AS operation ON operation.id = span.operation_id
+JOIN services AS service ON service.id = span.service_id
+WHERE service.service_name IN (?) AND span.start_time >= ? AND (? = '' OR span.tenant_id = ?)
+GROUP BY operation.operation_name, operation.span_kind
+ORDER BY operation.operation_name ASC, operation.span_kind ASC`
+
+// GetOperationMetrics returns the metrics of every operation of service over
+// the spans started within the last window, ordered by operation name
+func (r *Reader) GetOperationMetrics(ctx context.Context, service string, window time.Duration) (ret []OperationMetrics, err error) {
+	defer r.metrics.observe("GetOperationMetrics", time.Now(), &err)
+	ospan, ctx := r.startSpan(ctx, "GetOperationMetrics")
+	defer finishSpan(ospan, &err)
+	ctx, cancel := r.withQueryTimeout(ctx)
+	defer cancel()
+	ospan.SetTag("service_name", service)
+
+	var rows []struct {
+		OperationName string
+		SpanKind      string
+		Count         int64
+		Quantiles     []float64 `pg:",array"`
+	}
+	since := time.Now().Add(-window)
+	tenant := TenantFromContext(ctx)
+	err = r.retry(ctx, func() error {
+		rows = nil
+		aliases, err := r.serviceAliases(ctx)
+		if err != nil {
+			return err
+		}
+		services := pg.In(withServiceAliases([]string{service}, aliases))
+		_, err = r.replica.QueryContext(ctx, &rows, operationMetricsQuery, services, since, tenant, tenant)
+		return err
+	})
+	if err != nil {
+		return nil, wrapError(err, "GetOperationMetrics(%s)", service)
+	}
+
+	ret = make([]OperationMetrics, 0, len(rows))
+	for _, row := range rows {
+		metrics := OperationMetrics{Operation: row.OperationName, SpanKind: row.SpanKind, Count: row.Count}
+		if len(row.Quantiles) == 3 {
+			metrics.P50 = fromMicroseconds(int64(row.Quantiles[0]))
+			metrics.P95 = fromMicroseconds(int64(row.Quantiles[1]))
+			metrics.P99 = fromMicroseconds(int64(row.Quantiles[2]))
+		}
+		ret = append(ret, metrics)
+	}
+	ospan.SetTag("result_count", len(ret))
+	return ret, nil
+}
+
+// LatencyBucket counts the spans whose duration is at most UpperBound and
+// above the bound of the previous bucket, the last bucket counting the
+// longer spans has no UpperBound
+type LatencyBucket struct {
+	UpperBound time.Duration
+	Count      int64
+}
+
+// GetLatencyHistogram distributes the spans of the service started within
+// the last window among buckets, the ascending upper bounds of all but the
+// last of the returned len(buckets)+1 buckets. An empty operation stands for
+// every operation of the service.
+func (r *Reader) GetLatencyHistogram(ctx context.Context, service, operation string, window time.Duration, buckets []time.Duration) (ret []LatencyBucket, err error) {
+	defer r.metrics.observe("GetLatencyHistogram", time.Now(), &err)
+	ospan, ctx := r.startSpan(ctx, "GetLatencyHistogram")
+	defer finishSpan(ospan, &err)
+	ctx, cancel := r.withQueryTimeout(ctx)
+	defer cancel()
+	ospan.SetTag("service_name", service)
+	ospan.SetTag("operation_name", operation)
+
+	// width_bucket counts the thresholds at most the duration, starting the
+	// thresholds a microsecond past the bounds makes the bounds inclusive
+	thresholds := make([]int64, 0, len(buckets))
+	ret = make([]LatencyBucket, 0, len(buckets)+1)
+	for i, bound := range buckets {
+		if i > 0 && bound <= buckets[i-1] {
+			return nil, wrapError(fmt.Errorf("bucket bounds must ascend, %s follows %s", bound, buckets[i-1]), "GetLatencyHistogram(%s)", service)
+		}
+		thresholds = append(thresholds, toMicroseconds(bound)+1)
+		ret = append(ret, LatencyBucket{UpperBound: bound})
+	}
+	ret = append(ret, LatencyBucket{})
+
+	var rows []struct {
+		Bucket int
+		Count  int64
+	}
+	err = r.retry(ctx, func() error {
+		rows = nil
+		builder := &whereBuilder{}
+		found, err := r.whereServiceAndOperation(ctx, builder, &spanstore.TraceQueryParameters{ServiceName: service, OperationName: operation}, "")
+		if err != nil || !found {
+			return err
+		}
+		builder.andWhere(time.Now().Add(-window), startTimeMinPredicate)
+		return whereTenant(ctx, r.replica.ModelContext(ctx, (*Span)(nil))).
+			ColumnExpr("width_bucket(span.duration, ?::bigint[]) AS bucket", pg.Array(thresholds)).
+			ColumnExpr("count(*) AS count").
+			Where(builder.where, builder.params...).
+			Group("bucket").Select(&rows)
+	})
+	if err != nil {
+		return nil, wrapError(err, "GetLatencyHistogram(%s)", service)
+	}
+	for _, row := range rows {
+		if row.Bucket >= 0 && row.Bucket < len(ret) {
+			ret[row.Bucket].Count += row.Count
+		}
+	}
+	return ret, nil
+}
@@ -0,0 +1,263 @@
+package pgstore
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+// ExportTraces writes the traces matching the query to w as OTLP/JSON, one
+// TracesData object per trace and line like the file exporter of the
+// OpenTelemetry collector. The traces are streamed, a single one is held in
+// memory at a time.
+func (r *Reader) ExportTraces(ctx context.Context, query *spanstore.TraceQueryParameters, w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	return r.StreamTraces(ctx, query, func(trace *model.Trace) error {
+		return encoder.Encode(toOTLPTraces(trace))
+	})
+}
+
+// The subset of the OTLP/JSON encoding of
+// opentelemetry/proto/trace/v1/trace.proto the Jaeger model maps onto. As in
+// the JSON mapping of protobuf, 64 bit integers are strings and ids are hex.
+// Jaeger 1.17 converts its model to JSON and Thrift only, and the translator
+// of the OpenTelemetry collector needs a newer Jaeger and Go than this module,
+// so the mapping follows that translator here.
+type (
+	otlpTracesData struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name,omitempty"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Events            []otlpEvent    `json:"events,omitempty"`
+		Links             []otlpLink     `json:"links,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpEvent struct {
+		TimeUnixNano string         `json:"timeUnixNano"`
+		Name         string         `json:"name"`
+		Attributes   []otlpKeyValue `json:"attributes,omitempty"`
+	}
+	otlpLink struct {
+		TraceID string `json:"traceId"`
+		SpanID  string `json:"spanId"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpKeyValue struct {
+		Key   string       `json:"key"`
+		Value otlpAnyValue `json:"value"`
+	}
+	otlpAnyValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+		BytesValue  *string  `json:"bytesValue,omitempty"`
+	}
+)
+
+// Values of the OTLP Span.SpanKind and Status.StatusCode enums
+const (
+	otlpSpanKindInternal = 1
+	otlpSpanKindServer   = 2
+	otlpSpanKindClient   = 3
+	otlpSpanKindProducer = 4
+	otlpSpanKindConsumer = 5
+
+	otlpStatusCodeOK    = 1
+	otlpStatusCodeError = 2
+)
+
+// Tags of Jaeger carrying the OTLP span fields rather than attributes
+const (
+	spanKindTagKey           = "span.kind"
+	otelStatusDescriptionKey = "otel.status_description"
+	otelLibraryNameKey       = "otel.library.name"
+	serviceNameAttribute     = "service.name"
+	logEventFieldKey         = "event"
+)
+
+// toOTLPTraces groups the spans of the trace by process, each one becoming a
+// resource, and by instrumentation library within it
+func toOTLPTraces(trace *model.Trace) otlpTracesData {
+	type scopeKey struct {
+		resource int
+		scope    string
+	}
+	var data otlpTracesData
+	resources := make(map[string]int)
+	scopes := make(map[scopeKey]int)
+	for _, span := range trace.Spans {
+		processKey := span.ProcessID
+		if span.Process != nil {
+			processKey = span.Process.ServiceName + "\x00" + processKey
+		}
+		i, found := resources[processKey]
+		if !found {
+			i = len(data.ResourceSpans)
+			resources[processKey] = i
+			data.ResourceSpans = append(data.ResourceSpans, otlpResourceSpans{Resource: toOTLPResource(span.Process)})
+		}
+		resource := &data.ResourceSpans[i]
+
+		otlp, scope := toOTLPSpan(span)
+		j, found := scopes[scopeKey{resource: i, scope: scope}]
+		if !found {
+			j = len(resource.ScopeSpans)
+			scopes[scopeKey{resource: i, scope: scope}] = j
+			resource.ScopeSpans = append(resource.ScopeSpans, otlpScopeSpans{Scope: otlpScope{Name: scope}})
+		}
+		resource.ScopeSpans[j].Spans = append(resource.ScopeSpans[j].Spans, otlp)
+	}
+	return data
+}
+
+func toOTLPResource(process *model.Process) otlpResource {
+	var resource otlpResource
+	if process == nil {
+		return resource
+	}
+	serviceName := process.ServiceName
+	resource.Attributes = append(resource.Attributes, otlpKeyValue{Key: serviceNameAttribute, Value: otlpAnyValue{StringValue: &serviceName}})
+	resource.Attributes = append(resource.Attributes, toOTLPAttributes(process.Tags)...)
+	return resource
+}
+
+// toOTLPSpan converts the span and returns the name of its instrumentation
+// library, the otel.library.name tag
+func toOTLPSpan(span *model.Span) (otlpSpan, string) {
+	otlp := otlpSpan{
+		TraceID:           fmt.Sprintf("%016x%016x", span.TraceID.High, span.TraceID.Low),
+		SpanID:            fmt.Sprintf("%016x", uint64(span.SpanID)),
+		Name:              span.OperationName,
+		Kind:              otlpSpanKindInternal,
+		StartTimeUnixNano: strconv.FormatInt(span.StartTime.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(span.StartTime.Add(span.Duration).UnixNano(), 10),
+	}
+	if parent := span.ParentSpanID(); parent != 0 {
+		otlp.ParentSpanID = fmt.Sprintf("%016x", uint64(parent))
+	}
+	for _, ref := range span.References {
+		if ref.RefType == model.ChildOf && ref.TraceID == span.TraceID && ref.SpanID == span.ParentSpanID() {
+			continue
+		}
+		otlp.Links = append(otlp.Links, otlpLink{
+			TraceID: fmt.Sprintf("%016x%016x", ref.TraceID.High, ref.TraceID.Low),
+			SpanID:  fmt.Sprintf("%016x", uint64(ref.SpanID)),
+		})
+	}
+
+	scope := ""
+	hasError := spanHasError(span)
+	if hasError {
+		otlp.Status.Code = otlpStatusCodeError
+	}
+	attributes := make([]model.KeyValue, 0, len(span.Tags))
+	for _, tag := range span.Tags {
+		switch tag.Key {
+		case spanKindTagKey:
+			otlp.Kind = toOTLPSpanKind(tag.AsString())
+		case errorTagKey:
+		case otelStatusTagKey:
+			// an error of the span wins over an OK status
+			if tag.AsString() == "OK" && !hasError {
+				otlp.Status.Code = otlpStatusCodeOK
+			}
+		case otelStatusDescriptionKey:
+			otlp.Status.Message = tag.AsString()
+		case otelLibraryNameKey:
+			scope = tag.AsString()
+		default:
+			attributes = append(attributes, tag)
+		}
+	}
+	otlp.Attributes = toOTLPAttributes(attributes)
+
+	for _, log := range span.Logs {
+		event := otlpEvent{TimeUnixNano: strconv.FormatInt(log.Timestamp.UnixNano(), 10)}
+		fields := make([]model.KeyValue, 0, len(log.Fields))
+		for _, field := range log.Fields {
+			if field.Key == logEventFieldKey && len(event.Name) == 0 {
+				event.Name = field.AsString()
+				continue
+			}
+			fields = append(fields, field)
+		}
+		event.Attributes = toOTLPAttributes(fields)
+		otlp.Events = append(otlp.Events, event)
+	}
+	return otlp, scope
+}
+
+func toOTLPSpanKind(kind string) int {
+	switch kind {
+	case "server":
+		return otlpSpanKindServer
+	case "client":
+		return otlpSpanKindClient
+	case "producer":
+		return otlpSpanKindProducer
+	case "consumer":
+		return otlpSpanKindConsumer
+	}
+	return otlpSpanKindInternal
+}
+
+func toOTLPAttributes(tags []model.KeyValue) []otlpKeyValue {
+	if len(tags) == 0 {
+		return nil
+	}
+	ret := make([]otlpKeyValue, 0, len(tags))
+	for _, tag := range tags {
+		var value otlpAnyValue
+		switch tag.VType {
+		case model.ValueType_BOOL:
+			b := tag.VBool
+			value.BoolValue = &b
+		case model.ValueType_INT64:
+			i := strconv.FormatInt(tag.VInt64, 10)
+			value.IntValue = &i
+		case model.ValueType_FLOAT64:
+			f := tag.VFloat64
+			value.DoubleValue = &f
+		case model.ValueType_BINARY:
+			b := base64.StdEncoding.EncodeToString(tag.VBinary)
+			value.BytesValue = &b
+		default:
+			s := tag.VStr
+			value.StringValue = &s
+		}
+		ret = append(ret, otlpKeyValue{Key: tag.Key, Value: value})
+	}
+	return ret
+}
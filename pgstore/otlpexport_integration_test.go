@@ -0,0 +1,61 @@
+//go:build integration
+// +build integration
+
+package pgstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"sort"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+func TestExportTraces(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	start := time.Now().Add(-time.Minute)
+	first, second := model.TraceID{Low: 1}, model.TraceID{Low: 2}
+	child := testSpan(first, 2, "backend", "query", start)
+	child.References = []model.SpanRef{model.NewChildOfRef(first, 1)}
+	writeTestSpans(t, writer, testSpan(first, 1, "frontend", "GET /", start), child, testSpan(second, 3, "frontend", "GET /", start))
+
+	var out bytes.Buffer
+	err := reader.ExportTraces(context.Background(), &spanstore.TraceQueryParameters{ServiceName: "frontend", NumTraces: 10,
+		StartTimeMin: start.Add(-time.Minute), StartTimeMax: start.Add(time.Minute)}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spans := make(map[string]int)
+	decoder := json.NewDecoder(&out)
+	for decoder.More() {
+		var data parsedTraces
+		if err := decoder.Decode(&data); err != nil {
+			t.Fatal(err)
+		}
+		for _, resource := range data.ResourceSpans {
+			for _, scope := range resource.ScopeSpans {
+				for _, span := range scope.Spans {
+					spans[span.TraceID]++
+				}
+			}
+		}
+	}
+	var counts []int
+	for _, count := range spans {
+		counts = append(counts, count)
+	}
+	sort.Ints(counts)
+	if len(counts) != 2 || counts[0] != 1 || counts[1] != 2 {
+		t.Errorf("exported spans per trace %v, want a trace of 1 and one of 2", spans)
+	}
+}
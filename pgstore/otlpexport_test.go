@@ -0,0 +1,162 @@
+package pgstore
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// parsedTraces is an OTLP/JSON TracesData as read by a consumer of the export
+type parsedTraces struct {
+	ResourceSpans []struct {
+		Resource struct {
+			Attributes []parsedKeyValue `json:"attributes"`
+		} `json:"resource"`
+		ScopeSpans []struct {
+			Scope struct {
+				Name string `json:"name"`
+			} `json:"scope"`
+			Spans []struct {
+				TraceID           string           `json:"traceId"`
+				SpanID            string           `json:"spanId"`
+				ParentSpanID      string           `json:"parentSpanId"`
+				Name              string           `json:"name"`
+				Kind              int              `json:"kind"`
+				StartTimeUnixNano string           `json:"startTimeUnixNano"`
+				EndTimeUnixNano   string           `json:"endTimeUnixNano"`
+				Attributes        []parsedKeyValue `json:"attributes"`
+				Events            []struct {
+					Name       string           `json:"name"`
+					Attributes []parsedKeyValue `json:"attributes"`
+				} `json:"events"`
+				Links []struct {
+					TraceID string `json:"traceId"`
+					SpanID  string `json:"spanId"`
+				} `json:"links"`
+				Status struct {
+					Code int `json:"code"`
+				} `json:"status"`
+			} `json:"spans"`
+		} `json:"scopeSpans"`
+	} `json:"resourceSpans"`
+}
+
+type parsedKeyValue struct {
+	Key   string                 `json:"key"`
+	Value map[string]interface{} `json:"value"`
+}
+
+func TestOTLPTracesParseBack(t *testing.T) {
+	start := time.Unix(1583064000, 0)
+	frontend := model.NewProcess("frontend", []model.KeyValue{model.String("hostname", "host-1")})
+	backend := model.NewProcess("backend", nil)
+	checkout := model.TraceID{High: 1, Low: 2}
+	traces := []*model.Trace{
+		{Spans: []*model.Span{
+			{TraceID: checkout, SpanID: 1, OperationName: "GET /checkout", StartTime: start, Duration: time.Second, Process: frontend,
+				Tags: []model.KeyValue{model.String("span.kind", "server"), model.Int64("http.status_code", 500), model.Bool("error", true)}},
+			{TraceID: checkout, SpanID: 2, OperationName: "charge", StartTime: start, Duration: time.Millisecond, Process: backend,
+				References: []model.SpanRef{model.NewChildOfRef(checkout, 1), model.NewFollowsFromRef(model.TraceID{Low: 9}, 3)},
+				Tags:       []model.KeyValue{model.String("otel.library.name", "payments")},
+				Logs:       []model.Log{{Timestamp: start, Fields: []model.KeyValue{model.String("event", "retry"), model.Float64("backoff", 0.5)}}}},
+		}},
+		{Spans: []*model.Span{
+			{TraceID: model.TraceID{Low: 3}, SpanID: 4, OperationName: "GET /", StartTime: start, Process: frontend},
+		}},
+	}
+
+	// one TracesData per line as ExportTraces writes them
+	var out bytes.Buffer
+	encoder := json.NewEncoder(&out)
+	for _, trace := range traces {
+		if err := encoder.Encode(toOTLPTraces(trace)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	decoder := json.NewDecoder(&out)
+	var parsed []parsedTraces
+	for decoder.More() {
+		var data parsedTraces
+		if err := decoder.Decode(&data); err != nil {
+			t.Fatal(err)
+		}
+		parsed = append(parsed, data)
+	}
+	if len(parsed) != 2 {
+		t.Fatalf("parsed %d traces, want 2", len(parsed))
+	}
+	for i, data := range parsed {
+		spans := 0
+		for _, resource := range data.ResourceSpans {
+			for _, scope := range resource.ScopeSpans {
+				spans += len(scope.Spans)
+			}
+		}
+		if spans != len(traces[i].Spans) {
+			t.Errorf("trace %d parsed with %d spans, want %d", i, spans, len(traces[i].Spans))
+		}
+	}
+
+	resources := parsed[0].ResourceSpans
+	if len(resources) != 2 {
+		t.Fatalf("the checkout trace has %d resources, want frontend and backend", len(resources))
+	}
+	if attr := resources[0].Resource.Attributes; len(attr) != 2 || attr[0].Key != "service.name" || attr[0].Value["stringValue"] != "frontend" {
+		t.Errorf("frontend resource attributes = %v", attr)
+	}
+	root := resources[0].ScopeSpans[0].Spans[0]
+	if root.TraceID != "00000000000000010000000000000002" || root.SpanID != "0000000000000001" || root.ParentSpanID != "" {
+		t.Errorf("root ids = %s %s %s", root.TraceID, root.SpanID, root.ParentSpanID)
+	}
+	if root.Kind != otlpSpanKindServer || root.Status.Code != otlpStatusCodeError {
+		t.Errorf("root kind %d status %d, want server and error", root.Kind, root.Status.Code)
+	}
+	if root.StartTimeUnixNano != "1583064000000000000" || root.EndTimeUnixNano != "1583064001000000000" {
+		t.Errorf("root lasts %s to %s", root.StartTimeUnixNano, root.EndTimeUnixNano)
+	}
+	if len(root.Attributes) != 1 || root.Attributes[0].Key != "http.status_code" || root.Attributes[0].Value["intValue"] != "500" {
+		t.Errorf("root attributes = %v, want the status code as an int string", root.Attributes)
+	}
+
+	scope := resources[1].ScopeSpans[0]
+	child := scope.Spans[0]
+	if scope.Scope.Name != "payments" || child.ParentSpanID != "0000000000000001" || child.Kind != otlpSpanKindInternal {
+		t.Errorf("child of scope %q has parent %q and kind %d", scope.Scope.Name, child.ParentSpanID, child.Kind)
+	}
+	if len(child.Links) != 1 || child.Links[0].TraceID != "00000000000000000000000000000009" || child.Links[0].SpanID != "0000000000000003" {
+		t.Errorf("child links = %v, want the FOLLOWS_FROM reference only", child.Links)
+	}
+	if len(child.Events) != 1 || child.Events[0].Name != "retry" || len(child.Events[0].Attributes) != 1 ||
+		child.Events[0].Attributes[0].Value["doubleValue"] != 0.5 {
+		t.Errorf("child events = %v, want the retry with its backoff", child.Events)
+	}
+}
+
+func TestOTLPSpanStatus(t *testing.T) {
+	process := model.NewProcess("frontend", nil)
+	tests := []struct {
+		name string
+		tags []model.KeyValue
+		want int
+	}{
+		{name: "unset", want: 0},
+		{name: "ok", tags: []model.KeyValue{model.String("otel.status_code", "OK")}, want: otlpStatusCodeOK},
+		{name: "error tag", tags: []model.KeyValue{model.Bool("error", true)}, want: otlpStatusCodeError},
+		{name: "error status", tags: []model.KeyValue{model.String("otel.status_code", "ERROR")}, want: otlpStatusCodeError},
+		{name: "error tag wins over ok", tags: []model.KeyValue{model.Bool("error", true), model.String("otel.status_code", "OK")},
+			want: otlpStatusCodeError},
+		{name: "ok before the error tag", tags: []model.KeyValue{model.String("otel.status_code", "OK"), model.Bool("error", true)},
+			want: otlpStatusCodeError},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			span := &model.Span{TraceID: model.TraceID{Low: 1}, SpanID: 1, Process: process, Tags: tt.tags}
+			if otlp, _ := toOTLPSpan(span); otlp.Status.Code != tt.want {
+				t.Errorf("status code = %d, want %d", otlp.Status.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,149 @@
+package pgstore
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-pg/pg/v9"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// findTraceIDsQuery is the statement behind findTraceIDs, %WHERE% is replaced
+// by the predicates of the search
+const findTraceIDsQuery = `SELECT trace_id_low AS low, trace_id_high AS high FROM spans AS span%WHERE%
+GROUP BY trace_id_low, trace_id_high
+ORDER BY ` + traceIDsOrder + `
+LIMIT ? OFFSET ?`
+
+// stmtCache holds the prepared statements of the trace searches keyed by
+// their SQL, i.e. by the shape of the where clause. The predicates never
+// expand lists into the SQL so the number of shapes stays small.
+//
+// go-pg binds a prepared statement to the one connection it was prepared on
+// and a statement serves one query at a time, so the cache keeps the idle
+// statements of each shape and concurrent searches of the same shape prepare
+// their own. Every idle statement holds a connection out of the pool, at most
+// half the pool is kept idle.
+type stmtCache struct {
+	mu    sync.Mutex
+	idle  map[string][]*pg.Stmt
+	count int
+}
+
+// acquire returns an idle statement prepared for query on db, or prepares a
+// new one when all are in use, cached tells which
+func (c *stmtCache) acquire(db *pg.DB, query string) (stmt *pg.Stmt, cached bool, err error) {
+	c.mu.Lock()
+	if stmts := c.idle[query]; len(stmts) > 0 {
+		stmt = stmts[len(stmts)-1]
+		c.idle[query] = stmts[:len(stmts)-1]
+		c.count--
+		c.mu.Unlock()
+		return stmt, true, nil
+	}
+	c.mu.Unlock()
+	stmt, err = db.Prepare(query)
+	return stmt, false, err
+}
+
+// release hands back a statement acquired for query once its query returned
+// err. A statement whose connection went bad with err is closed rather than
+// kept, the next search prepares a new one on a healthy connection.
+func (c *stmtCache) release(db *pg.DB, query string, stmt *pg.Stmt, err error) {
+	if !brokenStmt(err) {
+		c.mu.Lock()
+		if c.count < maxIdleStmts(db) {
+			if c.idle == nil {
+				c.idle = make(map[string][]*pg.Stmt)
+			}
+			c.idle[query] = append(c.idle[query], stmt)
+			c.count++
+			c.mu.Unlock()
+			return
+		}
+		c.mu.Unlock()
+	}
+	_ = stmt.Close()
+}
+
+// maxIdleStmts is the number of statements kept idle for db, half its pool
+func maxIdleStmts(db *pg.DB) int {
+	if n := db.Options().PoolSize / 2; n > 1 {
+		return n
+	}
+	return 1
+}
+
+// brokenStmt tells whether err left the connection of a statement unusable.
+// Like go-pg, which drops the connection then, it trusts the connection only
+// after errors the server reported about the query itself.
+func brokenStmt(err error) bool {
+	if err == nil {
+		return false
+	}
+	var pgErr pg.Error
+	return !errors.As(err, &pgErr) || pgErr.Field('S') == "FATAL"
+}
+
+// Close closes all the idle prepared statements
+func (c *stmtCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	for query, stmts := range c.idle {
+		for _, stmt := range stmts {
+			if err1 := stmt.Close(); err1 != nil && err == nil {
+				err = err1
+			}
+		}
+		delete(c.idle, query)
+	}
+	c.count = 0
+	return err
+}
+
+// findTraceIDsPrepared runs the search of findTraceIDs through a prepared statement
+func (r *Reader) findTraceIDsPrepared(ctx context.Context, builder *whereBuilder, offset int, limit int) ([]model.TraceID, error) {
+	where := ""
+	if len(builder.where) > 0 {
+		where = " WHERE " + builder.where
+	}
+	query := toPositionalParams(strings.Replace(findTraceIDsQuery, "%WHERE%", where, 1))
+	params := append(append([]interface{}{}, builder.params...), limit, offset)
+	for {
+		stmt, cached, err := r.stmts.acquire(r.replica, query)
+		if err != nil {
+			return nil, err
+		}
+		var ret []model.TraceID
+		_, err = stmt.QueryContext(ctx, &ret, params...)
+		r.stmts.release(r.replica, query, stmt, err)
+		// an idle statement may have lost its connection since its last
+		// search, e.g. to a restart of the server, the search is retried on
+		// the next one until a statement prepared anew answers
+		if !cached || !brokenStmt(err) || ctx.Err() != nil {
+			return ret, err
+		}
+	}
+}
+
+// toPositionalParams numbers the ? placeholders of go-pg as $1, $2... which
+// is what PostgreSQL expects from a prepared statement
+func toPositionalParams(query string) string {
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteByte('$')
+			b.WriteString(strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
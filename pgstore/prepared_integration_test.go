@@ -0,0 +1,70 @@
+//go:build integration
+// +build integration
+
+package pgstore
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+func TestPreparedSearchSurvivesLostConnection(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger(), WithConfiguration(&Configuration{PrepareSearches: true}))
+	defer reader.Close()
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	writeTestSpans(t, NewWriter(db, hclog.NewNullLogger()), testSpan(model.TraceID{Low: 1}, 1, "frontend", "GET /", start))
+
+	query := spanstore.TraceQueryParameters{ServiceName: "frontend", StartTimeMin: start.Add(-time.Minute), StartTimeMax: start.Add(time.Minute)}
+	if got := findTraceIDs(t, reader, &query); !reflect.DeepEqual(got, []uint64{1}) {
+		t.Fatalf("found traces %v, want 1", got)
+	}
+	// kill the connection the cached statement was prepared on
+	if _, err := db.Exec(`SELECT pg_terminate_backend(pid) FROM pg_stat_activity
+WHERE datname = current_database() AND pid <> pg_backend_pid()`); err != nil {
+		t.Fatal(err)
+	}
+	if got := findTraceIDs(t, reader, &query); !reflect.DeepEqual(got, []uint64{1}) {
+		t.Errorf("found traces %v after losing the connection, want 1", got)
+	}
+}
+
+// BenchmarkFindTraceIDs runs the same search with and without a prepared
+// statement, the numbers of the request come from -benchtime 10000x
+func BenchmarkFindTraceIDs(b *testing.B) {
+	db, done := newTestDB(b)
+	defer done()
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	writer := NewWriter(db, hclog.NewNullLogger())
+	for i := 1; i <= 100; i++ {
+		span := testSpan(model.TraceID{Low: uint64(i)}, model.SpanID(i), "frontend", "GET /", start.Add(time.Duration(i)*time.Millisecond))
+		span.Tags = []model.KeyValue{model.String("http.method", "GET")}
+		writeTestSpans(b, writer, span)
+	}
+	query := &spanstore.TraceQueryParameters{ServiceName: "frontend", OperationName: "GET /", NumTraces: 20,
+		Tags: map[string]string{"http.method": "GET"}, StartTimeMin: start.Add(-time.Minute), StartTimeMax: start.Add(time.Minute)}
+
+	for _, prepared := range []bool{false, true} {
+		name := "Unprepared"
+		if prepared {
+			name = "Prepared"
+		}
+		b.Run(name, func(b *testing.B) {
+			reader := NewReader(db, hclog.NewNullLogger(), WithConfiguration(&Configuration{PrepareSearches: prepared}))
+			defer reader.Close()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := reader.FindTraceIDs(context.Background(), query); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
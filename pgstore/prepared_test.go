@@ -0,0 +1,58 @@
+package pgstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/go-pg/pg/v9"
+)
+
+// testPGError is an error reported by the server
+type testPGError map[byte]string
+
+func (e testPGError) Field(k byte) string      { return e[k] }
+func (e testPGError) IntegrityViolation() bool { return false }
+func (e testPGError) Error() string            { return e['M'] }
+
+var _ pg.Error = testPGError(nil)
+
+func TestBrokenStmt(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{nil, false},
+		{testPGError{'S': "ERROR", 'C': "22P02", 'M': "invalid input syntax"}, false},
+		{fmt.Errorf("search: %w", testPGError{'S': "ERROR", 'C': "57014", 'M': "canceling statement"}), false},
+		{testPGError{'S': "FATAL", 'C': "57P01", 'M': "terminating connection"}, true},
+		{io.EOF, true},
+		{&net.OpError{Op: "read", Err: errors.New("connection reset by peer")}, true},
+		{context.DeadlineExceeded, true},
+	}
+	for _, tt := range tests {
+		if got := brokenStmt(tt.err); got != tt.want {
+			t.Errorf("brokenStmt(%v) = %v, want %v", tt.err, got, tt.want)
+		}
+	}
+}
+
+func TestToPositionalParams(t *testing.T) {
+	got := toPositionalParams("a = ? AND b IN (?) LIMIT ? OFFSET ?")
+	if want := "a = $1 AND b IN ($2) LIMIT $3 OFFSET $4"; got != want {
+		t.Errorf("toPositionalParams() = %q, want %q", got, want)
+	}
+}
+
+func TestMaxIdleStmts(t *testing.T) {
+	for poolSize, want := range map[int]int{1: 1, 3: 1, 10: 5} {
+		db := pg.Connect(&pg.Options{Addr: "127.0.0.1:1", PoolSize: poolSize})
+		if got := maxIdleStmts(db); got != want {
+			t.Errorf("maxIdleStmts() with a pool of %d = %d, want %d", poolSize, got, want)
+		}
+		db.Close()
+	}
+}
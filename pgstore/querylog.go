@@ -0,0 +1,54 @@
+package pgstore
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+// maxLoggedQueryLen cuts the statements logged with Configuration.LogQueries,
+// the inserted tags and logs can be large and carry anything the traced
+// services recorded
+const maxLoggedQueryLen = 1024
+
+// queryLogHook logs every statement at debug level, used with
+// Configuration.LogQueries
+type queryLogHook struct {
+	logger hclog.Logger
+}
+
+var _ pg.QueryHook = queryLogHook{}
+
+// logQueries hooks db with a queryLogHook when the configuration asks for it
+func (c *Configuration) logQueries(db *pg.DB, logger hclog.Logger) {
+	if c.LogQueries {
+		db.AddQueryHook(queryLogHook{logger: logger})
+	}
+}
+
+func (h queryLogHook) BeforeQuery(ctx context.Context, _ *pg.QueryEvent) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h queryLogHook) AfterQuery(_ context.Context, event *pg.QueryEvent) error {
+	if !h.logger.IsDebug() {
+		return nil
+	}
+	query, err := event.FormattedQuery()
+	if err != nil {
+		query, _ = event.UnformattedQuery()
+	}
+	if len(query) > maxLoggedQueryLen {
+		query = query[:maxLoggedQueryLen] + "..."
+	}
+	args := []interface{}{"query", query, "duration", time.Since(event.StartTime)}
+	if event.Err != nil {
+		args = append(args, "err", event.Err)
+	} else if event.Result != nil {
+		args = append(args, "rows", event.Result.RowsReturned(), "affected", event.Result.RowsAffected())
+	}
+	h.logger.Debug("Query", args...)
+	return nil
+}
@@ -0,0 +1,76 @@
+package pgstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+// newBufferLogger returns a JSON logger at level writing into the buffer
+func newBufferLogger(level hclog.Level) (hclog.Logger, *bytes.Buffer) {
+	var out bytes.Buffer
+	return hclog.New(&hclog.LoggerOptions{Output: &out, Level: level, JSONFormat: true}), &out
+}
+
+func TestQueryLogHook(t *testing.T) {
+	db := pg.Connect(&pg.Options{Addr: "127.0.0.1:1"})
+	defer db.Close()
+	logger, out := newBufferLogger(hclog.Debug)
+	hook := queryLogHook{logger: logger}
+
+	event := &pg.QueryEvent{DB: db, StartTime: time.Now(), Query: "SELECT * FROM spans WHERE id = ?", Params: []interface{}{42},
+		Err: errors.New("boom")}
+	if err := hook.AfterQuery(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	var line map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &line); err != nil {
+		t.Fatalf("logged %q: %v", out, err)
+	}
+	if line["@message"] != "Query" || line["query"] != "SELECT * FROM spans WHERE id = 42" || line["err"] != "boom" {
+		t.Errorf("logged %v, want the formatted query and its error", line)
+	}
+
+	// long statements are cut
+	out.Reset()
+	event = &pg.QueryEvent{DB: db, StartTime: time.Now(), Query: "SELECT '" + strings.Repeat("x", 2*maxLoggedQueryLen) + "'"}
+	if err := hook.AfterQuery(context.Background(), event); err != nil {
+		t.Fatal(err)
+	}
+	line = nil
+	if err := json.Unmarshal(out.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	if query, _ := line["query"].(string); len(query) != maxLoggedQueryLen+len("...") || !strings.HasSuffix(query, "...") {
+		t.Errorf("logged a query of %d bytes, want it cut at %d", len(query), maxLoggedQueryLen)
+	}
+
+	// nothing above debug
+	logger, out = newBufferLogger(hclog.Info)
+	if err := (queryLogHook{logger: logger}).AfterQuery(context.Background(), event); err != nil || out.Len() > 0 {
+		t.Errorf("logged %q at info level, want nothing", out)
+	}
+}
+
+func TestLogQueries(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		// the refused connection is logged as the error of the query
+		db := pg.Connect(&pg.Options{Addr: "127.0.0.1:1"})
+		logger, out := newBufferLogger(hclog.Debug)
+		(&Configuration{LogQueries: enabled}).logQueries(db, logger)
+		if _, err := db.Exec("SELECT 1"); err == nil {
+			t.Fatal("SELECT 1 reached no server")
+		}
+		db.Close()
+		if logged := strings.Contains(out.String(), `"query":"SELECT 1"`); logged != enabled {
+			t.Errorf("LogQueries %v logged %q", enabled, out)
+		}
+	}
+}
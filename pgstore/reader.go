@@ -2,208 +2,1363 @@ package pgstore
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-pg/pg/v9"
+	"github.com/go-pg/pg/v9/orm"
 
 	hclog "github.com/hashicorp/go-hclog"
+	"github.com/opentracing/opentracing-go"
+	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/jaegertracing/jaeger/model"
 	"github.com/jaegertracing/jaeger/storage/spanstore"
 )
 
-var _ spanstore.Reader = (*Reader)(nil)
+var (
+	_ spanstore.Reader = (*Reader)(nil)
+	_ io.Closer        = (*Reader)(nil)
+)
 
 // Reader can query for and load traces from PostgreSQL v2.x.
 type Reader struct {
 	db *pg.DB
+	// serves searches, services, operations and dependencies, it is db
+	// itself unless a read replica is configured
+	replica *pg.DB
+
+	logger  hclog.Logger
+	metrics *readerMetrics
+	tracer  opentracing.Tracer
+
+	conf Configuration
 
-	logger hclog.Logger
+	// set when the Reader opened the connections itself and has to close them
+	ownsDB bool
+	// set once db and replica are handles of the Reader's own, see ownHandles
+	hooked bool
+
+	// prepared trace searches, used with Configuration.PrepareSearches
+	stmts stmtCache
+	// EXPLAINs of the slow queries, used with Configuration.ExplainSlowQueries
+	explainer *explainer
+	// computed dependencies, used with Configuration.DependencyCacheTTL
+	dependencies dependencyCache
+}
+
+// ReaderOption customizes a Reader built by NewReader
+type ReaderOption func(*Reader)
+
+// WithConfiguration applies the query settings of the configuration to the Reader
+func WithConfiguration(conf *Configuration) ReaderOption {
+	return func(r *Reader) {
+		r.conf = *conf
+	}
 }
 
 // NewReader returns a new SpanReader for PostgreSQL v2.x.
-func NewReader(db *pg.DB, logger hclog.Logger) *Reader {
-	return &Reader{
-		db:     db,
-		logger: logger,
+func NewReader(db *pg.DB, logger hclog.Logger, opts ...ReaderOption) *Reader {
+	return NewReaderWithReplica(db, db, logger, opts...)
+}
+
+// NewReaderWithReplica returns a new SpanReader which loads traces by id from
+// db and sends every other query to the read-only replica
+func NewReaderWithReplica(db *pg.DB, replica *pg.DB, logger hclog.Logger, opts ...ReaderOption) *Reader {
+	r := &Reader{
+		db:      db,
+		replica: replica,
+		logger:  logger,
+		tracer:  opentracing.NoopTracer{},
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	if r.conf.ExplainSlowQueries {
+		r.addSlowQueryHook()
+	}
+	return r
+}
+
+// readerHandleParam is the query parameter telling apart the handles of a
+// Reader, go-pg only copies a DB along with a parameter
+const readerHandleParam = "pgstore_reader"
+
+// ownHandles replaces db and the replica with handles of the Reader's own on
+// the same pools before it adds a query hook. The hooks of the handles given
+// by the caller would run for every Reader and the Writer sharing them, the
+// hooks the caller added so far are kept.
+func (r *Reader) ownHandles() {
+	if r.hooked {
+		return
+	}
+	r.hooked = true
+	db := r.db.WithParam(readerHandleParam, true)
+	if r.replica != r.db {
+		r.replica = r.replica.WithParam(readerHandleParam, true)
+	} else {
+		r.replica = db
+	}
+	r.db = db
+}
+
+// NewReaderWithMetrics returns a new SpanReader recording call metrics into registerer
+func NewReaderWithMetrics(db *pg.DB, logger hclog.Logger, registerer prometheus.Registerer, opts ...ReaderOption) (*Reader, error) {
+	metrics, err := newReaderMetrics(registerer)
+	if err != nil {
+		return nil, err
+	}
+	r := NewReader(db, logger, opts...)
+	r.metrics = metrics
+	r.addRowsHook()
+	return r, nil
+}
+
+// NewReaderFromConfig returns a new SpanReader connected with the pool options of the configuration
+func NewReaderFromConfig(conf *Configuration, logger hclog.Logger, opts ...ReaderOption) (*Reader, error) {
+	pgOpts, err := conf.pgOptions()
+	if err != nil {
+		return nil, err
+	}
+	replicaOpts, err := conf.replicaPgOptions()
+	if err != nil {
+		return nil, err
+	}
+	db := pg.Connect(pgOpts)
+	conf.logQueries(db, logger)
+	if err := conf.waitForDB(context.Background(), db, logger); err != nil {
+		db.Close()
+		return nil, err
+	}
+	replica := db
+	if replicaOpts != nil {
+		replica = pg.Connect(replicaOpts)
+		conf.logQueries(replica, logger)
+	}
+	opts = append([]ReaderOption{WithConfiguration(conf)}, opts...)
+	r := NewReaderWithReplica(db, replica, logger, opts...)
+	r.ownsDB = true
+	return r, nil
+}
+
+// Close stops the EXPLAIN of slow queries and closes the prepared statements
+// and the connection pools opened by NewReaderFromConfig, the db handed to the
+// other constructors stays open as it belongs to the caller
+func (r *Reader) Close() error {
+	if r.explainer != nil {
+		r.explainer.Close()
+	}
+	err := r.stmts.Close()
+	if !r.ownsDB {
+		return err
+	}
+	if r.replica != r.db {
+		err = r.replica.Close()
+	}
+	if err1 := r.db.Close(); err1 != nil {
+		return err1
+	}
+	return err
+}
+
+// wrapError annotates err with the Reader operation that failed, a nil error
+// stays nil
+func wrapError(err error, operation string, args ...interface{}) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("pgstore: %s: %w", fmt.Sprintf(operation, args...), err)
+}
+
+// withQueryTimeout bounds a Reader call by the configured QueryTimeout, an
+// earlier deadline of the caller still applies
+func (r *Reader) withQueryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if r.conf.QueryTimeout <= 0 {
+		return context.WithCancel(ctx)
 	}
+	return context.WithTimeout(ctx, r.conf.QueryTimeout)
 }
 
-// GetServices returns all services traced by Jaeger
-func (r *Reader) GetServices(ctx context.Context) ([]string, error) {
+// pingTimeout bounds Ping independently of QueryTimeout, a readiness probe
+// has to answer fast
+const pingTimeout = 2 * time.Second
+
+// Ping checks that the database answers a trivial query
+func (r *Reader) Ping(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, pingTimeout)
+	defer cancel()
+	if _, err := r.db.ExecContext(ctx, "SELECT 1"); err != nil {
+		return fmt.Errorf("pgstore: database unreachable: %w", err)
+	}
+	return nil
+}
+
+// GetServices returns all services traced by Jaeger, only those with spans
+// started within Configuration.ServiceLookback if set
+func (r *Reader) GetServices(ctx context.Context) (ret []string, err error) {
+	defer r.metrics.observe("GetServices", time.Now(), &err)
+	ospan, ctx := r.startSpan(ctx, "GetServices")
+	defer finishSpan(ospan, &err)
+	ctx, cancel := r.withQueryTimeout(ctx)
+	defer cancel()
 
 	var services []Service
-	err := r.db.Model(&services).Order("service_name ASC").Select()
-	ret := make([]string, 0, len(services))
+	var aliases map[string]string
+	query := whereHasSpans(ctx, r.replica.ModelContext(ctx, &services), "span.service_id = service.id", r.conf.ServiceLookback)
+	r.logEmptyNames("GetServices", query, "service.service_name")
+	query = query.Where("service.service_name <> ''")
+	if r.conf.ServiceOrder == ServiceOrderRecent {
+		if tenant := TenantFromContext(ctx); len(tenant) > 0 {
+			query = query.OrderExpr("(SELECT max(span.start_time) FROM spans AS span WHERE span.service_id = service.id AND span.tenant_id = ?) DESC NULLS LAST", tenant)
+		} else {
+			query = query.OrderExpr("(SELECT max(span.start_time) FROM spans AS span WHERE span.service_id = service.id) DESC NULLS LAST")
+		}
+	}
+	query = query.Order("service_name ASC")
+	err = r.retry(ctx, func() (err error) {
+		services = nil
+		if aliases, err = r.serviceAliases(ctx); err != nil {
+			return err
+		}
+		return query.Select()
+	})
+	ret = make([]string, 0, len(services))
 
 	for _, service := range services {
-		if len(service.ServiceName) > 0 {
-			ret = append(ret, service.ServiceName)
-		}
+		ret = append(ret, service.ServiceName)
 	}
+	ret = canonicalServiceNames(ret, aliases, r.conf.ServiceOrder != ServiceOrderRecent)
+	ospan.SetTag("result_count", len(ret))
 
-	return ret, err
+	return ret, wrapError(err, "GetServices")
 }
 
-// GetOperations returns all operations for a specific service traced by Jaeger
-func (r *Reader) GetOperations(ctx context.Context, param spanstore.OperationQueryParameters) ([]spanstore.Operation, error) {
+// GetOperations returns the distinct operations of a service traced by Jaeger,
+// of all services without one, sorted by name and kind
+func (r *Reader) GetOperations(ctx context.Context, param spanstore.OperationQueryParameters) (ret []spanstore.Operation, err error) {
+	defer r.metrics.observe("GetOperations", time.Now(), &err)
+	ospan, ctx := r.startSpan(ctx, "GetOperations")
+	defer finishSpan(ospan, &err)
+	ctx, cancel := r.withQueryTimeout(ctx)
+	defer cancel()
+	ospan.SetTag("service_name", param.ServiceName)
 
+	// an operation of several services, or of all of them when no service is
+	// given, is listed once per kind
 	var operations []Operation
-	err := r.db.Model(&operations).Order("operation_name ASC").Select()
-	ret := make([]spanstore.Operation, 0, len(operations))
-	for _, operation := range operations {
-		if len(operation.OperationName) > 0 {
-			ret = append(ret, spanstore.Operation{Name: operation.OperationName})
+	err = r.retry(ctx, func() error {
+		operations = nil
+		query := r.replica.ModelContext(ctx, &operations)
+		if len(param.ServiceName) > 0 {
+			aliases, err := r.serviceAliases(ctx)
+			if err != nil {
+				return err
+			}
+			query = query.Join("JOIN services AS service ON service.id = operation.service_id").
+				Where("service.service_name IN (?)", pg.In(withServiceAliases([]string{param.ServiceName}, aliases)))
+		}
+		if len(param.SpanKind) > 0 {
+			query = query.Where("operation.span_kind = ?", param.SpanKind)
 		}
+		query = whereHasSpans(ctx, query, "span.operation_id = operation.id", 0)
+		r.logEmptyNames("GetOperations", query, "operation.operation_name")
+		return query.Where("operation.operation_name <> ''").
+			ColumnExpr("DISTINCT operation.operation_name, operation.span_kind").
+			Order("operation.operation_name ASC", "operation.span_kind ASC").Select()
+	})
+	ret = make([]spanstore.Operation, 0, len(operations))
+	for _, operation := range operations {
+		ret = append(ret, spanstore.Operation{Name: operation.OperationName, SpanKind: operation.SpanKind})
 	}
+	ospan.SetTag("result_count", len(ret))
 
-	return ret, err
+	return ret, wrapError(err, "GetOperations")
 }
 
-// GetTrace takes a traceID and returns a Trace associated with that traceID
-func (r *Reader) GetTrace(ctx context.Context, traceID model.TraceID) (*model.Trace, error) {
-
-	builder := &whereBuilder{where: "", params: make([]interface{}, 0)}
+// whereHasSpans restricts a query on services or operations to the rows with
+// a span pointing at them through the join condition, a span of the tenant of
+// ctx started within lookback. The query is left as is without either.
+func whereHasSpans(ctx context.Context, query *orm.Query, join string, lookback time.Duration) *orm.Query {
+	tenant := TenantFromContext(ctx)
+	if lookback <= 0 && len(tenant) == 0 {
+		return query
+	}
+	where := "EXISTS (SELECT 1 FROM spans AS span WHERE " + join
+	var params []interface{}
+	if lookback > 0 {
+		where += " AND span.start_time >= ?"
+		params = append(params, time.Now().Add(-lookback))
+	}
+	if len(tenant) > 0 {
+		where += " AND span.tenant_id = ?"
+		params = append(params, tenant)
+	}
+	return query.Where(where+")", params...)
+}
 
-	if traceID.Low > 0 {
-		builder.andWhere(traceID.Low, "trace_id_low = ?")
+// logEmptyNames logs at debug level how many rows of the query have an empty
+// or NULL name column, they are left out of the listings as the UI can't
+// select them
+func (r *Reader) logEmptyNames(method string, query *orm.Query, column string) {
+	if !r.logger.IsDebug() {
+		return
 	}
-	if traceID.High > 0 {
-		builder.andWhere(traceID.High, "trace_id_high = ?")
+	count, err := query.Clone().Where("coalesce(" + column + ", '') = ''").Count()
+	if err != nil {
+		r.logger.Debug("Counting empty names failed", "method", method, "error", err)
+		return
+	}
+	if count > 0 {
+		r.logger.Debug("Skipped rows with an empty name", "method", method, "column", column, "count", count)
 	}
+}
+
+// GetTrace takes a traceID and returns a Trace associated with that traceID,
+// spanstore.ErrTraceNotFound is returned when no span of the trace is stored
+func (r *Reader) GetTrace(ctx context.Context, traceID model.TraceID) (trace *model.Trace, err error) {
+	defer r.metrics.observe("GetTrace", time.Now(), &err)
+	ospan, ctx := r.startSpan(ctx, "GetTrace")
+	defer finishSpan(ospan, &err)
+	ctx, cancel := r.withQueryTimeout(ctx)
+	defer cancel()
+	ospan.SetTag("trace_id", traceID.String())
 
 	var spans []Span
-	query := r.db.Model(&spans).Where(builder.where, builder.params...).Relation("Operation").Relation("Service").Relation("SpanRefs") //.Limit(1)
-	err := query.Select()
+	query := selectSpanColumns(r.db.ModelContext(ctx, &spans)).Where("trace_id_low = ? AND trace_id_high = ?", int64(traceID.Low), int64(traceID.High)).Relation("Operation").Relation("Service") //.Limit(1)
+	query = whereTenant(ctx, query)
+	err = r.retry(ctx, func() error {
+		spans = nil
+		if err := query.Select(); err != nil || len(spans) == 0 {
+			return err
+		}
+		return r.loadSpanDetails(ctx, r.db, spans)
+	})
+	if err == pg.ErrNoRows || (err == nil && len(spans) == 0) {
+		err = spanstore.ErrTraceNotFound
+	}
+	if err != nil {
+		return nil, wrapError(err, "GetTrace(%s)", traceID)
+	}
+	if r.conf.MaxSpansPerTrace > 0 && len(spans) > r.conf.MaxSpansPerTrace {
+		ospan.SetTag("truncated_from", len(spans))
+		spans = capSpans(spans, r.conf.MaxSpansPerTrace)
+	}
 	ret := make([]*model.Span, 0, len(spans))
-	ret2 := make([]model.Trace_ProcessMapping, 0, len(spans))
 	for _, span := range spans {
 		ret = append(ret, toModelSpan(span))
-		ret2 = append(ret2, model.Trace_ProcessMapping{
-			ProcessID: span.ProcessID,
-			Process: model.Process{
-				ServiceName: span.Service.ServiceName,
-				Tags:        mapToModelKV(span.ProcessTags),
-			},
-		})
 	}
 
-	trace := &model.Trace{Spans: ret, ProcessMap: ret2}
+	trace = &model.Trace{Spans: ret, ProcessMap: toModelProcessMap(spans)}
+	ospan.SetTag("result_count", len(ret))
 
-	return trace, err
+	return trace, nil
 }
 
-func buildTraceWhere(query *spanstore.TraceQueryParameters) *whereBuilder {
-	builder := &whereBuilder{where: "", params: make([]interface{}, 0)}
+// capSpans keeps max of the spans of a trace, the root spans first and then
+// the longest ones, in their original order. Like rootSpanPredicate, a root
+// references no span of its own trace. The first root kept, or the first span
+// without one, gets a warning telling about the truncation.
+func capSpans(spans []Span, max int) []Span {
+	isRoot := func(span Span) bool {
+		for _, ref := range span.SpanRefs {
+			if ref.TraceIDLow == span.TraceIDLow && ref.TraceIDHigh == span.TraceIDHigh {
+				return false
+			}
+		}
+		return true
+	}
+	order := make([]int, len(spans))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		si, sj := spans[order[i]], spans[order[j]]
+		if isRoot(si) != isRoot(sj) {
+			return isRoot(si)
+		}
+		return si.Duration > sj.Duration
+	})
+	kept := order[:max]
+	sort.Ints(kept)
 
-	if len(query.ServiceName) > 0 {
-		builder.andWhere(query.ServiceName, "service.service_name = ?")
+	ret := make([]Span, 0, max)
+	marker := -1
+	for _, i := range kept {
+		if marker < 0 && isRoot(spans[i]) {
+			marker = len(ret)
+		}
+		ret = append(ret, spans[i])
 	}
-	if len(query.OperationName) > 0 {
-		builder.andWhere(query.OperationName, "operation.operation_name = ?")
+	if marker < 0 {
+		marker = 0
 	}
-	if query.StartTimeMin.After(time.Time{}) {
-		builder.andWhere(query.StartTimeMin, "start_time >= ?")
+	warning := fmt.Sprintf("trace truncated, %d of its %d spans are shown", max, len(spans))
+	ret[marker].Warnings = append(append([]string{}, ret[marker].Warnings...), warning)
+	return ret
+}
+
+// loadSpanDetails attaches the references and logs recorded for each of the
+// spans, reading from the same db the spans came from
+func (r *Reader) loadSpanDetails(ctx context.Context, db *pg.DB, spans []Span) error {
+	if len(spans) == 0 {
+		return nil
 	}
-	if query.StartTimeMax.After(time.Time{}) {
-		//TODO builder.andWhere(query.StartTimeMax, "start_time < ?")
+	spanKeys := make([][]interface{}, 0, len(spans))
+	for _, span := range spans {
+		spanKeys = append(spanKeys, []interface{}{span.TraceIDLow, span.TraceIDHigh, span.ID, span.TenantID})
+	}
+
+	// span ids are only unique within their trace and tenant, the refs are
+	// found by the trace of the span holding them
+	var refs []*SpanRef
+	// in the order of model.Span.References, the older refs without an
+	// ordinal in the order they were inserted
+	if err := db.ModelContext(ctx, &refs).Where("(span_trace_id_low, span_trace_id_high, span_id, tenant_id) IN (?)", pg.In(spanKeys)).
+		Order("ordinal ASC", "id ASC").Select(); err != nil {
+		return err
+	}
+	refsBySpan := make(map[spanKey][]*SpanRef, len(spans))
+	for _, ref := range refs {
+		key := spanKey{TraceIDLow: ref.SpanTraceIDLow, TraceIDHigh: ref.SpanTraceIDHigh, ID: ref.SpanID, TenantID: ref.TenantID}
+		refsBySpan[key] = append(refsBySpan[key], ref)
+	}
+
+	var logs []*Log
+	if err := db.ModelContext(ctx, &logs).Where("(trace_id_low, trace_id_high, span_id, tenant_id) IN (?)", pg.In(spanKeys)).
+		Order("timestamp ASC", "id ASC").Select(); err != nil {
+		return err
+	}
+	logsBySpan := make(map[spanKey][]*Log, len(spans))
+	for _, log := range logs {
+		key := spanKey{TraceIDLow: log.TraceIDLow, TraceIDHigh: log.TraceIDHigh, ID: log.SpanID, TenantID: log.TenantID}
+		logsBySpan[key] = append(logsBySpan[key], log)
+	}
+
+	for i := range spans {
+		key := spanKey{TraceIDLow: spans[i].TraceIDLow, TraceIDHigh: spans[i].TraceIDHigh, ID: spans[i].ID, TenantID: spans[i].TenantID}
+		spans[i].SpanRefs = refsBySpan[key]
+		spans[i].Logs = logsBySpan[key]
+	}
+	return nil
+}
+
+// Boundary semantics of the search window: the time window is half-open
+// [StartTimeMin, StartTimeMax) while the duration window is closed
+// [DurationMin, DurationMax] compared in microseconds
+const (
+	startTimeMinPredicate = "start_time >= ?"
+	startTimeMaxPredicate = "start_time < ?"
+	durationMinPredicate  = "duration >= ?"
+	durationMaxPredicate  = "duration <= ?"
+)
+
+// rootSpanPredicate matches the spans which don't reference another span of
+// their trace
+const rootSpanPredicate = `NOT EXISTS (SELECT 1 FROM span_refs AS ref
+	WHERE ref.span_id = span.id AND ref.span_trace_id_low = span.trace_id_low AND ref.span_trace_id_high = span.trace_id_high
+	AND ref.trace_id_low = span.trace_id_low AND ref.trace_id_high = span.trace_id_high AND ref.tenant_id = span.tenant_id)`
+
+// traceSpanCount counts the spans of the trace of a span through the
+// idx_spans_trace_span_id index, for the bounds of TraceKindFilter
+const traceSpanCount = `(SELECT count(*) FROM spans AS trace_span
+	WHERE trace_span.trace_id_low = span.trace_id_low AND trace_span.trace_id_high = span.trace_id_high
+	AND trace_span.tenant_id = span.tenant_id)`
+
+// Prefixes restricting a searched tag to the span tags or to the process
+// tags, or making it a field of the span logs, e.g. log.event=cache_miss
+const (
+	spanTagPrefix    = "span."
+	processTagPrefix = "process."
+	logFieldPrefix   = "log."
+)
+
+// tagColumns are the columns holding the tags of a scope, as jsonb and hstore
+type tagColumns struct {
+	jsonb  string
+	hstore string
+}
+
+var (
+	spanTagColumns    = tagColumns{jsonb: "tags", hstore: "tags_hstore"}
+	processTagColumns = tagColumns{jsonb: "process_tags", hstore: "process_tags_hstore"}
+)
+
+// tagScope returns the columns a searched tag key is looked for in and the
+// keys to look for. A key prefixed with process. is looked for among the
+// process tags only and one prefixed with span. among the span tags only,
+// under the key with and without its prefix as tags like span.kind carry it
+// in their name. Other keys are looked for on the span itself and on its
+// process, e.g. a hostname which only the process carries.
+func tagScope(key string) ([]tagColumns, []string) {
+	switch {
+	case strings.HasPrefix(key, processTagPrefix):
+		return []tagColumns{processTagColumns}, []string{strings.TrimPrefix(key, processTagPrefix), key}
+	case strings.HasPrefix(key, spanTagPrefix):
+		return []tagColumns{spanTagColumns}, []string{strings.TrimPrefix(key, spanTagPrefix), key}
+	}
+	return []tagColumns{spanTagColumns, processTagColumns}, []string{key}
+}
+
+// tagPredicate matches a searched tag in the jsonb columns of its scope. It
+// tests containment so that the GIN indexes of the columns serve the search,
+// the value is looked for as a string and also as a bool or a number when it
+// reads as one.
+func tagPredicate(key string, value string) (string, []interface{}) {
+	values := searchedValues(value)
+	columns, keys := tagScope(key)
+	clauses := make([]string, 0, len(columns)*len(keys)*len(values))
+	params := make([]interface{}, 0, cap(clauses))
+	for _, column := range columns {
+		for _, k := range keys {
+			for _, v := range values {
+				doc, err := json.Marshal(map[string]interface{}{k: v})
+				if err != nil {
+					continue
+				}
+				clauses = append(clauses, column.jsonb+" @> ?::jsonb")
+				params = append(params, string(doc))
+			}
+		}
+	}
+	return "(" + strings.Join(clauses, " OR ") + ")", params
+}
+
+// searchedValues returns the JSON values a searched value stands for, the
+// string itself and the bool or number it reads as
+func searchedValues(value string) []interface{} {
+	values := []interface{}{value}
+	if value == "true" || value == "false" {
+		values = append(values, value == "true")
+	}
+	if number, err := strconv.ParseFloat(value, 64); err == nil {
+		values = append(values, number)
+	}
+	return values
+}
+
+// logFieldPredicate matches the spans aliased as table one of whose logs has
+// the field, with the value unless it is empty. The logs are looked up
+// through the GIN index of their fields.
+func logFieldPredicate(field string, value string, table string) (string, []interface{}) {
+	if len(value) == 0 {
+		return logsOf(table) + "fields -> ? IS NOT NULL)", []interface{}{field}
+	}
+	values := searchedValues(value)
+	clauses := make([]string, 0, len(values))
+	params := make([]interface{}, 0, len(values))
+	for _, v := range values {
+		doc, err := json.Marshal(map[string]interface{}{field: v})
+		if err != nil {
+			continue
+		}
+		clauses = append(clauses, "fields @> ?::jsonb")
+		params = append(params, string(doc))
+	}
+	return logsOf(table) + "(" + strings.Join(clauses, " OR ") + "))", params
+}
+
+// logsOf starts the predicate matching the spans aliased as table by their
+// logs, the caller appends the condition on the logs and the closing paren
+func logsOf(table string) string {
+	return "(" + table + ".trace_id_low, " + table + ".trace_id_high, " + table + ".id, " + table + ".tenant_id) IN (SELECT trace_id_low, trace_id_high, span_id, tenant_id FROM span_logs WHERE "
+}
+
+// buildTraceWhere builds the span predicates of the query, except for service
+// and operation names which are resolved by whereServiceAndOperation. Tags are
+// looked for in the columns of the tagStorage, and with hstore in the jsonb
+// ones too for the spans written before switching to it.
+func buildTraceWhere(query *spanstore.TraceQueryParameters, tagStorage string) *whereBuilder {
+	builder := &whereBuilder{where: "", params: make([]interface{}, 0)}
+
+	if !query.StartTimeMin.IsZero() {
+		builder.andWhere(query.StartTimeMin, startTimeMinPredicate)
+	}
+	if !query.StartTimeMax.IsZero() {
+		builder.andWhere(query.StartTimeMax, startTimeMaxPredicate)
 	}
 	if query.DurationMin > 0*time.Second {
-		builder.andWhere(query.DurationMin, "duration < ?")
+		builder.andWhere(toMicroseconds(query.DurationMin), durationMinPredicate)
 	}
 	if query.DurationMax > 0*time.Second {
-		builder.andWhere(query.DurationMax, "duration > ?")
+		builder.andWhere(toMicroseconds(query.DurationMax), durationMaxPredicate)
+	}
+	tagKeys := make([]string, 0, len(query.Tags))
+	for key := range query.Tags {
+		tagKeys = append(tagKeys, key)
+	}
+	sort.Strings(tagKeys)
+	for _, key := range tagKeys {
+		value, negated := parseTagValue(query.Tags[key])
+		if !negated {
+			where, params := spanTagPredicate(key, value, tagStorage, "span")
+			builder.andWhereParams(where, params...)
+			continue
+		}
+		// no span of the trace may carry the tag, not just the matched one
+		where, params := spanTagPredicate(key, value, tagStorage, "tag_span")
+		if len(value) == 0 {
+			where, params = tagKeyPredicate(key, tagStorage, "tag_span")
+		}
+		builder.andWhereParams(`NOT EXISTS (SELECT 1 FROM spans AS tag_span
+	WHERE tag_span.trace_id_low = span.trace_id_low AND tag_span.trace_id_high = span.trace_id_high
+	AND tag_span.tenant_id = span.tenant_id AND `+where+")", params...)
 	}
-
-	//TODO Tags map[]string
 
 	return builder
 }
 
+// parseTagValue reads the negation of a searched tag value: !value searches
+// for the traces without the tag value, a lone ! for the traces without the
+// tag at all and !! escapes a value starting with !
+func parseTagValue(value string) (string, bool) {
+	if !strings.HasPrefix(value, "!") {
+		return value, false
+	}
+	if strings.HasPrefix(value, "!!") {
+		return value[1:], false
+	}
+	return value[1:], true
+}
+
+// spanTagPredicate matches a searched tag value on the spans aliased as
+// table, in the columns of the tagStorage. The error=true search matches the
+// spans flagged by spanHasError instead, served by a partial index.
+func spanTagPredicate(key string, value string, tagStorage string, table string) (string, []interface{}) {
+	if key == errorTagKey && value == "true" {
+		return table + ".has_error", nil
+	}
+	if strings.HasPrefix(key, logFieldPrefix) {
+		return logFieldPredicate(strings.TrimPrefix(key, logFieldPrefix), value, table)
+	}
+	where, params := tagPredicate(key, value)
+	if tagStorage == TagStorageHstore {
+		hstoreWhere, hstoreParams := hstoreTagPredicate(key, value)
+		where = "(" + hstoreWhere + " OR " + where + ")"
+		params = append(hstoreParams, params...)
+	}
+	return where, params
+}
+
+// tagKeyPredicate matches the spans aliased as table carrying the tag key
+// whatever its value, in the columns of its scope or in their logs
+func tagKeyPredicate(key string, tagStorage string, table string) (string, []interface{}) {
+	if strings.HasPrefix(key, logFieldPrefix) {
+		return logFieldPredicate(strings.TrimPrefix(key, logFieldPrefix), "", table)
+	}
+	columns, keys := tagScope(key)
+	var clauses []string
+	var params []interface{}
+	for _, column := range columns {
+		for _, k := range keys {
+			clauses = append(clauses, column.jsonb+" -> ? IS NOT NULL")
+			params = append(params, k)
+			if tagStorage == TagStorageHstore {
+				clauses = append(clauses, "exist("+column.hstore+", ?)")
+				params = append(params, k)
+			}
+		}
+	}
+	return "(" + strings.Join(clauses, " OR ") + ")", params
+}
+
 // FindTraces retrieve traces that match the traceQuery
-func (r *Reader) FindTraces(ctx context.Context, query *spanstore.TraceQueryParameters) ([]*model.Trace, error) {
+func (r *Reader) FindTraces(ctx context.Context, query *spanstore.TraceQueryParameters) (ret []*model.Trace, err error) {
+	defer r.metrics.observe("FindTraces", time.Now(), &err)
+	ospan, ctx := r.startSpan(ctx, "FindTraces")
+	defer finishSpan(ospan, &err)
+	ctx, cancel := r.withQueryTimeout(ctx)
+	defer cancel()
+	ospan.SetTag("service_name", query.ServiceName)
 
-	traceIDs, err := r.FindTraceIDs(ctx, query)
-	ret := make([]*model.Trace, 0, len(traceIDs))
+	if traceID, found := queriedTraceID(query); found {
+		ospan.SetTag("trace_id", traceID.String())
+		err = r.retry(ctx, func() (err error) {
+			ret, err = r.loadTraces(ctx, r.db, []model.TraceID{traceID}, r.conf.MaxSpansPerTrace)
+			return err
+		})
+		if err != nil {
+			return nil, wrapError(err, "FindTraces")
+		}
+		ret = r.handleMissingRoots(ret)
+	} else if ret, err = r.findTraces(ctx, query, TraceKindFilter{}); err != nil {
+		return nil, wrapError(err, "FindTraces")
+	}
+	ospan.SetTag("result_count", len(ret))
+
+	return ret, nil
+}
+
+// traceIDTagKey is the searched tag some callers pass a trace id with, no
+// span is stored with it
+const traceIDTagKey = "traceID"
+
+// queriedTraceID returns the trace id of a query searching for nothing but
+// the traceID tag, FindTraces loads the trace by id then rather than running
+// a search which can't match. The service and time window, which the UI
+// always sends, are ignored as the id designates the trace.
+func queriedTraceID(query *spanstore.TraceQueryParameters) (model.TraceID, bool) {
+	value, found := query.Tags[traceIDTagKey]
+	if !found || len(query.Tags) > 1 || len(query.OperationName) > 0 || query.DurationMin > 0 || query.DurationMax > 0 {
+		return model.TraceID{}, false
+	}
+	traceID, err := model.TraceIDFromString(value)
+	return traceID, err == nil
+}
+
+// TraceKindFilter narrows a trace search to the traces having a matching span
+// of a given kind, e.g. the traces whose root span is a server span, and to
+// the traces of a given size
+type TraceKindFilter struct {
+	// Kind of the matching span as in the span.kind tag, empty for any kind
+	SpanKind string
+	// Only spans without references, the roots of their trace, can match
+	RootOnly bool
+	// Bounds of the number of spans stored for the trace, all of them and
+	// not only the matching ones, 0 leaves a bound out
+	MinSpans int
+	MaxSpans int
+}
+
+// FindTracesAnyOf retrieve up to numTraces traces having a span which matches
+// any of the queries, e.g. an operation in any service or any operation of
+// another service. NumTraces of the queries is ignored.
+func (r *Reader) FindTracesAnyOf(ctx context.Context, numTraces int, queries ...*spanstore.TraceQueryParameters) (ret []*model.Trace, err error) {
+	defer r.metrics.observe("FindTracesAnyOf", time.Now(), &err)
+	ospan, ctx := r.startSpan(ctx, "FindTracesAnyOf")
+	defer finishSpan(ospan, &err)
+	ctx, cancel := r.withQueryTimeout(ctx)
+	defer cancel()
+	ospan.SetTag("query_count", len(queries))
+
+	var traceIDs []model.TraceID
+	err = r.retry(ctx, func() error {
+		traceIDs = nil
+		alternatives := make([]*whereBuilder, 0, len(queries))
+		for _, query := range queries {
+			builder, found, err := r.traceSearchWhere(ctx, query, TraceKindFilter{})
+			if err != nil {
+				return err
+			}
+			if found {
+				alternatives = append(alternatives, builder)
+			}
+		}
+		if len(alternatives) == 0 {
+			return nil
+		}
+		builder := &whereBuilder{}
+		builder.andWhereAny(alternatives...)
+		var err error
+		traceIDs, err = r.findTraceIDsWhere(ctx, builder, 0, numTraces)
+		return err
+	})
 	if err != nil {
-		return ret, err
+		return nil, wrapError(err, "FindTracesAnyOf")
+	}
+
+	err = r.retry(ctx, func() (err error) {
+		ret, err = r.loadTraces(ctx, r.replica, traceIDs, 0)
+		return err
+	})
+	if err != nil {
+		return nil, wrapError(err, "FindTracesAnyOf")
+	}
+	ret = r.handleMissingRoots(ret)
+	sortTracesByLatestSpan(ret)
+	ospan.SetTag("result_count", len(ret))
+
+	return ret, nil
+}
+
+// FindTracesByKind retrieve traces that match the traceQuery through a span
+// which also matches the filter
+func (r *Reader) FindTracesByKind(ctx context.Context, query *spanstore.TraceQueryParameters, filter TraceKindFilter) (ret []*model.Trace, err error) {
+	defer r.metrics.observe("FindTracesByKind", time.Now(), &err)
+	ospan, ctx := r.startSpan(ctx, "FindTracesByKind")
+	defer finishSpan(ospan, &err)
+	ctx, cancel := r.withQueryTimeout(ctx)
+	defer cancel()
+	ospan.SetTag("service_name", query.ServiceName)
+	ospan.SetTag("span_kind", filter.SpanKind)
+	ospan.SetTag("root_only", filter.RootOnly)
+
+	ret, err = r.findTraces(ctx, query, filter)
+	if err != nil {
+		return nil, wrapError(err, "FindTracesByKind")
+	}
+	ospan.SetTag("result_count", len(ret))
+
+	return ret, nil
+}
+
+// findTraces loads the traces found by findTraceIDs, newest first
+func (r *Reader) findTraces(ctx context.Context, query *spanstore.TraceQueryParameters, filter TraceKindFilter) ([]*model.Trace, error) {
+	var traceIDs []model.TraceID
+	err := r.retry(ctx, func() (err error) {
+		traceIDs, err = r.findTraceIDs(ctx, query, filter, 0, query.NumTraces)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var ret []*model.Trace
+	err = r.retry(ctx, func() (err error) {
+		ret, err = r.loadTraces(ctx, r.replica, traceIDs, 0)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	ret = r.handleMissingRoots(ret)
+	sortTracesByLatestSpan(ret)
+	return ret, nil
+}
+
+// missingRootWarning marks the traces found before their root span arrived
+const missingRootWarning = "the root span of the trace is missing, it may not have arrived yet"
+
+// handleMissingRoots drops the traces without a root span when
+// Configuration.RequireRootSpan is set, otherwise the first span of such a
+// trace gets a warning telling the root is missing
+func (r *Reader) handleMissingRoots(traces []*model.Trace) []*model.Trace {
+	ret := traces[:0]
+	for _, trace := range traces {
+		if hasRootSpan(trace) {
+			ret = append(ret, trace)
+			continue
+		}
+		if r.conf.RequireRootSpan {
+			continue
+		}
+		if len(trace.Spans) > 0 {
+			trace.Spans[0].Warnings = append(trace.Spans[0].Warnings, missingRootWarning)
+		}
+		ret = append(ret, trace)
 	}
+	return ret
+}
+
+// hasRootSpan tells whether a span of the trace has no parent within it
+func hasRootSpan(trace *model.Trace) bool {
+	for _, span := range trace.Spans {
+		if span.ParentSpanID() == 0 {
+			return true
+		}
+	}
+	return false
+}
 
-	grouping := make(map[model.TraceID]*model.Trace)
+// StreamTraces calls fn with each trace matching the traceQuery, newest first,
+// loading one trace at a time so that only the current one is held in memory.
+// An error returned by fn stops the stream and is returned as is.
+func (r *Reader) StreamTraces(ctx context.Context, query *spanstore.TraceQueryParameters, fn func(*model.Trace) error) (err error) {
+	defer r.metrics.observe("StreamTraces", time.Now(), &err)
+	ospan, ctx := r.startSpan(ctx, "StreamTraces")
+	defer finishSpan(ospan, &err)
+	ctx, cancel := r.withQueryTimeout(ctx)
+	defer cancel()
+	ospan.SetTag("service_name", query.ServiceName)
+
+	var traceIDs []model.TraceID
+	err = r.retry(ctx, func() (err error) {
+		traceIDs, err = r.findTraceIDs(ctx, query, TraceKindFilter{}, 0, query.NumTraces)
+		return err
+	})
+	if err != nil {
+		return wrapError(err, "StreamTraces")
+	}
+
+	streamed := 0
 	for _, traceID := range traceIDs {
-		var spans []Span
-		err = r.db.Model(&spans).Where("trace_id_low = ? and trace_id_high = ?", traceID.Low, traceID.High).
-			Relation("Operation").Relation("Service").Relation("SpanRefs").
-			Order("start_time ASC").Select()
+		var traces []*model.Trace
+		err := r.retry(ctx, func() (err error) {
+			traces, err = r.loadTraces(ctx, r.replica, []model.TraceID{traceID}, 0)
+			return err
+		})
 		if err != nil {
-			return ret, err
-		}
-		for _, span := range spans {
-			modelSpan := toModelSpan(span)
-			trace, found := grouping[modelSpan.TraceID]
-			if !found {
-				trace = &model.Trace{
-					Spans:      make([]*model.Span, 0, len(spans)),
-					ProcessMap: make([]model.Trace_ProcessMapping, 0, len(spans)),
-				}
-				grouping[modelSpan.TraceID] = trace
+			return wrapError(err, "StreamTraces")
+		}
+		traces = r.handleMissingRoots(traces)
+		for _, trace := range traces {
+			if err := fn(trace); err != nil {
+				return err
 			}
-			trace.Spans = append(trace.Spans, modelSpan)
-			procMap := model.Trace_ProcessMapping{
-				ProcessID: span.ProcessID,
-				Process: model.Process{
-					ServiceName: span.Service.ServiceName,
-					Tags:        mapToModelKV(span.ProcessTags),
-				},
+			streamed++
+		}
+	}
+	ospan.SetTag("result_count", streamed)
+
+	return nil
+}
+
+// GetTraces returns the traces of the given ids loaded with a single query, in
+// the order of ids. Unknown ids are left out of the result.
+func (r *Reader) GetTraces(ctx context.Context, ids []model.TraceID) (ret []*model.Trace, err error) {
+	defer r.metrics.observe("GetTraces", time.Now(), &err)
+	ospan, ctx := r.startSpan(ctx, "GetTraces")
+	defer finishSpan(ospan, &err)
+	ctx, cancel := r.withQueryTimeout(ctx)
+	defer cancel()
+	ospan.SetTag("trace_count", len(ids))
+
+	err = r.retry(ctx, func() (err error) {
+		ret, err = r.loadTraces(ctx, r.db, ids, 0)
+		return err
+	})
+	if err != nil {
+		return nil, wrapError(err, "GetTraces")
+	}
+	ospan.SetTag("result_count", len(ret))
+
+	return ret, nil
+}
+
+// loadTraces reads all spans of the traces from db and groups them, traces
+// follow the order of traceIDs and the ones without spans are skipped. With
+// Configuration.FindConcurrency the traces are split among that many
+// statements running in parallel, the first failure cancels the others. A
+// positive maxSpans caps the spans of each trace with capSpans.
+func (r *Reader) loadTraces(ctx context.Context, db *pg.DB, traceIDs []model.TraceID, maxSpans int) ([]*model.Trace, error) {
+	workers := r.conf.FindConcurrency
+	if workers > len(traceIDs) {
+		workers = len(traceIDs)
+	}
+	if workers <= 1 {
+		return r.loadTraceShare(ctx, db, traceIDs, maxSpans)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	share := (len(traceIDs) + workers - 1) / workers
+	traces := make([][]*model.Trace, workers)
+	errs := make([]error, workers)
+	var wg sync.WaitGroup
+	for i := 0; i < workers && i*share < len(traceIDs); i++ {
+		from, to := i*share, (i+1)*share
+		if to > len(traceIDs) {
+			to = len(traceIDs)
+		}
+		wg.Add(1)
+		go func(i int, traceIDs []model.TraceID) {
+			defer wg.Done()
+			if traces[i], errs[i] = r.loadTraceShare(ctx, db, traceIDs, maxSpans); errs[i] != nil {
+				cancel()
 			}
-			trace.ProcessMap = append(trace.ProcessMap, procMap)
+		}(i, traceIDs[from:to])
+	}
+	wg.Wait()
+
+	ret := make([]*model.Trace, 0, len(traceIDs))
+	var err error
+	for i := range traces {
+		// the cause rather than the statements it canceled
+		if errs[i] != nil && (err == nil || errors.Is(err, context.Canceled)) {
+			err = errs[i]
 		}
+		ret = append(ret, traces[i]...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// loadTraceShare loads the traces of loadTraces with a single statement
+func (r *Reader) loadTraceShare(ctx context.Context, db *pg.DB, traceIDs []model.TraceID, maxSpans int) ([]*model.Trace, error) {
+	ret := make([]*model.Trace, 0, len(traceIDs))
+	if len(traceIDs) == 0 {
+		return ret, nil
+	}
+
+	traceIDPairs := make([][]int64, 0, len(traceIDs))
+	for _, traceID := range traceIDs {
+		traceIDPairs = append(traceIDPairs, []int64{int64(traceID.Low), int64(traceID.High)})
+	}
+
+	var spans []Span
+	err := whereTenant(ctx, selectSpanColumns(db.ModelContext(ctx, &spans))).Where("(trace_id_low, trace_id_high) IN (?)", pg.In(traceIDPairs)).
+		Relation("Operation").Relation("Service").
+		Order("start_time ASC").Select()
+	if err != nil {
+		return nil, err
+	}
+	if err = r.loadSpanDetails(ctx, db, spans); err != nil {
+		return nil, err
 	}
 
-	for _, trace := range grouping {
+	grouping := make(map[model.TraceID][]Span)
+	for _, span := range spans {
+		traceID := model.TraceID{Low: uint64(span.TraceIDLow), High: uint64(span.TraceIDHigh)}
+		grouping[traceID] = append(grouping[traceID], span)
+	}
+	for _, traceID := range traceIDs {
+		traceSpans, found := grouping[traceID]
+		if !found {
+			continue
+		}
+		delete(grouping, traceID)
+		if maxSpans > 0 && len(traceSpans) > maxSpans {
+			traceSpans = capSpans(traceSpans, maxSpans)
+		}
+		trace := &model.Trace{
+			Spans:      make([]*model.Span, 0, len(traceSpans)),
+			ProcessMap: toModelProcessMap(traceSpans),
+		}
+		for _, span := range traceSpans {
+			trace.Spans = append(trace.Spans, toModelSpan(span))
+		}
 		ret = append(ret, trace)
 	}
+	return ret, nil
+}
 
-	return ret, err
+// sortTracesByLatestSpan orders traces newest first by the start time of their
+// most recent span, breaking ties by trace id so the result is stable
+func sortTracesByLatestSpan(traces []*model.Trace) {
+	latest := func(trace *model.Trace) time.Time {
+		var ret time.Time
+		for _, span := range trace.Spans {
+			if span.StartTime.After(ret) {
+				ret = span.StartTime
+			}
+		}
+		return ret
+	}
+	sort.SliceStable(traces, func(i, j int) bool {
+		ti, tj := latest(traces[i]), latest(traces[j])
+		if !ti.Equal(tj) {
+			return ti.After(tj)
+		}
+		idi, idj := traces[i].Spans[0].TraceID, traces[j].Spans[0].TraceID
+		// signed like the bigint columns to agree with the order of the search
+		if idi.High != idj.High {
+			return int64(idi.High) < int64(idj.High)
+		}
+		return int64(idi.Low) < int64(idj.Low)
+	})
 }
 
 // FindTraceIDs retrieve traceIDs that match the traceQuery
 func (r *Reader) FindTraceIDs(ctx context.Context, query *spanstore.TraceQueryParameters) (ret []model.TraceID, err error) {
+	defer r.metrics.observe("FindTraceIDs", time.Now(), &err)
+	ospan, ctx := r.startSpan(ctx, "FindTraceIDs")
+	defer finishSpan(ospan, &err)
+	ctx, cancel := r.withQueryTimeout(ctx)
+	defer cancel()
+	ospan.SetTag("service_name", query.ServiceName)
+
+	err = r.retry(ctx, func() (err error) {
+		ret, err = r.findTraceIDs(ctx, query, TraceKindFilter{}, 0, query.NumTraces)
+		return err
+	})
+	ospan.SetTag("result_count", len(ret))
+
+	return ret, wrapError(err, "FindTraceIDs")
+}
+
+// FindTraceIDsPaged retrieve one page of traceIDs that match the traceQuery,
+// newest traces first. NumTraces of the query is ignored in favor of limit.
+func (r *Reader) FindTraceIDsPaged(ctx context.Context, query *spanstore.TraceQueryParameters, offset int, limit int) (ret []model.TraceID, err error) {
+	defer r.metrics.observe("FindTraceIDsPaged", time.Now(), &err)
+	ospan, ctx := r.startSpan(ctx, "FindTraceIDsPaged")
+	defer finishSpan(ospan, &err)
+	ctx, cancel := r.withQueryTimeout(ctx)
+	defer cancel()
+	ospan.SetTag("service_name", query.ServiceName)
+	ospan.SetTag("offset", offset)
+
+	err = r.retry(ctx, func() (err error) {
+		ret, err = r.findTraceIDs(ctx, query, TraceKindFilter{}, offset, limit)
+		return err
+	})
+	ospan.SetTag("result_count", len(ret))
+
+	return ret, wrapError(err, "FindTraceIDsPaged")
+}
+
+// traceIDsOrder sorts the trace ids grouped from the spans by their most
+// recent span, the ids break ties so that pages don't overlap
+const traceIDsOrder = "max(start_time) DESC, trace_id_high ASC, trace_id_low ASC"
+
+// findTraceIDs groups the matching spans by trace so that limit and offset
+// count distinct traces rather than spans, traces are ordered by their most
+// recent matching span. The limit applies to the groups, a trace with many
+// matching spans takes a single place.
+func (r *Reader) findTraceIDs(ctx context.Context, query *spanstore.TraceQueryParameters, filter TraceKindFilter, offset int, limit int) (ret []model.TraceID, err error) {
+
+	builder, found, err := r.traceSearchWhere(ctx, query, filter)
+	if err != nil || !found {
+		return ret, err
+	}
+	return r.findTraceIDsWhere(ctx, builder, offset, limit)
+}
 
-	builder := buildTraceWhere(query)
+// findTraceIDsWhere runs the trace id search of findTraceIDs for the
+// predicates of builder
+func (r *Reader) findTraceIDsWhere(ctx context.Context, builder *whereBuilder, offset int, limit int) (ret []model.TraceID, err error) {
+	limit = r.numTraces(limit)
+	if offset < 0 {
+		offset = 0
+	}
 
-	limit := query.NumTraces
-	if limit <= 0 {
-		limit = 10
+	if r.conf.PrepareSearches {
+		return r.findTraceIDsPrepared(ctx, builder, offset, limit)
 	}
 
-	err = r.db.Model((*Span)(nil)).
-		Join("JOIN operations AS operation ON operation.id = span.operation_id").
-		Join("JOIN services AS service ON service.id = span.service_id").
-		ColumnExpr("distinct trace_id_low as Low, trace_id_high as High").
-		Where(builder.where, builder.params...).Limit(100 * limit).Select(&ret)
+	// spans are only joined to services and operations through the ids
+	// resolved above, a query by time, duration or tags alone reads spans only
+	q := r.replica.ModelContext(ctx, (*Span)(nil)).
+		ColumnExpr("trace_id_low as Low, trace_id_high as High")
+	if len(builder.where) > 0 {
+		q = q.Where(builder.where, builder.params...)
+	}
+	err = q.Group("trace_id_low", "trace_id_high").
+		OrderExpr(traceIDsOrder).
+		Limit(limit).Offset(offset).Select(&ret)
 
 	return ret, err
 }
 
-// GetDependencies returns all inter-service dependencies
-func (r *Reader) GetDependencies(endTs time.Time, lookback time.Duration) (ret []model.DependencyLink, err error) {
-
-	err = r.db.Model((*SpanRef)(nil)).
-		ColumnExpr("source_spans.service_id AS parent").
-		ColumnExpr("source_service.service_name AS parent_name").
-		ColumnExpr("child_spans.service_id AS child").
-		ColumnExpr("child_service.service_name AS child_name").
-		ColumnExpr("count(*) AS call_count").
-		Join("JOIN spans AS source_spans ON source_spans.id = span_ref.id").
-		Join("JOIN services AS source_service ON source_service.id = source_spans.service_id").
-		Join("JOIN spans AS child_spans ON child_spans.id = span_ref.child_span_id").
-		Join("JOIN services AS child_service ON child_service.id = source_spans.service_id").
-		Group("source_spans.service_id").
-		Group("source_service.service_name").
-		Group("child_spans.service_id").
-		Group("child_service.service_name").
-		Select(&ret)
+// traceSearchWhere builds the span predicates shared by every trace search, it
+// reports false when nothing can match
+func (r *Reader) traceSearchWhere(ctx context.Context, query *spanstore.TraceQueryParameters, filter TraceKindFilter) (*whereBuilder, bool, error) {
+	builder := buildTraceWhere(query, r.conf.TagStorage)
+	found, err := r.whereServiceAndOperation(ctx, builder, query, filter.SpanKind)
+	if err != nil || !found {
+		return builder, false, err
+	}
+	if tenant := TenantFromContext(ctx); len(tenant) > 0 {
+		builder.andWhere(tenant, "span.tenant_id = ?")
+	}
+	if filter.RootOnly {
+		builder.andWhereParams(rootSpanPredicate)
+	}
+	if filter.MinSpans > 0 {
+		builder.andWhere(filter.MinSpans, traceSpanCount+" >= ?")
+	}
+	if filter.MaxSpans > 0 {
+		builder.andWhere(filter.MaxSpans, traceSpanCount+" <= ?")
+	}
+	return builder, true, nil
+}
+
+// CountTraces returns the number of traces matching the traceQuery, NumTraces
+// of the query is ignored
+func (r *Reader) CountTraces(ctx context.Context, query *spanstore.TraceQueryParameters) (count int64, err error) {
+	defer r.metrics.observe("CountTraces", time.Now(), &err)
+	ospan, ctx := r.startSpan(ctx, "CountTraces")
+	defer finishSpan(ospan, &err)
+	ctx, cancel := r.withQueryTimeout(ctx)
+	defer cancel()
+	ospan.SetTag("service_name", query.ServiceName)
+
+	err = r.retry(ctx, func() error {
+		count = 0
+		builder, found, err := r.traceSearchWhere(ctx, query, TraceKindFilter{})
+		if err != nil || !found {
+			return err
+		}
+		q := r.replica.ModelContext(ctx, (*Span)(nil)).
+			ColumnExpr("count(DISTINCT (trace_id_low, trace_id_high))")
+		if len(builder.where) > 0 {
+			q = q.Where(builder.where, builder.params...)
+		}
+		return q.Select(pg.Scan(&count))
+	})
+	ospan.SetTag("result_count", count)
+
+	return count, wrapError(err, "CountTraces")
+}
+
+// whereServiceAndOperation resolves the service and operation names of the
+// query to ids and filters spans by those, so that the search can use the
+// spans(service_id, operation_id, start_time) index instead of joining by name.
+// ServiceName may list several comma separated services to search across,
+// each under all of its names, see Writer.AddServiceAlias.
+// A span kind restricts the operations the same way as an operation name.
+// Names are compared ignoring case with Configuration.CaseInsensitiveNames.
+// It reports false when a name is unknown and therefore nothing can match.
+func (r *Reader) whereServiceAndOperation(ctx context.Context, builder *whereBuilder, query *spanstore.TraceQueryParameters, spanKind string) (bool, error) {
+	serviceNames := splitServiceNames(query.ServiceName)
+	if len(serviceNames) > 0 {
+		aliases, err := r.serviceAliases(ctx)
+		if err != nil {
+			return false, err
+		}
+		serviceNames = withServiceAliases(serviceNames, aliases)
+	}
+	serviceNameColumn, operationNameColumn := "service_name", "operation_name"
+	// stored truncated by the Writer
+	operationName, _ := truncateName(query.OperationName, r.conf.MaxOperationNameLength)
+	if r.conf.CaseInsensitiveNames {
+		serviceNameColumn, operationNameColumn = "lower(service_name)", "lower(operation_name)"
+		for i := range serviceNames {
+			serviceNames[i] = strings.ToLower(serviceNames[i])
+		}
+		operationName = strings.ToLower(operationName)
+	}
+
+	var serviceIDs []int64
+	if len(serviceNames) > 0 {
+		err := r.replica.ModelContext(ctx, (*Service)(nil)).Column("id").Where("? IN (?)", pg.SafeQuery(serviceNameColumn), pg.In(serviceNames)).Select(&serviceIDs)
+		if err != nil {
+			return false, err
+		}
+		if len(serviceIDs) == 0 {
+			return false, nil
+		}
+		builder.andWhere(pg.Array(serviceIDs), "span.service_id = ANY(?)")
+	}
+	if len(query.OperationName) > 0 || len(spanKind) > 0 {
+		var operationIDs []int64
+		operations := r.replica.ModelContext(ctx, (*Operation)(nil)).Column("id")
+		if len(operationName) > 0 {
+			operations = operations.Where("? = ?", pg.SafeQuery(operationNameColumn), operationName)
+		}
+		if len(spanKind) > 0 {
+			operations = operations.Where("span_kind = ?", spanKind)
+		}
+		if len(serviceIDs) > 0 {
+			operations = operations.Where("service_id IN (?)", pg.In(serviceIDs))
+		}
+		if err := operations.Select(&operationIDs); err != nil {
+			return false, err
+		}
+		if len(operationIDs) == 0 {
+			return false, nil
+		}
+		builder.andWhere(pg.Array(operationIDs), "span.operation_id = ANY(?)")
+	}
+	return true, nil
+}
+
+// splitServiceNames returns the non-empty service names of a comma separated list
+func splitServiceNames(serviceName string) []string {
+	ret := make([]string, 0)
+	for _, name := range strings.Split(serviceName, ",") {
+		if name = strings.TrimSpace(name); len(name) > 0 {
+			ret = append(ret, name)
+		}
+	}
+	return ret
+}
+
+// numTraces returns the effective search limit for the requested one
+func (r *Reader) numTraces(requested int) int {
+	if requested <= 0 {
+		requested = r.conf.DefaultNumTraces
+		if requested <= 0 {
+			requested = 10
+		}
+	}
+	if r.conf.MaxNumTraces > 0 && requested > r.conf.MaxNumTraces {
+		r.logger.Warn("Requested number of traces exceeds the maximum, capping it", "requested", requested, "max", r.conf.MaxNumTraces)
+		requested = r.conf.MaxNumTraces
+	}
+	return requested
+}
+
+// GetDependencies returns all inter-service dependencies observed in the
+// window [endTs-lookback, endTs), it is GetDependenciesContext without a way
+// to cancel as required by dependencystore.Reader
+func (r *Reader) GetDependencies(endTs time.Time, lookback time.Duration) ([]model.DependencyLink, error) {
+	return r.GetDependenciesContext(context.Background(), endTs, lookback)
+}
+
+// GetDependenciesContext returns all inter-service dependencies observed in the
+// window [endTs-lookback, endTs), cancelling ctx aborts the aggregation
+func (r *Reader) GetDependenciesContext(ctx context.Context, endTs time.Time, lookback time.Duration) (ret []model.DependencyLink, err error) {
+	defer r.metrics.observe("GetDependencies", time.Now(), &err)
+	ospan, ctx := r.startSpan(ctx, "GetDependencies")
+	defer finishSpan(ospan, &err)
+	ctx, cancel := r.withQueryTimeout(ctx)
+	defer cancel()
+	ospan.SetTag("lookback", lookback.String())
+
+	load := func() (ret []model.DependencyLink, err error) {
+		err = r.retry(ctx, func() (err error) {
+			ret, err = r.precomputedDependencies(ctx, endTs, lookback)
+			if err != nil || len(ret) > 0 {
+				return err
+			}
+			ret, err = r.liveDependencies(ctx, endTs, lookback)
+			return err
+		})
+		return ret, err
+	}
+	if r.conf.DependencyCacheTTL > 0 {
+		ret, err = r.dependencies.get(ctx, r.conf.DependencyCacheTTL, TenantFromContext(ctx), endTs, lookback, load)
+	} else {
+		ret, err = load()
+	}
+
+	return ret, wrapError(err, "GetDependencies")
+}
+
+// liveDependenciesQuery counts the calls between services. The referenced
+// span is the caller, the span holding the reference the callee, and a call
+// belongs to the window its caller started in. The callers are narrowed to
+// the window through idx_spans_start_time before anything is joined, the
+// references to them are then found through idx_span_refs_trace_child_span_id
+// and the callees through idx_spans_trace_span_id. Only CHILD_OF references
+// are calls, FOLLOWS_FROM links e.g. a producer to its consumer without it
+// waiting for the result. The calls are those of the tenant of the context,
+// of every tenant without one.
+const liveDependenciesQuery = `SELECT parent_service.service_name AS parent, child_service.service_name AS child,
+	count(*) AS call_count, ? AS source
+FROM (SELECT id, trace_id_low, trace_id_high, tenant_id, service_id FROM spans
+	WHERE start_time >= ? AND start_time < ? AND (? = '' OR tenant_id = ?)) AS parent_spans
+JOIN span_refs AS span_ref ON span_ref.trace_id_low = parent_spans.trace_id_low
+	AND span_ref.trace_id_high = parent_spans.trace_id_high AND span_ref.child_span_id = parent_spans.id
+	AND span_ref.tenant_id = parent_spans.tenant_id AND span_ref.ref_type = ?
+JOIN spans AS child_spans ON child_spans.trace_id_low = span_ref.span_trace_id_low
+	AND child_spans.trace_id_high = span_ref.span_trace_id_high AND child_spans.id = span_ref.span_id
+	AND child_spans.tenant_id = span_ref.tenant_id
+JOIN services AS child_service ON child_service.id = child_spans.service_id
+JOIN services AS parent_service ON parent_service.id = parent_spans.service_id
+GROUP BY parent_service.service_name, child_service.service_name
+ORDER BY parent ASC, child ASC`
+
+// liveDependencies counts the calls between services from the span references
+// to the spans started within the window
+func (r *Reader) liveDependencies(ctx context.Context, endTs time.Time, lookback time.Duration) ([]model.DependencyLink, error) {
+	ret := make([]model.DependencyLink, 0)
+	tenant := TenantFromContext(ctx)
+	_, err := r.replica.QueryContext(ctx, &ret, liveDependenciesQuery,
+		model.JaegerDependencyLinkSource, endTs.Add(-lookback), endTs, tenant, tenant, model.SpanRefType_CHILD_OF)
+	return ret, err
+}
 
+// precomputedDependencies sums up the links stored by DependencyWriter within
+// the window, those of the tenant of the context, of every tenant without one
+func (r *Reader) precomputedDependencies(ctx context.Context, endTs time.Time, lookback time.Duration) ([]model.DependencyLink, error) {
+	var deps []Dependency
+	query := r.replica.ModelContext(ctx, &deps).
+		ColumnExpr("parent, child, source, sum(call_count) AS call_count").
+		Where("ts >= ?", endTs.Add(-lookback)).
+		Where("ts < ?", endTs)
+	if tenant := TenantFromContext(ctx); len(tenant) > 0 {
+		query = query.Where("tenant_id = ?", tenant)
+	}
+	err := query.Group("parent", "child", "source").
+		Order("parent ASC", "child ASC").
+		Select()
+	ret := make([]model.DependencyLink, 0, len(deps))
+	for _, dep := range deps {
+		ret = append(ret, model.DependencyLink{
+			Parent:    dep.Parent,
+			Child:     dep.Child,
+			CallCount: dep.CallCount,
+			Source:    dep.Source,
+		})
+	}
 	return ret, err
 }
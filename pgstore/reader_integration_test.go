@@ -0,0 +1,1847 @@
+//go:build integration
+// +build integration
+
+package pgstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+func TestFindTraces(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	logger := hclog.NewNullLogger()
+	writer := NewWriter(db, logger)
+	reader := NewReader(db, logger, WithConfiguration(&Configuration{DefaultNumTraces: 20}))
+
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	checkout := model.TraceID{Low: 1}
+	root := testSpan(checkout, 1, "frontend", "GET /checkout", start)
+	root.Tags = []model.KeyValue{model.String("http.method", "GET")}
+	child := testSpan(checkout, 2, "payments", "charge", start.Add(time.Millisecond))
+	child.References = []model.SpanRef{model.NewChildOfRef(checkout, 1)}
+	other := testSpan(model.TraceID{Low: 2}, 3, "frontend", "GET /home", start)
+	writeTestSpans(t, writer, root, child, other)
+
+	traces, err := reader.FindTraces(context.Background(), &spanstore.TraceQueryParameters{
+		ServiceName:   "frontend",
+		OperationName: "GET /checkout",
+		Tags:          map[string]string{"http.method": "GET"},
+		StartTimeMin:  start.Add(-time.Minute),
+		StartTimeMax:  start.Add(time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traces) != 1 {
+		t.Fatalf("found %d traces, want the checkout one", len(traces))
+	}
+	trace := traces[0]
+	if len(trace.Spans) != 2 {
+		t.Fatalf("found %d spans, want the root and its child", len(trace.Spans))
+	}
+	for _, span := range trace.Spans {
+		if span.TraceID != checkout {
+			t.Errorf("span %s is of trace %s, want %s", span.SpanID, span.TraceID, checkout)
+		}
+		if span.SpanID == child.SpanID && (len(span.References) != 1 || span.References[0].SpanID != root.SpanID) {
+			t.Errorf("child references %v, want its root", span.References)
+		}
+		if span.SpanID == root.SpanID && !span.StartTime.Equal(root.StartTime) {
+			t.Errorf("root starts at %s, want %s", span.StartTime, root.StartTime)
+		}
+	}
+
+	traces, err = reader.FindTraces(context.Background(), &spanstore.TraceQueryParameters{
+		ServiceName:  "frontend",
+		Tags:         map[string]string{"http.method": "POST"},
+		StartTimeMin: start.Add(-time.Minute),
+		StartTimeMax: start.Add(time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traces) != 0 {
+		t.Errorf("found %d traces for an unused tag value", len(traces))
+	}
+}
+
+// findTraceIDs returns the ids found by FindTraceIDs ordered by their low word
+func findTraceIDs(tb testing.TB, reader *Reader, query *spanstore.TraceQueryParameters) []uint64 {
+	tb.Helper()
+	if query.NumTraces == 0 {
+		query.NumTraces = 100
+	}
+	ids, err := reader.FindTraceIDs(context.Background(), query)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	lows := make([]uint64, 0, len(ids))
+	for _, id := range ids {
+		lows = append(lows, id.Low)
+	}
+	sort.Slice(lows, func(i, j int) bool { return lows[i] < lows[j] })
+	return lows
+}
+
+func TestFindTraceIDsMultipleServices(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	for i, service := range []string{"a", "b", "c"} {
+		// spans are keyed by id and start time
+		writeTestSpans(t, writer, testSpan(model.TraceID{Low: uint64(i + 1)}, 1, service, "GET /", start.Add(time.Duration(i)*time.Millisecond)))
+	}
+
+	tests := []struct {
+		name        string
+		serviceName string
+		want        []uint64
+	}{
+		{name: "two services", serviceName: "a,b", want: []uint64{1, 2}},
+		{name: "whitespace around the names", serviceName: " a , b ", want: []uint64{1, 2}},
+		{name: "empty segments", serviceName: ",a,,b,", want: []uint64{1, 2}},
+		{name: "one service", serviceName: "c", want: []uint64{3}},
+		{name: "unknown service listed", serviceName: "a,mail", want: []uint64{1}},
+		{name: "separators only", serviceName: " , ,", want: []uint64{1, 2, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := &spanstore.TraceQueryParameters{ServiceName: tt.serviceName,
+				StartTimeMin: start.Add(-time.Minute), StartTimeMax: start.Add(time.Minute)}
+			if got := findTraceIDs(t, reader, query); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("found traces %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindTraceIDsDurationBounds(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	for i, duration := range []time.Duration{50 * time.Millisecond, 150 * time.Millisecond, 300 * time.Millisecond} {
+		span := testSpan(model.TraceID{Low: uint64(i + 1)}, model.SpanID(i+1), "frontend", "GET /", start)
+		span.Duration = duration
+		writeTestSpans(t, writer, span)
+	}
+	// found by a search without a service only
+	other := testSpan(model.TraceID{Low: 4}, 4, "backend", "query", start)
+	other.Duration = 150 * time.Millisecond
+	writeTestSpans(t, writer, other)
+
+	tests := []struct {
+		name     string
+		service  string
+		min, max time.Duration
+		want     []uint64
+	}{
+		{name: "DurationMin only", service: "frontend", min: 100 * time.Millisecond, want: []uint64{2, 3}},
+		{name: "DurationMax only", service: "frontend", max: 200 * time.Millisecond, want: []uint64{1, 2}},
+		{name: "both bounds", service: "frontend", min: 100 * time.Millisecond, max: 200 * time.Millisecond, want: []uint64{2}},
+		{name: "bounds matching exactly", service: "frontend", min: 50 * time.Millisecond, max: 150 * time.Millisecond, want: []uint64{1, 2}},
+		{name: "no span in between", service: "frontend", min: 160 * time.Millisecond, max: 290 * time.Millisecond, want: []uint64{}},
+		{name: "duration only", min: 100 * time.Millisecond, max: 200 * time.Millisecond, want: []uint64{2, 4}},
+		{name: "DurationMin only of any service", min: 100 * time.Millisecond, want: []uint64{2, 3, 4}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			query := &spanstore.TraceQueryParameters{ServiceName: tt.service,
+				StartTimeMin: start.Add(-time.Minute), StartTimeMax: start.Add(time.Minute), DurationMin: tt.min, DurationMax: tt.max}
+			if got := findTraceIDs(t, reader, query); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("found traces %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// statementHook records the statements run on a db
+type statementHook struct {
+	statements []string
+}
+
+func (h *statementHook) BeforeQuery(ctx context.Context, event *pg.QueryEvent) (context.Context, error) {
+	if statement, err := event.FormattedQuery(); err == nil {
+		h.statements = append(h.statements, statement)
+	}
+	return ctx, nil
+}
+
+func (h *statementHook) AfterQuery(context.Context, *pg.QueryEvent) error {
+	return nil
+}
+
+func TestFindTracesStatementCount(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	// the spans and refs of all the traces found are loaded at once
+	hook := &statementHook{}
+	db.AddQueryHook(hook)
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	stored := uint64(0)
+	want := -1
+	for _, numTraces := range []uint64{1, 5, 20} {
+		for ; stored < numTraces; stored++ {
+			traceID := model.TraceID{Low: stored + 1}
+			rootID := model.SpanID(2*stored + 1)
+			child := testSpan(traceID, rootID+1, "backend", "query", start)
+			child.References = []model.SpanRef{model.NewChildOfRef(traceID, rootID)}
+			writeTestSpans(t, writer, testSpan(traceID, rootID, "frontend", "GET /", start), child)
+		}
+		hook.statements = nil
+		traces, err := reader.FindTraces(context.Background(), &spanstore.TraceQueryParameters{ServiceName: "frontend",
+			NumTraces: 20, StartTimeMin: start.Add(-time.Minute), StartTimeMax: start.Add(time.Minute)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uint64(len(traces)) != numTraces {
+			t.Fatalf("FindTraces() found %d traces, want %d", len(traces), numTraces)
+		}
+		if want < 0 {
+			want = len(hook.statements)
+		}
+		if len(hook.statements) != want {
+			t.Errorf("FindTraces() of %d traces ran %d statements, want %d like the one of a trace", numTraces, len(hook.statements), want)
+		}
+	}
+}
+
+// benchmarkTraces is the number of traces of benchmarkTraceSpans spans seeded
+// for BenchmarkFindTraces and BenchmarkGetTracesConcurrency, one per second
+// going back from now
+const (
+	benchmarkTraces     = 100000
+	benchmarkTraceSpans = 10
+)
+
+// BenchmarkFindTraces searches the latest traces of a service out of
+// benchmarkTraces, alone and with the spans of the traces loaded
+func BenchmarkFindTraces(b *testing.B) {
+	db, done := newTestDB(b)
+	defer done()
+	if _, err := db.Exec(`
+INSERT INTO services (id, service_name) VALUES (1, 'frontend');
+INSERT INTO operations (id, service_id, operation_name, span_kind) VALUES (1, 1, 'GET /', '');
+INSERT INTO spans (id, trace_id_low, trace_id_high, operation_id, flags, start_time, duration, service_id, process_id)
+	SELECT span, i, 0, 1, 0, now() - i * interval '1 second', 1000, 1, ''
+	FROM generate_series(1, ?) AS i, generate_series(1, ?) AS span;
+ANALYZE;
+`, benchmarkTraces, benchmarkTraceSpans); err != nil {
+		b.Fatal(err)
+	}
+	reader := NewReader(db, hclog.NewNullLogger())
+	query := &spanstore.TraceQueryParameters{ServiceName: "frontend", NumTraces: 20,
+		StartTimeMin: time.Now().Add(-24 * time.Hour), StartTimeMax: time.Now()}
+
+	b.Run("IDs", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			ids, err := reader.FindTraceIDs(context.Background(), query)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if len(ids) == 0 {
+				b.Fatal("found no trace")
+			}
+		}
+	})
+	b.Run("Traces", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			traces, err := reader.FindTraces(context.Background(), query)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if len(traces) == 0 || len(traces[0].Spans) != benchmarkTraceSpans {
+				b.Fatalf("found %d traces, want some of %d spans", len(traces), benchmarkTraceSpans)
+			}
+		}
+	})
+}
+
+func TestFindTracesOrder(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	// 5 started before 4 but has the latest span, 2 and 3 tie
+	start := time.Now().Add(-10 * time.Minute).Truncate(time.Microsecond)
+	for trace, offset := range map[uint64]time.Duration{1: -4 * time.Minute, 2: -time.Minute, 3: -time.Minute, 4: 0, 5: -2 * time.Minute} {
+		writeTestSpans(t, writer, testSpan(model.TraceID{Low: trace}, model.SpanID(trace), "frontend", "GET /", start.Add(offset)))
+	}
+	writeTestSpans(t, writer, testSpan(model.TraceID{Low: 5}, 6, "backend", "query", start.Add(30*time.Second)))
+
+	query := &spanstore.TraceQueryParameters{ServiceName: "frontend", NumTraces: 10,
+		StartTimeMin: start.Add(-time.Hour), StartTimeMax: start.Add(time.Hour)}
+	want := []uint64{5, 4, 2, 3, 1}
+	for i := 0; i < 5; i++ {
+		traces, err := reader.FindTraces(context.Background(), query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]uint64, 0, len(traces))
+		for _, trace := range traces {
+			got = append(got, trace.Spans[0].TraceID.Low)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("call %d: FindTraces() = %v, want %v", i+1, got, want)
+		}
+	}
+}
+
+// lockSpanTables holds an ACCESS EXCLUSIVE lock on the services, operations
+// and spans, making the queries of the Reader wait, until release
+func lockSpanTables(tb testing.TB, db *pg.DB) (release func()) {
+	tb.Helper()
+	tx, err := db.Begin()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := tx.Exec("LOCK TABLE services, operations, spans IN ACCESS EXCLUSIVE MODE"); err != nil {
+		tx.Rollback()
+		tb.Fatal(err)
+	}
+	return func() {
+		tx.Rollback()
+	}
+}
+
+// assertCanceledPromptly runs call with a context cancelled 100ms into it and
+// expects it to return context.Canceled soon after
+func assertCanceledPromptly(t *testing.T, name string, call func(ctx context.Context) error) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	time.AfterFunc(100*time.Millisecond, cancel)
+	started := time.Now()
+	if err := call(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("%s = %v, want context.Canceled", name, err)
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("%s returned %s after the cancellation, want it at once", name, elapsed-100*time.Millisecond)
+	}
+}
+
+func TestReaderCanceled(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	start := time.Now().Add(-time.Minute)
+	writeTestSpans(t, NewWriter(db, hclog.NewNullLogger()), testSpan(model.TraceID{Low: 1}, 1, "frontend", "GET /", start))
+	query := &spanstore.TraceQueryParameters{ServiceName: "frontend", NumTraces: 10,
+		StartTimeMin: start.Add(-time.Minute), StartTimeMax: start.Add(time.Minute)}
+
+	release := lockSpanTables(t, db)
+	defer release()
+	assertCanceledPromptly(t, "GetServices()", func(ctx context.Context) error {
+		_, err := reader.GetServices(ctx)
+		return err
+	})
+	assertCanceledPromptly(t, "GetOperations()", func(ctx context.Context) error {
+		_, err := reader.GetOperations(ctx, spanstore.OperationQueryParameters{ServiceName: "frontend"})
+		return err
+	})
+	assertCanceledPromptly(t, "GetTrace()", func(ctx context.Context) error {
+		trace, err := reader.GetTrace(ctx, model.TraceID{Low: 1})
+		if trace != nil {
+			t.Errorf("GetTrace() = %v, want nil with the error", trace)
+		}
+		return err
+	})
+	assertCanceledPromptly(t, "FindTraceIDs()", func(ctx context.Context) error {
+		_, err := reader.FindTraceIDs(ctx, query)
+		return err
+	})
+	assertCanceledPromptly(t, "FindTraces()", func(ctx context.Context) error {
+		traces, err := reader.FindTraces(ctx, query)
+		if traces != nil {
+			t.Errorf("FindTraces() = %v, want nil with the error", traces)
+		}
+		return err
+	})
+}
+
+func TestFindTraceIDsBoundaries(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	min := time.Now().Add(-time.Hour).Truncate(time.Microsecond)
+	max := min.Add(time.Minute)
+	span := func(trace uint64, start time.Time, duration time.Duration) *model.Span {
+		span := testSpan(model.TraceID{Low: trace}, model.SpanID(trace), "frontend", "GET /", start)
+		span.Duration = duration
+		return span
+	}
+	writeTestSpans(t, writer,
+		span(1, min.Add(-time.Microsecond), 2*time.Millisecond),
+		span(2, min, time.Millisecond),
+		span(3, max.Add(-time.Microsecond), 2*time.Millisecond),
+		span(4, max, 3*time.Millisecond),
+		span(5, min, 500*time.Microsecond),
+		span(6, min, 1500*time.Microsecond),
+		span(7, min, 0),
+	)
+
+	tests := []struct {
+		name  string
+		query spanstore.TraceQueryParameters
+		want  []uint64
+	}{
+		{
+			name:  "time window is half-open",
+			query: spanstore.TraceQueryParameters{ServiceName: "frontend", StartTimeMin: min, StartTimeMax: max},
+			want:  []uint64{2, 3, 5, 6, 7},
+		},
+		{
+			name: "duration window is closed",
+			query: spanstore.TraceQueryParameters{ServiceName: "frontend", StartTimeMin: min.Add(-time.Hour), StartTimeMax: max.Add(time.Hour),
+				DurationMin: 2 * time.Millisecond, DurationMax: 3 * time.Millisecond},
+			want: []uint64{1, 3, 4},
+		},
+		{
+			name: "sub-millisecond durations compare exactly",
+			query: spanstore.TraceQueryParameters{ServiceName: "frontend", StartTimeMin: min, StartTimeMax: max,
+				DurationMin: 500 * time.Microsecond, DurationMax: 1500 * time.Microsecond},
+			want: []uint64{2, 5, 6},
+		},
+		{
+			name: "sub-millisecond bounds exclude by a microsecond",
+			query: spanstore.TraceQueryParameters{ServiceName: "frontend", StartTimeMin: min, StartTimeMax: max,
+				DurationMin: 501 * time.Microsecond, DurationMax: 1499 * time.Microsecond},
+			want: []uint64{2},
+		},
+		{
+			name: "zero durations match DurationMax",
+			query: spanstore.TraceQueryParameters{ServiceName: "frontend", StartTimeMin: min, StartTimeMax: max,
+				DurationMax: 100 * time.Microsecond},
+			want: []uint64{7},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := findTraceIDs(t, reader, &tt.query); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("found traces %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindTraceIDsPaged(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	// 7 traces of 2 spans, newest first by trace id, the last 3 started at
+	// the same time
+	start := time.Now().Add(-time.Hour).Truncate(time.Microsecond)
+	for i := 1; i <= 7; i++ {
+		traceID := model.TraceID{Low: uint64(i)}
+		latest := start.Add(time.Duration(7-i) * time.Second)
+		if i >= 5 {
+			latest = start
+		}
+		writeTestSpans(t, writer,
+			testSpan(traceID, model.SpanID(2*i-1), "frontend", "GET /", latest.Add(-time.Millisecond)),
+			testSpan(traceID, model.SpanID(2*i), "frontend", "GET /", latest))
+	}
+	query := &spanstore.TraceQueryParameters{ServiceName: "frontend",
+		StartTimeMin: start.Add(-time.Minute), StartTimeMax: start.Add(time.Minute)}
+
+	var all []uint64
+	for _, page := range []struct {
+		offset int
+		want   int
+	}{{0, 3}, {3, 3}, {6, 1}, {9, 0}} {
+		ids, err := reader.FindTraceIDsPaged(context.Background(), query, page.offset, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != page.want {
+			t.Errorf("page at %d has %d traces, want %d", page.offset, len(ids), page.want)
+		}
+		for _, id := range ids {
+			all = append(all, id.Low)
+		}
+	}
+	if want := []uint64{1, 2, 3, 4, 5, 6, 7}; !reflect.DeepEqual(all, want) {
+		t.Errorf("pages = %v, want %v", all, want)
+	}
+}
+
+func TestGetTraceZeroWords(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	traceIDs := []model.TraceID{
+		// 64 bit
+		{Low: 1},
+		// 128 bit sharing the low word of the 64 bit one
+		{High: 7, Low: 1},
+		// 128 bit with a zero low word
+		{High: 5},
+	}
+	for i, traceID := range traceIDs {
+		writeTestSpans(t, writer, testSpan(traceID, model.SpanID(i+1), "frontend", "GET /", time.Now()))
+	}
+	for i, traceID := range traceIDs {
+		trace, err := reader.GetTrace(context.Background(), traceID)
+		if err != nil {
+			t.Errorf("GetTrace(%s): %v", traceID, err)
+			continue
+		}
+		if len(trace.Spans) != 1 || trace.Spans[0].TraceID != traceID || trace.Spans[0].SpanID != model.SpanID(i+1) {
+			t.Errorf("GetTrace(%s) = %v, want only span %d", traceID, trace.Spans, i+1)
+		}
+	}
+}
+
+// joinedServiceSearchQuery is the search of a service and operation joining
+// spans to their names, the form the search by resolved ids replaced
+const joinedServiceSearchQuery = `SELECT span.trace_id_low AS low, span.trace_id_high AS high FROM spans AS span
+JOIN services AS service ON service.id = span.service_id
+JOIN operations AS operation ON operation.id = span.operation_id
+WHERE service.service_name = ? AND operation.operation_name = ? AND span.start_time >= ? AND span.start_time < ?
+GROUP BY span.trace_id_low, span.trace_id_high
+ORDER BY max(span.start_time) DESC LIMIT 20`
+
+// BenchmarkFindTraceIDsByServiceAndOperation searches one operation of one
+// of 10 services of 10 operations each, with the ids resolved first and with
+// the names joined
+func BenchmarkFindTraceIDsByServiceAndOperation(b *testing.B) {
+	db, done := newTestDB(b)
+	defer done()
+	if _, err := db.Exec(`
+INSERT INTO services (id, service_name) SELECT s, 'service-' || s FROM generate_series(1, 10) AS s;
+INSERT INTO operations (id, service_id, operation_name, span_kind)
+	SELECT (s - 1) * 10 + o, s, 'operation-' || o, '' FROM generate_series(1, 10) AS s, generate_series(1, 10) AS o;
+INSERT INTO spans (id, trace_id_low, trace_id_high, operation_id, flags, start_time, duration, service_id, process_id)
+	SELECT 1, i, 0, i % 100 + 1, 0, now() - i * interval '1 second', 1000, i % 100 / 10 + 1, ''
+	FROM generate_series(1, ?) AS i;
+ANALYZE;
+`, benchmarkTraces); err != nil {
+		b.Fatal(err)
+	}
+	reader := NewReader(db, hclog.NewNullLogger())
+	start, end := time.Now().Add(-24*time.Hour), time.Now()
+	query := &spanstore.TraceQueryParameters{ServiceName: "service-5", OperationName: "operation-3", NumTraces: 20,
+		StartTimeMin: start, StartTimeMax: end}
+
+	b.Run("ResolvedIDs", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if ids, err := reader.FindTraceIDs(context.Background(), query); err != nil || len(ids) != 20 {
+				b.Fatalf("FindTraceIDs() = %d traces, %v, want 20", len(ids), err)
+			}
+		}
+	})
+	b.Run("Joined", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var ids []model.TraceID
+			if _, err := db.Query(&ids, joinedServiceSearchQuery, query.ServiceName, query.OperationName, start, end); err != nil || len(ids) != 20 {
+				b.Fatalf("joined search = %d traces, %v, want 20", len(ids), err)
+			}
+		}
+	})
+}
+
+func TestGetTraceLogsOfCollidingSpanIDs(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	start := time.Now().Add(-time.Minute)
+	// the same span id in two traces
+	for _, trace := range []uint64{1, 2} {
+		span := testSpan(model.TraceID{Low: trace}, 7, "frontend", "GET /", start)
+		span.Logs = []model.Log{{Timestamp: start, Fields: []model.KeyValue{model.Int64("trace", int64(trace))}}}
+		writeTestSpans(t, writer, span)
+	}
+
+	for _, trace := range []uint64{1, 2} {
+		got, err := reader.GetTrace(context.Background(), model.TraceID{Low: trace})
+		if err != nil {
+			t.Fatal(err)
+		}
+		logs := got.Spans[0].Logs
+		if len(logs) != 1 || logs[0].Fields[0].Int64() != int64(trace) {
+			t.Errorf("span of trace %d has the logs %v, want only its own", trace, logs)
+		}
+	}
+
+	found := findTraceIDs(t, reader, &spanstore.TraceQueryParameters{ServiceName: "frontend",
+		Tags: map[string]string{"log.trace": "2"}, StartTimeMin: start.Add(-time.Minute), StartTimeMax: start.Add(time.Minute)})
+	if !reflect.DeepEqual(found, []uint64{2}) {
+		t.Errorf("log search found traces %v, want 2", found)
+	}
+}
+
+func TestGetTraceRefsOfCollidingSpanIDs(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	start := time.Now().Add(-time.Minute)
+	// the same span id in two traces, each a child of another parent
+	for _, trace := range []uint64{1, 2} {
+		traceID := model.TraceID{Low: trace}
+		span := testSpan(traceID, 7, "frontend", "GET /", start)
+		span.References = []model.SpanRef{model.NewChildOfRef(traceID, model.SpanID(trace))}
+		writeTestSpans(t, writer, span)
+	}
+
+	for _, trace := range []uint64{1, 2} {
+		got, err := reader.GetTrace(context.Background(), model.TraceID{Low: trace})
+		if err != nil {
+			t.Fatal(err)
+		}
+		refs := got.Spans[0].References
+		if len(refs) != 1 || refs[0].TraceID.Low != trace || refs[0].SpanID != model.SpanID(trace) {
+			t.Errorf("span of trace %d has the references %v, want only its own", trace, refs)
+		}
+	}
+}
+
+func TestGetTraceRefsIntoAnotherTrace(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger(), WithConfiguration(&Configuration{DefaultNumTraces: 10}))
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	// a consumer following from the producer of another trace
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	producer, consumer := model.TraceID{Low: 1}, model.TraceID{Low: 2}
+	writeTestSpans(t, writer, testSpan(producer, 1, "producer", "send", start), testSpan(consumer, 2, "consumer", "receive", start))
+	span := testSpan(consumer, 3, "consumer", "handle", start.Add(time.Millisecond))
+	span.References = []model.SpanRef{model.NewChildOfRef(consumer, 2), model.NewFollowsFromRef(producer, 1)}
+	writeTestSpans(t, writer, span)
+
+	assertRefs := func(call string, trace *model.Trace) {
+		t.Helper()
+		for _, got := range trace.Spans {
+			if got.SpanID == span.SpanID && !reflect.DeepEqual(got.References, span.References) {
+				t.Errorf("%s: span %s has the references %v, want %v", call, got.SpanID, got.References, span.References)
+			}
+		}
+	}
+	trace, err := reader.GetTrace(context.Background(), consumer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRefs("GetTrace()", trace)
+	traces, err := reader.FindTraces(context.Background(), &spanstore.TraceQueryParameters{ServiceName: "consumer",
+		StartTimeMin: start.Add(-time.Minute), StartTimeMax: start.Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traces) != 1 {
+		t.Fatalf("FindTraces() found %d traces, want the consumer one", len(traces))
+	}
+	assertRefs("FindTraces()", traces[0])
+
+	// the refs of the kept span aren't orphans
+	if _, err := NewMaintenance(db, &Configuration{}, hclog.NewNullLogger()).Purge(context.Background(), start.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	trace, err = reader.GetTrace(context.Background(), consumer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertRefs("GetTrace() after Purge()", trace)
+}
+
+func TestFindTracesProcessMapPerTrace(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	// the ProcessIDs are only unique within a trace
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	for trace := uint64(1); trace <= 2; trace++ {
+		for i, service := range []string{"frontend", "frontend", "backend"} {
+			span := testSpan(model.TraceID{Low: trace}, model.SpanID(i+1), service, "GET /", start.Add(time.Duration(trace)*time.Millisecond))
+			span.ProcessID = service
+			writeTestSpans(t, writer, span)
+		}
+	}
+
+	traces, err := reader.FindTraces(context.Background(), &spanstore.TraceQueryParameters{ServiceName: "frontend",
+		StartTimeMin: start.Add(-time.Minute), StartTimeMax: start.Add(time.Minute), NumTraces: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traces) != 2 {
+		t.Fatalf("FindTraces() found %d traces, want 2", len(traces))
+	}
+	for _, trace := range traces {
+		if len(trace.Spans) != 3 || len(trace.ProcessMap) != 2 {
+			t.Errorf("trace %s has %d spans and the processes %v, want 3 spans of 2 processes",
+				trace.Spans[0].TraceID, len(trace.Spans), trace.ProcessMap)
+		}
+	}
+}
+
+func TestGetTraceNotFound(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+
+	trace, err := reader.GetTrace(context.Background(), model.TraceID{Low: 42})
+	if !errors.Is(err, spanstore.ErrTraceNotFound) {
+		t.Fatalf("GetTrace() error = %v, want spanstore.ErrTraceNotFound", err)
+	}
+	if trace != nil {
+		t.Errorf("GetTrace() = %v, want nil", trace)
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger(), WithConfiguration(&Configuration{QueryTimeout: 200 * time.Millisecond}))
+
+	ctx, cancel := reader.withQueryTimeout(context.Background())
+	defer cancel()
+	started := time.Now()
+	if _, err := db.ExecContext(ctx, "SELECT pg_sleep(5)"); err == nil {
+		t.Error("pg_sleep(5) outlived the QueryTimeout")
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("pg_sleep(5) stopped after %s, want the QueryTimeout", elapsed)
+	}
+
+	// a Reader call waiting for a lock gives up too
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec("LOCK TABLE services IN ACCESS EXCLUSIVE MODE"); err != nil {
+		t.Fatal(err)
+	}
+	started = time.Now()
+	_, err = reader.GetServices(context.Background())
+	if err == nil {
+		t.Fatal("GetServices() on a locked table succeeded")
+	}
+	if !strings.HasPrefix(err.Error(), "pgstore: GetServices: ") {
+		t.Errorf("GetServices() = %q, want the error to name the operation", err)
+	}
+	if elapsed := time.Since(started); elapsed > 2*time.Second {
+		t.Errorf("GetServices() returned after %s, want the QueryTimeout", elapsed)
+	}
+}
+
+func TestReaderPingServer(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	if err := NewReader(db, hclog.NewNullLogger()).Ping(context.Background()); err != nil {
+		t.Errorf("Ping() = %v", err)
+	}
+}
+
+func TestFindTraceIDsByProcessTag(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	onHost2 := testSpan(model.TraceID{Low: 2}, 2, "frontend", "GET /", start)
+	onHost2.Process = model.NewProcess("frontend", []model.KeyValue{model.String("hostname", "host-2")})
+	// a span tag of the same key, on a process of host-1
+	tagged := testSpan(model.TraceID{Low: 3}, 3, "frontend", "GET /", start)
+	tagged.Tags = []model.KeyValue{model.String("hostname", "host-2")}
+	writeTestSpans(t, writer, testSpan(model.TraceID{Low: 1}, 1, "frontend", "GET /", start), onHost2, tagged)
+
+	tests := []struct {
+		host string
+		want []uint64
+	}{
+		{host: "host-1", want: []uint64{1, 3}},
+		{host: "host-2", want: []uint64{2, 3}},
+		{host: "host-3", want: []uint64{}},
+	}
+	for _, tt := range tests {
+		query := &spanstore.TraceQueryParameters{ServiceName: "frontend", Tags: map[string]string{"hostname": tt.host},
+			StartTimeMin: start.Add(-time.Minute), StartTimeMax: start.Add(time.Minute)}
+		if got := findTraceIDs(t, reader, query); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("traces on %s = %v, want %v", tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestGetTraces(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	for trace := uint64(1); trace <= 3; trace++ {
+		traceID := model.TraceID{Low: trace}
+		writeTestSpans(t, writer, testSpan(traceID, model.SpanID(2*trace-1), "frontend", "GET /", start),
+			testSpan(traceID, model.SpanID(2*trace), "backend", "query", start))
+	}
+
+	ids := []model.TraceID{{Low: 3}, {Low: 9}, {Low: 1}}
+	traces, err := reader.GetTraces(context.Background(), ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []model.TraceID
+	for _, trace := range traces {
+		got = append(got, trace.Spans[0].TraceID)
+		if len(trace.Spans) != 2 {
+			t.Errorf("trace %s has %d spans, want 2", trace.Spans[0].TraceID, len(trace.Spans))
+		}
+	}
+	if want := []model.TraceID{{Low: 3}, {Low: 1}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetTraces(%v) = %v, want %v in the order asked without the missing one", ids, got, want)
+	}
+
+	if traces, err := reader.GetTraces(context.Background(), nil); err != nil || len(traces) != 0 {
+		t.Errorf("GetTraces(nil) = %v, %v, want no trace", traces, err)
+	}
+}
+
+func TestStreamTraces(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	// trace 1 is the newest
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	for trace := uint64(1); trace <= 3; trace++ {
+		writeTestSpans(t, writer, testSpan(model.TraceID{Low: trace}, 1, "frontend", "GET /", start.Add(-time.Duration(trace)*time.Second)))
+	}
+	query := &spanstore.TraceQueryParameters{ServiceName: "frontend", NumTraces: 10,
+		StartTimeMin: start.Add(-time.Minute), StartTimeMax: start.Add(time.Minute)}
+
+	var streamed []uint64
+	err := reader.StreamTraces(context.Background(), query, func(trace *model.Trace) error {
+		streamed = append(streamed, trace.Spans[0].TraceID.Low)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint64{1, 2, 3}; !reflect.DeepEqual(streamed, want) {
+		t.Errorf("streamed %v, want %v", streamed, want)
+	}
+
+	errStop := errors.New("stop")
+	streamed = nil
+	err = reader.StreamTraces(context.Background(), query, func(trace *model.Trace) error {
+		streamed = append(streamed, trace.Spans[0].TraceID.Low)
+		return errStop
+	})
+	if err != errStop || len(streamed) != 1 {
+		t.Errorf("StreamTraces() = %v after %v, want the error of the first callback", err, streamed)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	streamed = nil
+	err = reader.StreamTraces(ctx, query, func(trace *model.Trace) error {
+		streamed = append(streamed, trace.Spans[0].TraceID.Low)
+		cancel()
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) || len(streamed) != 1 {
+		t.Errorf("StreamTraces() = %v after %v, want canceled after the first trace", err, streamed)
+	}
+}
+
+func TestFindTracesByKind(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	span := func(trace uint64, id model.SpanID, kind string, parent model.SpanID) *model.Span {
+		traceID := model.TraceID{Low: trace}
+		span := testSpan(traceID, id, "frontend", "GET /", start)
+		span.Tags = []model.KeyValue{model.String("span.kind", kind)}
+		if parent > 0 {
+			span.References = []model.SpanRef{model.NewChildOfRef(traceID, parent)}
+		}
+		return span
+	}
+	// a root server span, a root client span and a server span called by a
+	// gateway
+	gateway := testSpan(model.TraceID{Low: 3}, 3, "gateway", "GET /", start)
+	writeTestSpans(t, writer, span(1, 1, "server", 0), span(2, 2, "client", 0), gateway, span(3, 4, "server", 3))
+
+	tests := []struct {
+		name   string
+		filter TraceKindFilter
+		want   []uint64
+	}{
+		{name: "server spans", filter: TraceKindFilter{SpanKind: "server"}, want: []uint64{1, 3}},
+		{name: "server roots", filter: TraceKindFilter{SpanKind: "server", RootOnly: true}, want: []uint64{1}},
+		{name: "roots", filter: TraceKindFilter{RootOnly: true}, want: []uint64{1, 2}},
+		{name: "consumer spans", filter: TraceKindFilter{SpanKind: "consumer"}, want: []uint64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			traces, err := reader.FindTracesByKind(context.Background(), &spanstore.TraceQueryParameters{ServiceName: "frontend",
+				StartTimeMin: start.Add(-time.Minute), StartTimeMax: start.Add(time.Minute)}, tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]uint64, 0, len(traces))
+			for _, trace := range traces {
+				got = append(got, trace.Spans[0].TraceID.Low)
+			}
+			sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("found traces %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCountTraces(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	// 3 traces of 4 matching spans each, above NumTraces
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	for trace := uint64(1); trace <= 3; trace++ {
+		for i := uint64(1); i <= 4; i++ {
+			writeTestSpans(t, writer, testSpan(model.TraceID{Low: trace}, model.SpanID(4*trace+i), "frontend", "GET /", start))
+		}
+	}
+	writeTestSpans(t, writer, testSpan(model.TraceID{Low: 4}, 1, "backend", "query", start))
+
+	count, err := reader.CountTraces(context.Background(), &spanstore.TraceQueryParameters{ServiceName: "frontend", NumTraces: 1,
+		StartTimeMin: start.Add(-time.Minute), StartTimeMax: start.Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 3 {
+		t.Errorf("CountTraces() = %d, want the 3 traces rather than their spans", count)
+	}
+
+	count, err = reader.CountTraces(context.Background(), &spanstore.TraceQueryParameters{ServiceName: "unknown",
+		StartTimeMin: start.Add(-time.Minute), StartTimeMax: start.Add(time.Minute)})
+	if err != nil || count != 0 {
+		t.Errorf("CountTraces() of an unknown service = %d, %v, want 0", count, err)
+	}
+}
+
+func TestFindTraceIDsCaseInsensitiveNames(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	writeTestSpans(t, writer, testSpan(model.TraceID{Low: 1}, 1, "Frontend", "GET /Checkout", start))
+	query := func(service, operation string) *spanstore.TraceQueryParameters {
+		return &spanstore.TraceQueryParameters{ServiceName: service, OperationName: operation,
+			StartTimeMin: start.Add(-time.Minute), StartTimeMax: start.Add(time.Minute)}
+	}
+
+	insensitive := NewReader(db, hclog.NewNullLogger(), WithConfiguration(&Configuration{CaseInsensitiveNames: true}))
+	for _, names := range [][2]string{{"frontend", ""}, {"FRONTEND", "get /checkout"}, {"Frontend", "GET /Checkout"}} {
+		if got := findTraceIDs(t, insensitive, query(names[0], names[1])); !reflect.DeepEqual(got, []uint64{1}) {
+			t.Errorf("traces of %s %s = %v, want 1", names[0], names[1], got)
+		}
+	}
+	if got := findTraceIDs(t, insensitive, query("frontend", "GET /home")); len(got) != 0 {
+		t.Errorf("traces of another operation = %v, want none", got)
+	}
+
+	sensitive := NewReader(db, hclog.NewNullLogger())
+	if got := findTraceIDs(t, sensitive, query("frontend", "get /checkout")); len(got) != 0 {
+		t.Errorf("traces of differently cased names = %v, want none by default", got)
+	}
+}
+
+func TestGetTraceMaxSpansPerTrace(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger(), WithConfiguration(&Configuration{MaxSpansPerTrace: 100}))
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	traceID := model.TraceID{Low: 1}
+	start := time.Now().Add(-time.Minute)
+	for i := 1; i <= 1000; i++ {
+		span := testSpan(traceID, model.SpanID(i), "frontend", "GET /", start)
+		span.Duration = time.Duration(i) * time.Microsecond
+		if i > 1 {
+			span.References = []model.SpanRef{model.NewChildOfRef(traceID, 1)}
+		}
+		writeTestSpans(t, writer, span)
+	}
+
+	trace, err := reader.GetTrace(context.Background(), traceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trace.Spans) != 100 {
+		t.Fatalf("GetTrace() returned %d spans, want 100", len(trace.Spans))
+	}
+	truncated := 0
+	for _, span := range trace.Spans {
+		if span.SpanID == 1 && len(span.Warnings) == 1 {
+			truncated++
+		} else if len(span.Warnings) > 0 {
+			t.Errorf("span %s has the warnings %v", span.SpanID, span.Warnings)
+		}
+	}
+	if truncated != 1 {
+		t.Errorf("the root of the trace has no truncation warning")
+	}
+}
+
+// keyLookupTagQuery is the tag search extracting the value of the key, the
+// form the GIN containment search replaced
+const keyLookupTagQuery = `SELECT trace_id_low AS low, trace_id_high AS high FROM spans
+WHERE (tags->>? = ? OR process_tags->>? = ?) AND start_time >= ? AND start_time < ?
+GROUP BY trace_id_low, trace_id_high
+ORDER BY max(start_time) DESC LIMIT 20`
+
+// BenchmarkTagSearch searches a tag value 1 in 100 of benchmarkTraces spans
+// carry by containment, served by the GIN indexes, and by key lookup
+func BenchmarkTagSearch(b *testing.B) {
+	db, done := newTestDB(b)
+	defer done()
+	if _, err := db.Exec(`
+INSERT INTO services (id, service_name) VALUES (1, 'frontend');
+INSERT INTO operations (id, service_id, operation_name, span_kind) VALUES (1, 1, 'GET /', '');
+INSERT INTO spans (id, trace_id_low, trace_id_high, operation_id, flags, start_time, duration, service_id, process_id, tags, process_tags)
+	SELECT 1, i, 0, 1, 0, now() - i * interval '1 second', 1000, 1, '',
+		jsonb_build_object('http.status_code', CASE WHEN i % 100 = 0 THEN '500' ELSE '200' END),
+		jsonb_build_object('hostname', 'host-' || i % 10)
+	FROM generate_series(1, ?) AS i;
+ANALYZE;
+`, benchmarkTraces); err != nil {
+		b.Fatal(err)
+	}
+	reader := NewReader(db, hclog.NewNullLogger())
+	start, end := time.Now().Add(-24*time.Hour), time.Now()
+	query := &spanstore.TraceQueryParameters{Tags: map[string]string{"http.status_code": "500"}, NumTraces: 20,
+		StartTimeMin: start, StartTimeMax: end}
+
+	b.Run("Containment", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if ids, err := reader.FindTraceIDs(context.Background(), query); err != nil || len(ids) != 20 {
+				b.Fatalf("FindTraceIDs() = %d traces, %v, want 20", len(ids), err)
+			}
+		}
+	})
+	b.Run("KeyLookup", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var ids []model.TraceID
+			if _, err := db.Query(&ids, keyLookupTagQuery, "http.status_code", "500", "http.status_code", "500", start, end); err != nil || len(ids) != 20 {
+				b.Fatalf("key lookup = %d traces, %v, want 20", len(ids), err)
+			}
+		}
+	})
+}
+
+func TestFindTraceIDsByError(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	span := func(trace uint64, tags ...model.KeyValue) *model.Span {
+		span := testSpan(model.TraceID{Low: trace}, model.SpanID(trace), "frontend", "GET /", start)
+		span.Tags = tags
+		return span
+	}
+	writeTestSpans(t, writer,
+		span(1, model.Bool("error", true)),
+		span(2, model.String("otel.status_code", "ERROR")),
+		span(3, model.String("otel.status_code", "OK")),
+		span(4))
+
+	query := &spanstore.TraceQueryParameters{ServiceName: "frontend", Tags: map[string]string{"error": "true"},
+		StartTimeMin: start.Add(-time.Minute), StartTimeMax: start.Add(time.Minute)}
+	if got := findTraceIDs(t, reader, query); !reflect.DeepEqual(got, []uint64{1, 2}) {
+		t.Errorf("traces with an error = %v, want 1 and 2", got)
+	}
+	flagged, err := db.Model((*Span)(nil)).Where("has_error").Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flagged != 2 {
+		t.Errorf("%d spans stored with has_error, want 2", flagged)
+	}
+}
+
+func TestGetOperationMetrics(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	// GET / lasting 1ms to 100ms, POST / once and a span older than the window
+	start := time.Now().Add(-time.Minute)
+	for i := 1; i <= 100; i++ {
+		span := testSpan(model.TraceID{Low: uint64(i)}, model.SpanID(i), "frontend", "GET /", start)
+		span.Duration = time.Duration(i) * time.Millisecond
+		writeTestSpans(t, writer, span)
+	}
+	writeTestSpans(t, writer, testSpan(model.TraceID{Low: 101}, 101, "frontend", "POST /", start),
+		testSpan(model.TraceID{Low: 102}, 102, "frontend", "GET /", start.Add(-2*time.Hour)))
+
+	metrics, err := reader.GetOperationMetrics(context.Background(), "frontend", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 2 || metrics[0].Operation != "GET /" || metrics[1].Operation != "POST /" {
+		t.Fatalf("GetOperationMetrics() = %v, want GET / and POST /", metrics)
+	}
+	get := metrics[0]
+	if get.Count != 100 {
+		t.Errorf("GET / counted %d spans, want the 100 within the window", get.Count)
+	}
+	// interpolated between the stored durations
+	if diff := get.P50 - 50500*time.Microsecond; diff < -time.Microsecond || diff > time.Microsecond {
+		t.Errorf("P50 = %s, want 50.5ms", get.P50)
+	}
+	if !(get.P50 < get.P95 && get.P95 < get.P99 && get.P99 <= 100*time.Millisecond) {
+		t.Errorf("quantiles %s, %s, %s don't ascend within the durations", get.P50, get.P95, get.P99)
+	}
+	if post := metrics[1]; post.Count != 1 || post.P50 != time.Millisecond || post.P99 != time.Millisecond {
+		t.Errorf("POST / metrics = %+v, want its single span", post)
+	}
+
+	if metrics, err := reader.GetOperationMetrics(context.Background(), "unknown", time.Hour); err != nil || len(metrics) != 0 {
+		t.Errorf("GetOperationMetrics() of an unknown service = %v, %v, want none", metrics, err)
+	}
+}
+
+func TestGetRecentTracesCollidingSpans(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	// trace 3 fills all of a page but its last span, which is the one
+	// of trace 2 which shares its start time and span id with the one of
+	// trace 1 starting the next page
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	for id := 1; id < recentSpansPage; id++ {
+		writeTestSpans(t, writer, testSpan(model.TraceID{Low: 3}, model.SpanID(id), "frontend", "GET /", start.Add(-time.Duration(id)*time.Microsecond)))
+	}
+	collision := start.Add(-time.Second)
+	writeTestSpans(t, writer,
+		testSpan(model.TraceID{Low: 2}, 7, "backend", "query", collision),
+		testSpan(model.TraceID{Low: 1}, 7, "payments", "charge", collision))
+
+	ids, err := reader.GetRecentTraces(context.Background(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []model.TraceID{{Low: 3}, {Low: 2}, {Low: 1}}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("GetRecentTraces(10) = %v, want %v", ids, want)
+	}
+}
+
+func TestGetTrace64BitIDs(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	// the words above math.MaxInt64 are stored as negative bigints
+	traceID := model.TraceID{High: 0xfedcba9876543210, Low: 0x8000000000000001}
+	spanID := model.SpanID(0xffffffffffffffff)
+	writeTestSpans(t, writer, testSpan(traceID, spanID, "frontend", "GET /", time.Now()))
+	trace, err := reader.GetTrace(context.Background(), traceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trace.Spans) != 1 || trace.Spans[0].TraceID != traceID || trace.Spans[0].SpanID != spanID {
+		t.Errorf("GetTrace(%s) = %v, want span %s", traceID, trace.Spans, spanID)
+	}
+
+	// a 64 bit id reads the same with or without its zero high word
+	writeTestSpans(t, writer, testSpan(model.TraceID{Low: 0xabc}, 1, "frontend", "GET /", time.Now()))
+	for _, hex := range []string{"abc", "0000000000000abc", "00000000000000000000000000000abc"} {
+		id, err := model.TraceIDFromString(hex)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if trace, err := reader.GetTrace(context.Background(), id); err != nil || len(trace.Spans) != 1 {
+			t.Errorf("GetTrace(%s) = %v, want the 64 bit trace", hex, err)
+		}
+	}
+
+	// and the searches find them unchanged
+	highBit := model.TraceID{Low: 0xffffffffffffff00}
+	writeTestSpans(t, writer, testSpan(highBit, 1, "frontend", "GET /", time.Now()))
+	query := &spanstore.TraceQueryParameters{ServiceName: "frontend", NumTraces: 10,
+		StartTimeMin: time.Now().Add(-time.Hour), StartTimeMax: time.Now().Add(time.Hour)}
+	want := map[model.TraceID]bool{traceID: true, {Low: 0xabc}: true, highBit: true}
+	ids, err := reader.FindTraceIDs(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[model.TraceID]bool)
+	for _, id := range ids {
+		found[id] = true
+	}
+	if len(ids) != len(want) || !reflect.DeepEqual(found, want) {
+		t.Errorf("FindTraceIDs() = %v, want %v", ids, want)
+	}
+	traces, err := reader.FindTraces(context.Background(), query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found = make(map[model.TraceID]bool)
+	for _, trace := range traces {
+		found[trace.Spans[0].TraceID] = true
+	}
+	if len(traces) != len(want) || !reflect.DeepEqual(found, want) {
+		t.Errorf("FindTraces() found the traces %v, want %v", found, want)
+	}
+}
+
+func TestFindTracesRequireRootSpan(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger(), WithConfiguration(&Configuration{RequireRootSpan: true}))
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	orphan := testSpan(model.TraceID{Low: 2}, 2, "frontend", "GET /", start)
+	orphan.References = []model.SpanRef{model.NewChildOfRef(model.TraceID{Low: 2}, 1)}
+	writeTestSpans(t, writer, testSpan(model.TraceID{Low: 1}, 1, "frontend", "GET /", start), orphan)
+
+	traces, err := reader.FindTraces(context.Background(), &spanstore.TraceQueryParameters{ServiceName: "frontend",
+		StartTimeMin: start.Add(-time.Minute), StartTimeMax: start.Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traces) != 1 || traces[0].Spans[0].TraceID.Low != 1 {
+		t.Errorf("FindTraces() = %v, want the trace with its root only", traces)
+	}
+}
+
+func TestFindTracesBySpanCount(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	// trace n has n spans, all of them but the first of another service. The
+	// span ids differ across the traces, the spans start at the same time.
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	for trace := uint64(1); trace <= 3; trace++ {
+		first := model.SpanID(trace * 10)
+		writeTestSpans(t, writer, testSpan(model.TraceID{Low: trace}, first, "frontend", "GET /", start))
+		for id := first + 1; id < first+model.SpanID(trace); id++ {
+			writeTestSpans(t, writer, testSpan(model.TraceID{Low: trace}, id, "backend", "query", start))
+		}
+	}
+
+	tests := []struct {
+		name   string
+		filter TraceKindFilter
+		want   []uint64
+	}{
+		{name: "MinSpans", filter: TraceKindFilter{MinSpans: 2}, want: []uint64{2, 3}},
+		{name: "MaxSpans", filter: TraceKindFilter{MaxSpans: 2}, want: []uint64{1, 2}},
+		{name: "both", filter: TraceKindFilter{MinSpans: 2, MaxSpans: 2}, want: []uint64{2}},
+		{name: "above every trace", filter: TraceKindFilter{MinSpans: 4}, want: []uint64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			traces, err := reader.FindTracesByKind(context.Background(), &spanstore.TraceQueryParameters{ServiceName: "frontend",
+				StartTimeMin: start.Add(-time.Minute), StartTimeMax: start.Add(time.Minute)}, tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]uint64, 0, len(traces))
+			for _, trace := range traces {
+				got = append(got, trace.Spans[0].TraceID.Low)
+			}
+			sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("found traces %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetServicesLookback(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	now := time.Now()
+	writeTestSpans(t, writer,
+		testSpan(model.TraceID{Low: 1}, 1, "frontend", "GET /", now.Add(-time.Minute)),
+		testSpan(model.TraceID{Low: 2}, 1, "legacy", "GET /", now.Add(-48*time.Hour)))
+
+	for lookback, want := range map[time.Duration][]string{0: {"frontend", "legacy"}, 24 * time.Hour: {"frontend"}} {
+		reader := NewReader(db, hclog.NewNullLogger(), WithConfiguration(&Configuration{ServiceLookback: lookback}))
+		services, err := reader.GetServices(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(services, want) {
+			t.Errorf("GetServices() with the lookback %s = %v, want %v", lookback, services, want)
+		}
+	}
+}
+
+func TestFindTraceIDsLimitCountsTraces(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	// trace 1 has the 5 newest spans, traces 2 and 3 one span each
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	for id := model.SpanID(1); id <= 5; id++ {
+		writeTestSpans(t, writer, testSpan(model.TraceID{Low: 1}, id, "frontend", "GET /", start.Add(-time.Duration(id)*time.Millisecond)))
+	}
+	writeTestSpans(t, writer,
+		testSpan(model.TraceID{Low: 2}, 1, "frontend", "GET /", start.Add(-time.Second)),
+		testSpan(model.TraceID{Low: 3}, 1, "frontend", "GET /", start.Add(-2*time.Second)))
+	query := &spanstore.TraceQueryParameters{ServiceName: "frontend", NumTraces: 2,
+		StartTimeMin: start.Add(-time.Minute), StartTimeMax: start.Add(time.Minute)}
+
+	// the ORM and the prepared searches share the order
+	for _, prepared := range []bool{false, true} {
+		reader := NewReader(db, hclog.NewNullLogger(), WithConfiguration(&Configuration{PrepareSearches: prepared}))
+		ids, err := reader.FindTraceIDs(context.Background(), query)
+		reader.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []model.TraceID{{Low: 1}, {Low: 2}}; !reflect.DeepEqual(ids, want) {
+			t.Errorf("FindTraceIDs() prepared %v = %v, want %v", prepared, ids, want)
+		}
+	}
+}
+
+func TestGetRecentTraces(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	// trace 1 fills more than a page of the newest spans, the older traces
+	// 2 and 3 are of other services
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	for id := 1; id <= recentSpansPage+100; id++ {
+		writeTestSpans(t, writer, testSpan(model.TraceID{Low: 1}, model.SpanID(id), "frontend", "GET /", start.Add(-time.Duration(id)*time.Microsecond)))
+	}
+	writeTestSpans(t, writer,
+		testSpan(model.TraceID{Low: 2}, 1, "backend", "query", start.Add(-time.Second)),
+		testSpan(model.TraceID{Low: 3}, 1, "payments", "charge", start.Add(-2*time.Second)))
+
+	tests := []struct {
+		limit int
+		want  []model.TraceID
+	}{
+		{limit: 1, want: []model.TraceID{{Low: 1}}},
+		{limit: 2, want: []model.TraceID{{Low: 1}, {Low: 2}}},
+		{limit: 10, want: []model.TraceID{{Low: 1}, {Low: 2}, {Low: 3}}},
+	}
+	for _, tt := range tests {
+		ids, err := reader.GetRecentTraces(context.Background(), tt.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ids, tt.want) {
+			t.Errorf("GetRecentTraces(%d) = %v, want %v", tt.limit, ids, tt.want)
+		}
+	}
+}
+
+func TestGetOperationsListedOnce(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	start := time.Now().Add(-time.Minute)
+	span := func(trace uint64, service, operation, kind string) *model.Span {
+		span := testSpan(model.TraceID{Low: trace}, model.SpanID(trace), service, operation, start)
+		if len(kind) > 0 {
+			span.Tags = []model.KeyValue{model.String("span.kind", kind)}
+		}
+		return span
+	}
+	writeTestSpans(t, writer,
+		span(1, "shop", "GET /", "server"), span(2, "store", "GET /", "server"),
+		span(3, "shop", "GET /", "client"), span(4, "payments", "GET /", "server"), span(5, "payments", "POST /", ""))
+	if err := writer.AddServiceAlias(context.Background(), "store", "shop"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		param spanstore.OperationQueryParameters
+		want  []spanstore.Operation
+	}{
+		{name: "service and its alias", param: spanstore.OperationQueryParameters{ServiceName: "shop"},
+			want: []spanstore.Operation{{Name: "GET /", SpanKind: "client"}, {Name: "GET /", SpanKind: "server"}}},
+		{name: "kind", param: spanstore.OperationQueryParameters{ServiceName: "shop", SpanKind: "server"},
+			want: []spanstore.Operation{{Name: "GET /", SpanKind: "server"}}},
+		{name: "every service", param: spanstore.OperationQueryParameters{},
+			want: []spanstore.Operation{{Name: "GET /", SpanKind: "client"}, {Name: "GET /", SpanKind: "server"}, {Name: "POST /"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := reader.GetOperations(context.Background(), tt.param)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetOperations(%+v) = %v, want %v", tt.param, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindTracesAnyOf(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	// trace 3 matches both queries, trace 4 none of them. The roots share
+	// their span id, they start at different times.
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	child := testSpan(model.TraceID{Low: 3}, 2, "payments", "charge", start.Add(time.Millisecond))
+	child.References = []model.SpanRef{model.NewChildOfRef(model.TraceID{Low: 3}, 1)}
+	writeTestSpans(t, writer,
+		testSpan(model.TraceID{Low: 1}, 1, "shop", "GET /", start.Add(-3*time.Second)),
+		testSpan(model.TraceID{Low: 2}, 1, "payments", "charge", start.Add(-2*time.Second)),
+		testSpan(model.TraceID{Low: 3}, 1, "shop", "GET /", start), child,
+		testSpan(model.TraceID{Low: 4}, 1, "payments", "refund", start.Add(-time.Second)))
+
+	query := func(service, operation string) *spanstore.TraceQueryParameters {
+		return &spanstore.TraceQueryParameters{ServiceName: service, OperationName: operation,
+			StartTimeMin: start.Add(-time.Minute), StartTimeMax: start.Add(time.Minute)}
+	}
+	tests := []struct {
+		name      string
+		numTraces int
+		queries   []*spanstore.TraceQueryParameters
+		want      []uint64
+	}{
+		{name: "any query", numTraces: 10, queries: []*spanstore.TraceQueryParameters{query("shop", ""), query("payments", "charge")},
+			want: []uint64{1, 2, 3}},
+		{name: "unknown service ignored", numTraces: 10, queries: []*spanstore.TraceQueryParameters{query("mail", ""), query("payments", "refund")},
+			want: []uint64{4}},
+		{name: "no query matching", numTraces: 10, queries: []*spanstore.TraceQueryParameters{query("mail", "")}, want: []uint64{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			traces, err := reader.FindTracesAnyOf(context.Background(), tt.numTraces, tt.queries...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := make([]uint64, 0, len(traces))
+			for _, trace := range traces {
+				got = append(got, trace.Spans[0].TraceID.Low)
+				if trace.Spans[0].TraceID.Low == 3 && len(trace.Spans) != 2 {
+					t.Errorf("trace 3 has %d spans, want both", len(trace.Spans))
+				}
+			}
+			sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("found traces %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	traces, err := reader.FindTracesAnyOf(context.Background(), 2, query("shop", ""), query("payments", ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traces) != 2 {
+		t.Errorf("FindTracesAnyOf() found %d traces, want the limit of 2", len(traces))
+	}
+}
+
+func TestEmptyNamesNotListed(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	logger, out := newBufferLogger(hclog.Debug)
+	reader := NewReader(db, logger)
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	writeTestSpans(t, writer,
+		testSpan(model.TraceID{Low: 1}, 1, "shop", "GET /", start),
+		testSpan(model.TraceID{Low: 2}, 2, "shop", "", start),
+		testSpan(model.TraceID{Low: 3}, 3, "", "GET /", start))
+
+	services, err := reader.GetServices(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(services, []string{"shop"}) {
+		t.Errorf("GetServices() = %q, want the empty name left out", services)
+	}
+	operations, err := reader.GetOperations(context.Background(), spanstore.OperationQueryParameters{ServiceName: "shop"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(operations, []spanstore.Operation{{Name: "GET /"}}) {
+		t.Errorf("GetOperations() = %v, want the empty name left out", operations)
+	}
+
+	for _, method := range []string{"GetServices", "GetOperations"} {
+		if !strings.Contains(out.String(), `"method":"`+method+`"`) {
+			t.Errorf("the empty name skipped by %s isn't logged: %s", method, out)
+		}
+	}
+}
+
+func TestFindTraceIDsNegatedTags(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	// trace 2 has a prod span beside its dev one, trace 4 has no env
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	span := func(trace uint64, id model.SpanID, env string) *model.Span {
+		span := testSpan(model.TraceID{Low: trace}, id, "shop", "GET /", start.Add(time.Duration(id)*time.Millisecond))
+		if len(env) > 0 {
+			span.Tags = []model.KeyValue{model.String("env", env)}
+		}
+		return span
+	}
+	writeTestSpans(t, writer, span(1, 1, "prod"), span(2, 1, "dev"), span(2, 2, "prod"), span(3, 1, "dev"), span(4, 1, ""),
+		span(5, 1, "!prod"))
+
+	tests := []struct {
+		value string
+		want  []uint64
+	}{
+		{value: "prod", want: []uint64{1, 2}},
+		{value: "!prod", want: []uint64{3, 4, 5}},
+		{value: "!", want: []uint64{4}},
+		{value: "!!prod", want: []uint64{5}},
+	}
+	for _, tt := range tests {
+		got := findTraceIDs(t, reader, &spanstore.TraceQueryParameters{ServiceName: "shop", Tags: map[string]string{"env": tt.value},
+			StartTimeMin: start.Add(-time.Minute), StartTimeMax: start.Add(time.Minute)})
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("env=%s found traces %v, want %v", tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestGetServicesOrder(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	// payments traced last, shop first
+	start := time.Now().Add(-time.Hour).Truncate(time.Microsecond)
+	writeTestSpans(t, writer,
+		testSpan(model.TraceID{Low: 1}, 1, "shop", "GET /", start),
+		testSpan(model.TraceID{Low: 2}, 1, "auth", "login", start.Add(time.Minute)),
+		testSpan(model.TraceID{Low: 3}, 1, "payments", "charge", start.Add(2*time.Minute)),
+		testSpan(model.TraceID{Low: 4}, 1, "auth", "login", start.Add(-time.Minute)))
+
+	tests := []struct {
+		order string
+		want  []string
+	}{
+		{order: "", want: []string{"auth", "payments", "shop"}},
+		{order: ServiceOrderName, want: []string{"auth", "payments", "shop"}},
+		{order: ServiceOrderRecent, want: []string{"payments", "auth", "shop"}},
+	}
+	for _, tt := range tests {
+		reader := NewReader(db, hclog.NewNullLogger(), WithConfiguration(&Configuration{ServiceOrder: tt.order}))
+		got, err := reader.GetServices(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("GetServices() ordered by %q = %v, want %v", tt.order, got, tt.want)
+		}
+	}
+}
+
+func TestFindTracesByTraceIDTag(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger(), WithConfiguration(&Configuration{MaxSpansPerTrace: 3}))
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	traceID := model.TraceID{High: 1, Low: 2}
+	start := time.Now().Add(-2 * time.Hour)
+	for i := 1; i <= 5; i++ {
+		span := testSpan(traceID, model.SpanID(i), "frontend", "GET /", start.Add(time.Duration(i)*time.Millisecond))
+		if i > 1 {
+			span.References = []model.SpanRef{model.NewChildOfRef(traceID, 1)}
+		}
+		writeTestSpans(t, writer, span)
+	}
+
+	// the service and the window sent along don't match the trace
+	traces, err := reader.FindTraces(context.Background(), &spanstore.TraceQueryParameters{
+		ServiceName: "backend", Tags: map[string]string{"traceID": traceID.String()},
+		StartTimeMin: time.Now().Add(-time.Minute), StartTimeMax: time.Now(), NumTraces: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traces) != 1 || traces[0].Spans[0].TraceID != traceID {
+		t.Fatalf("FindTraces() by trace id = %v, want the trace %s", traces, traceID)
+	}
+	if len(traces[0].Spans) != 3 || len(traces[0].Spans[0].Warnings) != 1 {
+		t.Errorf("FindTraces() by trace id returned %d spans with the root warnings %v, want 3 and a truncation warning",
+			len(traces[0].Spans), traces[0].Spans[0].Warnings)
+	}
+}
+
+func TestFindTraceIDsByTagScope(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	// the region is a process tag of trace 1 and a span tag of trace 2,
+	// trace 3 has span.kind as a tag of its span
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	processRegion := testSpan(model.TraceID{Low: 1}, 1, "shop", "GET /", start)
+	processRegion.Process.Tags = append(processRegion.Process.Tags, model.String("region", "eu"))
+	spanRegion := testSpan(model.TraceID{Low: 2}, 1, "shop", "GET /", start)
+	spanRegion.Tags = []model.KeyValue{model.String("region", "eu")}
+	kind := testSpan(model.TraceID{Low: 3}, 1, "shop", "GET /", start)
+	kind.Tags = []model.KeyValue{model.String("span.kind", "server")}
+	writeTestSpans(t, writer, processRegion, spanRegion, kind)
+
+	tests := []struct {
+		key   string
+		value string
+		want  []uint64
+	}{
+		{key: "region", value: "eu", want: []uint64{1, 2}},
+		{key: "process.region", value: "eu", want: []uint64{1}},
+		{key: "span.region", value: "eu", want: []uint64{2}},
+		{key: "span.kind", value: "server", want: []uint64{3}},
+		{key: "process.kind", value: "server", want: []uint64{}},
+		{key: "process.hostname", value: "host-1", want: []uint64{1, 2, 3}},
+		{key: "span.hostname", value: "host-1", want: []uint64{}},
+	}
+	for _, tt := range tests {
+		got := findTraceIDs(t, reader, &spanstore.TraceQueryParameters{ServiceName: "shop", Tags: map[string]string{tt.key: tt.value},
+			StartTimeMin: start.Add(-time.Minute), StartTimeMax: start.Add(time.Minute)})
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s=%s found traces %v, want %v", tt.key, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestGetLatencyHistogram(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	// GET / spans on and between the bounds, a POST / span and a GET /
+	// span older than the window
+	start := time.Now().Add(-time.Minute)
+	durations := []time.Duration{500 * time.Microsecond, time.Millisecond, 1001 * time.Microsecond, 10 * time.Millisecond, time.Second}
+	for i, duration := range durations {
+		span := testSpan(model.TraceID{Low: uint64(i + 1)}, 1, "frontend", "GET /", start)
+		span.Duration = duration
+		writeTestSpans(t, writer, span)
+	}
+	writeTestSpans(t, writer, testSpan(model.TraceID{Low: 10}, 1, "frontend", "POST /", start),
+		testSpan(model.TraceID{Low: 11}, 1, "frontend", "GET /", start.Add(-2*time.Hour)))
+
+	buckets := []time.Duration{time.Millisecond, 10 * time.Millisecond}
+	tests := []struct {
+		operation string
+		want      []LatencyBucket
+	}{
+		{operation: "GET /", want: []LatencyBucket{{UpperBound: time.Millisecond, Count: 2}, {UpperBound: 10 * time.Millisecond, Count: 2}, {Count: 1}}},
+		{operation: "", want: []LatencyBucket{{UpperBound: time.Millisecond, Count: 3}, {UpperBound: 10 * time.Millisecond, Count: 2}, {Count: 1}}},
+		{operation: "DELETE /", want: []LatencyBucket{{UpperBound: time.Millisecond}, {UpperBound: 10 * time.Millisecond}, {}}},
+	}
+	for _, tt := range tests {
+		got, err := reader.GetLatencyHistogram(context.Background(), "frontend", tt.operation, time.Hour, buckets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("GetLatencyHistogram(%q) = %v, want %v", tt.operation, got, tt.want)
+		}
+	}
+
+	got, err := reader.GetLatencyHistogram(context.Background(), "frontend", "GET /", time.Hour, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, []LatencyBucket{{Count: 5}}) {
+		t.Errorf("GetLatencyHistogram() without bounds = %v, want a single bucket of the 5 spans", got)
+	}
+}
+
+func TestGetOperationMetricsServiceAliases(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	start := time.Now().Add(-time.Minute)
+	writeTestSpans(t, writer,
+		testSpan(model.TraceID{Low: 1}, 1, "shop", "GET /", start),
+		testSpan(model.TraceID{Low: 2}, 1, "store", "GET /", start),
+		testSpan(model.TraceID{Low: 3}, 1, "payments", "GET /", start))
+	if err := writer.AddServiceAlias(context.Background(), "store", "shop"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, service := range []string{"shop", "store"} {
+		metrics, err := reader.GetOperationMetrics(context.Background(), service, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(metrics) != 1 || metrics[0].Operation != "GET /" || metrics[0].Count != 2 {
+			t.Errorf("GetOperationMetrics(%s) = %v, want the spans of shop and store", service, metrics)
+		}
+	}
+}
+
+func TestGetTracesConcurrently(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger(), WithConfiguration(&Configuration{FindConcurrency: 3}))
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	for trace := uint64(1); trace <= 10; trace++ {
+		writeTestSpans(t, writer, testSpan(model.TraceID{Low: trace}, 1, "shop", "GET /", start))
+	}
+
+	// out of order, with an unknown trace among them
+	ids := []model.TraceID{{Low: 7}, {Low: 2}, {Low: 10}, {Low: 99}, {Low: 1}, {Low: 5}, {Low: 3}, {Low: 9}, {Low: 4}, {Low: 8}, {Low: 6}}
+	traces, err := reader.GetTraces(context.Background(), ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]uint64, 0, len(traces))
+	for _, trace := range traces {
+		got = append(got, trace.Spans[0].TraceID.Low)
+	}
+	if want := []uint64{7, 2, 10, 1, 5, 3, 9, 4, 8, 6}; !reflect.DeepEqual(got, want) {
+		t.Errorf("GetTraces() returned traces %v, want %v", got, want)
+	}
+}
+
+// BenchmarkGetTracesConcurrency loads 20 traces of benchmarkTraceSpans spans
+// out of benchmarkTraces with one statement and split among several
+func BenchmarkGetTracesConcurrency(b *testing.B) {
+	db, done := newTestDB(b)
+	defer done()
+	if _, err := db.Exec(`
+INSERT INTO services (id, service_name) VALUES (1, 'frontend');
+INSERT INTO operations (id, service_id, operation_name, span_kind) VALUES (1, 1, 'GET /', '');
+INSERT INTO spans (id, trace_id_low, trace_id_high, operation_id, flags, start_time, duration, service_id, process_id)
+	SELECT span, i, 0, 1, 0, now() - i * interval '1 second', 1000, 1, ''
+	FROM generate_series(1, ?) AS i, generate_series(1, ?) AS span;
+ANALYZE;
+`, benchmarkTraces, benchmarkTraceSpans); err != nil {
+		b.Fatal(err)
+	}
+	ids := make([]model.TraceID, 0, 20)
+	for trace := uint64(1); trace <= 20; trace++ {
+		ids = append(ids, model.TraceID{Low: trace})
+	}
+
+	for _, concurrency := range []int{1, 4} {
+		reader := NewReader(db, hclog.NewNullLogger(), WithConfiguration(&Configuration{FindConcurrency: concurrency}))
+		b.Run(fmt.Sprintf("FindConcurrency=%d", concurrency), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				traces, err := reader.GetTraces(context.Background(), ids)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(traces) != len(ids) {
+					b.Fatalf("loaded %d traces, want %d", len(traces), len(ids))
+				}
+			}
+		})
+	}
+}
+
+func TestFindTraceIDsByLogField(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	reader := NewReader(db, hclog.NewNullLogger())
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	// trace 3 has the event as a span tag rather than in a log
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	span := func(trace uint64, fields ...model.KeyValue) *model.Span {
+		span := testSpan(model.TraceID{Low: trace}, 1, "shop", "GET /", start)
+		if len(fields) > 0 {
+			span.Logs = []model.Log{{Timestamp: start, Fields: fields}}
+		}
+		return span
+	}
+	tagged := span(3)
+	tagged.Tags = []model.KeyValue{model.String("event", "cache_miss")}
+	writeTestSpans(t, writer, span(1, model.String("event", "cache_miss")), span(2, model.String("event", "cache_hit")), tagged,
+		span(4, model.Int64("retries", 3)))
+
+	tests := []struct {
+		key   string
+		value string
+		want  []uint64
+	}{
+		{key: "log.event", value: "cache_miss", want: []uint64{1}},
+		{key: "event", value: "cache_miss", want: []uint64{3}},
+		{key: "log.retries", value: "3", want: []uint64{4}},
+		{key: "log.event", value: "!cache_miss", want: []uint64{2, 3, 4}},
+		{key: "log.event", value: "!", want: []uint64{3, 4}},
+		{key: "log.cache_miss", value: "event", want: []uint64{}},
+	}
+	for _, tt := range tests {
+		got := findTraceIDs(t, reader, &spanstore.TraceQueryParameters{ServiceName: "shop", Tags: map[string]string{tt.key: tt.value},
+			StartTimeMin: start.Add(-time.Minute), StartTimeMax: start.Add(time.Minute)})
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s=%s found traces %v, want %v", tt.key, tt.value, got, tt.want)
+		}
+	}
+}
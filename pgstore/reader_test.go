@@ -0,0 +1,447 @@
+package pgstore
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+func TestSortTracesByLatestSpan(t *testing.T) {
+	start := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	trace := func(low uint64, starts ...time.Duration) *model.Trace {
+		trace := &model.Trace{}
+		for i, offset := range starts {
+			trace.Spans = append(trace.Spans, &model.Span{TraceID: model.TraceID{Low: low}, SpanID: model.SpanID(i + 1), StartTime: start.Add(offset)})
+		}
+		return trace
+	}
+	// 5 started before 4 but has the latest span. 2, 3 and 1<<63 tie and go
+	// by their ids compared as signed, the way the columns order them.
+	traces := []*model.Trace{trace(1, -4*time.Minute), trace(2, -time.Minute), trace(3, -time.Minute),
+		trace(4, 0), trace(5, -2*time.Minute, 30*time.Second), trace(1<<63, -time.Minute)}
+	want := []uint64{5, 4, 1 << 63, 2, 3, 1}
+	for i := 0; i < 10; i++ {
+		shuffled := append([]*model.Trace(nil), traces...)
+		rand.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+		sortTracesByLatestSpan(shuffled)
+		got := make([]uint64, 0, len(shuffled))
+		for _, trace := range shuffled {
+			got = append(got, trace.Spans[0].TraceID.Low)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("sortTracesByLatestSpan() = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestBuildTraceWhereBoundaries(t *testing.T) {
+	start := time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		query  spanstore.TraceQueryParameters
+		where  string
+		params []interface{}
+	}{
+		{
+			name:   "StartTimeMin is inclusive",
+			query:  spanstore.TraceQueryParameters{StartTimeMin: start},
+			where:  "start_time >= ?",
+			params: []interface{}{start},
+		},
+		{
+			name:   "StartTimeMax is exclusive",
+			query:  spanstore.TraceQueryParameters{StartTimeMax: start},
+			where:  "start_time < ?",
+			params: []interface{}{start},
+		},
+		{
+			name:   "DurationMin is inclusive",
+			query:  spanstore.TraceQueryParameters{DurationMin: time.Millisecond},
+			where:  "duration >= ?",
+			params: []interface{}{int64(1000)},
+		},
+		{
+			name:   "DurationMax is inclusive",
+			query:  spanstore.TraceQueryParameters{DurationMax: time.Millisecond},
+			where:  "duration <= ?",
+			params: []interface{}{int64(1000)},
+		},
+		{
+			name:   "sub-millisecond bounds keep their microseconds",
+			query:  spanstore.TraceQueryParameters{DurationMin: 500 * time.Microsecond, DurationMax: 1500 * time.Microsecond},
+			where:  "duration >= ? AND duration <= ?",
+			params: []interface{}{int64(500), int64(1500)},
+		},
+		{
+			name:   "nanoseconds below the stored precision are dropped",
+			query:  spanstore.TraceQueryParameters{DurationMin: 1500*time.Microsecond + 999},
+			where:  "duration >= ?",
+			params: []interface{}{int64(1500)},
+		},
+		{
+			name: "all bounds",
+			query: spanstore.TraceQueryParameters{
+				StartTimeMin: start,
+				StartTimeMax: start.Add(time.Hour),
+				DurationMin:  time.Millisecond,
+				DurationMax:  time.Second,
+			},
+			where:  "start_time >= ? AND start_time < ? AND duration >= ? AND duration <= ?",
+			params: []interface{}{start, start.Add(time.Hour), int64(1000), int64(1000000)},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			builder := buildTraceWhere(&tt.query, TagStorageJSONB)
+			if builder.where != tt.where {
+				t.Errorf("where = %q, want %q", builder.where, tt.where)
+			}
+			if !reflect.DeepEqual(builder.params, tt.params) {
+				t.Errorf("params = %v, want %v", builder.params, tt.params)
+			}
+		})
+	}
+}
+
+func TestBuildTraceWhereUnsetStartTime(t *testing.T) {
+	if builder := buildTraceWhere(&spanstore.TraceQueryParameters{}, TagStorageJSONB); len(builder.where) > 0 || len(builder.params) > 0 {
+		t.Errorf("zero bounds gave %q %v, want no predicate", builder.where, builder.params)
+	}
+
+	// the Unix epoch and earlier are still bounds
+	for _, early := range []time.Time{time.Unix(0, 0), time.Unix(-86400, 0), time.Date(1, 1, 1, 0, 0, 0, 1, time.UTC)} {
+		builder := buildTraceWhere(&spanstore.TraceQueryParameters{StartTimeMin: early, StartTimeMax: early}, TagStorageJSONB)
+		if want := "start_time >= ? AND start_time < ?"; builder.where != want {
+			t.Errorf("bounds at %s gave %q, want %q", early, builder.where, want)
+		}
+		if !reflect.DeepEqual(builder.params, []interface{}{early, early}) {
+			t.Errorf("bounds at %s gave params %v", early, builder.params)
+		}
+	}
+}
+
+func TestNumTraces(t *testing.T) {
+	tests := []struct {
+		name      string
+		conf      Configuration
+		requested int
+		want      int
+	}{
+		{name: "built-in default", requested: 0, want: 10},
+		{name: "configured default", conf: Configuration{DefaultNumTraces: 20}, requested: 0, want: 20},
+		{name: "negative takes the default", conf: Configuration{DefaultNumTraces: 20}, requested: -1, want: 20},
+		{name: "passthrough", conf: Configuration{DefaultNumTraces: 20, MaxNumTraces: 100}, requested: 50, want: 50},
+		{name: "the maximum itself", conf: Configuration{MaxNumTraces: 100}, requested: 100, want: 100},
+		{name: "clamped to the maximum", conf: Configuration{MaxNumTraces: 100}, requested: 1000, want: 100},
+		{name: "default clamped to the maximum", conf: Configuration{DefaultNumTraces: 200, MaxNumTraces: 100}, requested: 0, want: 100},
+		{name: "no maximum", requested: 1000, want: 1000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reader := &Reader{conf: tt.conf, logger: hclog.NewNullLogger()}
+			if got := reader.numTraces(tt.requested); got != tt.want {
+				t.Errorf("numTraces(%d) = %d, want %d", tt.requested, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWrapError(t *testing.T) {
+	if err := wrapError(nil, "GetTrace(%s)", model.TraceID{Low: 1}); err != nil {
+		t.Errorf("wrapError(nil) = %v, want nil", err)
+	}
+
+	err := wrapError(spanstore.ErrTraceNotFound, "GetTrace(%s)", model.TraceID{Low: 1})
+	if !errors.Is(err, spanstore.ErrTraceNotFound) {
+		t.Errorf("errors.Is(%v, spanstore.ErrTraceNotFound) = false", err)
+	}
+	if want := "pgstore: GetTrace(0000000000000001): trace not found"; err.Error() != want {
+		t.Errorf("wrapError() = %q, want %q", err, want)
+	}
+
+	var pgErr pg.Error
+	if errors.As(wrapError(errors.New("boom"), "GetServices"), &pgErr) {
+		t.Error("errors.As found a pg.Error in a plain error")
+	}
+}
+
+func TestWithQueryTimeout(t *testing.T) {
+	reader := &Reader{conf: Configuration{QueryTimeout: time.Hour}}
+	ctx, cancel := reader.withQueryTimeout(context.Background())
+	defer cancel()
+	if deadline, found := ctx.Deadline(); !found || time.Until(deadline) > time.Hour {
+		t.Errorf("deadline = %s, %v, want within the QueryTimeout", deadline, found)
+	}
+
+	// an earlier deadline of the caller still applies
+	early, cancelEarly := context.WithTimeout(context.Background(), time.Minute)
+	defer cancelEarly()
+	ctx, cancel = reader.withQueryTimeout(early)
+	defer cancel()
+	if deadline, _ := ctx.Deadline(); time.Until(deadline) > time.Minute {
+		t.Errorf("deadline = %s, want the one of the caller", deadline)
+	}
+
+	// none without a QueryTimeout
+	ctx, cancel = (&Reader{}).withQueryTimeout(context.Background())
+	defer cancel()
+	if deadline, found := ctx.Deadline(); found {
+		t.Errorf("deadline = %s without a QueryTimeout, want none", deadline)
+	}
+}
+
+func TestCapSpans(t *testing.T) {
+	// a root lasting 1µs and 999 children of it lasting 1µs to 999µs
+	spans := make([]Span, 1000)
+	for i := range spans {
+		spans[i] = Span{ID: int64(i + 1), Duration: int64(i)}
+		if i > 0 {
+			spans[i].SpanRefs = []*SpanRef{{SpanID: int64(i + 1), ChildSpanID: 1}}
+		}
+	}
+	spans[0].Duration = 1
+	// following from a span of another trace
+	spans[0].SpanRefs = []*SpanRef{{TraceIDLow: 2, SpanID: 1, ChildSpanID: 1, RefType: model.SpanRefType_FOLLOWS_FROM}}
+
+	capped := capSpans(spans, 100)
+	if len(capped) != 100 {
+		t.Fatalf("capSpans() kept %d spans, want 100", len(capped))
+	}
+	if capped[0].ID != 1 {
+		t.Errorf("capSpans() starts with span %d, want the root", capped[0].ID)
+	}
+	for i, span := range capped[1:] {
+		// the 99 longest children in their original order
+		if want := int64(902 + i); span.ID != want {
+			t.Errorf("capSpans()[%d] is span %d, want %d", i+1, span.ID, want)
+		}
+	}
+	if want := []string{"trace truncated, 100 of its 1000 spans are shown"}; !reflect.DeepEqual(capped[0].Warnings, want) {
+		t.Errorf("root warnings = %v, want %v", capped[0].Warnings, want)
+	}
+	for _, span := range capped[1:] {
+		if len(span.Warnings) > 0 {
+			t.Errorf("span %d got the warnings %v, want them on the root only", span.ID, span.Warnings)
+		}
+	}
+	if len(spans[0].Warnings) > 0 {
+		t.Errorf("capSpans() changed the warnings of its input to %v", spans[0].Warnings)
+	}
+
+	// without a root the first span kept carries the warning
+	capped = capSpans(spans[1:], 10)
+	if len(capped) != 10 || capped[0].ID != 991 || len(capped[0].Warnings) != 1 {
+		t.Errorf("capSpans() without a root = %v, want spans 991 to 1000 with the warning on the first", capped)
+	}
+}
+
+func TestSpanTagPredicateError(t *testing.T) {
+	if where, params := spanTagPredicate("error", "true", TagStorageJSONB, "span"); where != "span.has_error" || len(params) > 0 {
+		t.Errorf("error=true predicate = %q %v, want the has_error column", where, params)
+	}
+	if where, _ := spanTagPredicate("error", "false", TagStorageJSONB, "span"); where == "span.has_error" {
+		t.Errorf("error=false predicate = %q, want a tag search", where)
+	}
+}
+
+func TestHandleMissingRoots(t *testing.T) {
+	traceID := model.TraceID{Low: 1}
+	traces := func() []*model.Trace {
+		return []*model.Trace{
+			{Spans: []*model.Span{{TraceID: traceID, SpanID: 1}, {TraceID: traceID, SpanID: 2, References: []model.SpanRef{model.NewChildOfRef(traceID, 1)}}}},
+			// the root 3 hasn't arrived
+			{Spans: []*model.Span{{TraceID: model.TraceID{Low: 2}, SpanID: 4, References: []model.SpanRef{model.NewChildOfRef(model.TraceID{Low: 2}, 3)}}}},
+		}
+	}
+
+	required := (&Reader{conf: Configuration{RequireRootSpan: true}}).handleMissingRoots(traces())
+	if len(required) != 1 || required[0].Spans[0].SpanID != 1 {
+		t.Errorf("handleMissingRoots() with RequireRootSpan = %v, want the trace with a root only", required)
+	}
+
+	warned := (&Reader{}).handleMissingRoots(traces())
+	if len(warned) != 2 {
+		t.Fatalf("handleMissingRoots() = %v, want both traces", warned)
+	}
+	if len(warned[0].Spans[0].Warnings) > 0 {
+		t.Errorf("the trace with a root got the warnings %v", warned[0].Spans[0].Warnings)
+	}
+	if want := []string{missingRootWarning}; !reflect.DeepEqual(warned[1].Spans[0].Warnings, want) {
+		t.Errorf("the trace without a root has the warnings %v, want %v", warned[1].Spans[0].Warnings, want)
+	}
+}
+
+func TestParseTagValue(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		negated bool
+	}{
+		{value: "prod", want: "prod"},
+		{value: "!prod", want: "prod", negated: true},
+		{value: "!", want: "", negated: true},
+		{value: "!!prod", want: "!prod"},
+		{value: "!!", want: "!"},
+		{value: "", want: ""},
+		{value: "pro!d", want: "pro!d"},
+	}
+	for _, tt := range tests {
+		if got, negated := parseTagValue(tt.value); got != tt.want || negated != tt.negated {
+			t.Errorf("parseTagValue(%q) = %q, %t, want %q, %t", tt.value, got, negated, tt.want, tt.negated)
+		}
+	}
+}
+
+func TestBuildTraceWhereNegatedTags(t *testing.T) {
+	tests := []struct {
+		value     string
+		notExists bool
+		params    []interface{}
+	}{
+		{value: "prod", params: []interface{}{`{"env":"prod"}`}},
+		{value: "!prod", notExists: true, params: []interface{}{`{"env":"prod"}`}},
+		{value: "!!prod", params: []interface{}{`{"env":"!prod"}`}},
+		{value: "!", notExists: true, params: []interface{}{"env"}},
+	}
+	for _, tt := range tests {
+		builder := buildTraceWhere(&spanstore.TraceQueryParameters{Tags: map[string]string{"env": tt.value}}, TagStorageJSONB)
+		if notExists := strings.HasPrefix(builder.where, "NOT EXISTS (SELECT 1 FROM spans AS tag_span"); notExists != tt.notExists {
+			t.Errorf("env=%s: where = %q, want NOT EXISTS %t", tt.value, builder.where, tt.notExists)
+		}
+		if !reflect.DeepEqual(builder.params[:1], tt.params) {
+			t.Errorf("env=%s: params = %v, want them to start with %v", tt.value, builder.params, tt.params)
+		}
+	}
+}
+
+func TestTagScope(t *testing.T) {
+	tests := []struct {
+		key     string
+		columns []tagColumns
+		keys    []string
+	}{
+		{key: "hostname", columns: []tagColumns{spanTagColumns, processTagColumns}, keys: []string{"hostname"}},
+		{key: "process.hostname", columns: []tagColumns{processTagColumns}, keys: []string{"hostname", "process.hostname"}},
+		{key: "span.kind", columns: []tagColumns{spanTagColumns}, keys: []string{"kind", "span.kind"}},
+		{key: "processor", columns: []tagColumns{spanTagColumns, processTagColumns}, keys: []string{"processor"}},
+	}
+	for _, tt := range tests {
+		columns, keys := tagScope(tt.key)
+		if !reflect.DeepEqual(columns, tt.columns) || !reflect.DeepEqual(keys, tt.keys) {
+			t.Errorf("tagScope(%q) = %v, %v, want %v, %v", tt.key, columns, keys, tt.columns, tt.keys)
+		}
+	}
+}
+
+func TestGetLatencyHistogramBucketBounds(t *testing.T) {
+	db, hook := newRecordingDB()
+	defer db.Close()
+	reader := NewReader(db, hclog.NewNullLogger())
+
+	for _, buckets := range [][]time.Duration{{time.Second, time.Millisecond}, {time.Millisecond, time.Millisecond}} {
+		if _, err := reader.GetLatencyHistogram(context.Background(), "shop", "", time.Hour, buckets); err == nil || errors.Is(err, errRecorded) {
+			t.Errorf("GetLatencyHistogram(%v) = %v, want the bounds rejected", buckets, err)
+		}
+	}
+	if hook.queries != 0 {
+		t.Errorf("%d queries, want the bounds rejected before any", hook.queries)
+	}
+}
+
+// concurrencyHook fails the queries of a db like recordingHook, each after a
+// while so that the queries run in parallel overlap
+type concurrencyHook struct {
+	mu       sync.Mutex
+	queries  int
+	inFlight int
+	max      int
+}
+
+func (h *concurrencyHook) BeforeQuery(ctx context.Context, _ *pg.QueryEvent) (context.Context, error) {
+	h.mu.Lock()
+	h.queries++
+	h.inFlight++
+	if h.inFlight > h.max {
+		h.max = h.inFlight
+	}
+	h.mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	h.mu.Lock()
+	h.inFlight--
+	h.mu.Unlock()
+	return ctx, errRecorded
+}
+
+func (h *concurrencyHook) AfterQuery(context.Context, *pg.QueryEvent) error {
+	return nil
+}
+
+func TestLoadTracesConcurrency(t *testing.T) {
+	tests := []struct {
+		concurrency int
+		traces      int
+		statements  int
+	}{
+		{concurrency: 0, traces: 10, statements: 1},
+		{concurrency: 1, traces: 10, statements: 1},
+		{concurrency: 3, traces: 10, statements: 3},
+		{concurrency: 5, traces: 2, statements: 2},
+		{concurrency: 3, traces: 0, statements: 0},
+	}
+	for _, tt := range tests {
+		db := pg.Connect(&pg.Options{Addr: "127.0.0.1:1"})
+		hook := &concurrencyHook{}
+		db.AddQueryHook(hook)
+		reader := NewReader(db, hclog.NewNullLogger(), WithConfiguration(&Configuration{FindConcurrency: tt.concurrency}))
+		traceIDs := make([]model.TraceID, tt.traces)
+		for i := range traceIDs {
+			traceIDs[i] = model.TraceID{Low: uint64(i + 1)}
+		}
+
+		_, err := reader.loadTraces(context.Background(), db, traceIDs, 0)
+		if tt.statements > 0 && !errors.Is(err, errRecorded) {
+			t.Errorf("FindConcurrency %d: loadTraces() = %v, want %v", tt.concurrency, err, errRecorded)
+		}
+		if hook.queries != tt.statements {
+			t.Errorf("FindConcurrency %d: %d statements for %d traces, want %d", tt.concurrency, hook.queries, tt.traces, tt.statements)
+		}
+		if hook.max > tt.statements {
+			t.Errorf("FindConcurrency %d: %d statements in parallel, want at most %d", tt.concurrency, hook.max, tt.statements)
+		}
+		db.Close()
+	}
+}
+
+func TestLogFieldPredicate(t *testing.T) {
+	logs := "(span.trace_id_low, span.trace_id_high, span.id, span.tenant_id) IN (SELECT trace_id_low, trace_id_high, span_id, tenant_id FROM span_logs WHERE "
+	tests := []struct {
+		key    string
+		value  string
+		where  string
+		params []interface{}
+	}{
+		{key: "log.event", value: "cache_miss", where: logs + `(fields @> ?::jsonb))`, params: []interface{}{`{"event":"cache_miss"}`}},
+		{key: "log.retries", value: "3", where: logs + `(fields @> ?::jsonb OR fields @> ?::jsonb))`,
+			params: []interface{}{`{"retries":"3"}`, `{"retries":3}`}},
+		{key: "log.event", value: "", where: logs + "fields -> ? IS NOT NULL)", params: []interface{}{"event"}},
+	}
+	for _, tt := range tests {
+		where, params := spanTagPredicate(tt.key, tt.value, TagStorageJSONB, "span")
+		if tt.value == "" {
+			where, params = tagKeyPredicate(tt.key, TagStorageJSONB, "span")
+		}
+		if where != tt.where || !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("%s=%s gave %q %v, want %q %v", tt.key, tt.value, where, params, tt.where, tt.params)
+		}
+	}
+}
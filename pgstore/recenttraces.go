@@ -0,0 +1,63 @@
+package pgstore
+
+import (
+	"context"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// recentSpansPage is the number of spans GetRecentTraces reads per statement
+const recentSpansPage = 1000
+
+// GetRecentTraces returns the ids of the traces with the most recently
+// started spans whichever their service, newest first. The spans are read
+// backwards along idx_spans_start_time until limit traces are found, a page
+// continues after the trace and span id of the last span read as spans of
+// different traces may share both the start time and the span id.
+func (r *Reader) GetRecentTraces(ctx context.Context, limit int) (ret []model.TraceID, err error) {
+	defer r.metrics.observe("GetRecentTraces", time.Now(), &err)
+	ospan, ctx := r.startSpan(ctx, "GetRecentTraces")
+	defer finishSpan(ospan, &err)
+	ctx, cancel := r.withQueryTimeout(ctx)
+	defer cancel()
+
+	limit = r.numTraces(limit)
+	err = r.retry(ctx, func() error {
+		ret = nil
+		seen := make(map[model.TraceID]struct{}, limit)
+		var spans []Span
+		for len(ret) < limit {
+			q := whereTenant(ctx, r.replica.ModelContext(ctx, &spans)).
+				Column("id", "trace_id_low", "trace_id_high", "start_time").
+				Order("start_time DESC", "trace_id_high DESC", "trace_id_low DESC", "id DESC").
+				Limit(recentSpansPage)
+			if len(spans) > 0 {
+				last := spans[len(spans)-1]
+				q = q.Where("(start_time, trace_id_high, trace_id_low, id) < (?, ?, ?, ?)",
+					last.StartTime, last.TraceIDHigh, last.TraceIDLow, last.ID)
+			}
+			spans = nil
+			if err := q.Select(); err != nil {
+				return err
+			}
+			for _, span := range spans {
+				traceID := model.TraceID{Low: uint64(span.TraceIDLow), High: uint64(span.TraceIDHigh)}
+				if _, found := seen[traceID]; found {
+					continue
+				}
+				seen[traceID] = struct{}{}
+				if ret = append(ret, traceID); len(ret) == limit {
+					break
+				}
+			}
+			if len(spans) < recentSpansPage {
+				break
+			}
+		}
+		return nil
+	})
+	ospan.SetTag("result_count", len(ret))
+
+	return ret, wrapError(err, "GetRecentTraces")
+}
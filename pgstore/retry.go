@@ -0,0 +1,96 @@
+package pgstore
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+// Backoff between the attempts of a Reader call, doubled on every retry
+const (
+	retryMinBackoff = 100 * time.Millisecond
+	retryMaxBackoff = 2 * time.Second
+)
+
+// retry runs fn until it succeeds, fails with an error which isn't transient
+// or Configuration.ReadRetries retries are exhausted. fn has to reset whatever
+// it loads as it may run several times. Once ctx is done a failure of fn is
+// reported as the error of ctx, the server fails a statement cancelled for it
+// with an error of its own.
+func (r *Reader) retry(ctx context.Context, fn func() error) error {
+	backoff := retryMinBackoff
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if attempt >= r.conf.ReadRetries || !isTransient(err) || ctx.Err() != nil {
+			return err
+		}
+		r.logger.Debug("Retrying after a transient error", "attempt", attempt+1, "err", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > retryMaxBackoff {
+			backoff = retryMaxBackoff
+		}
+	}
+}
+
+// waitForDB tries to reach db up to Configuration.StartupConnectRetries more
+// times, StartupConnectBackoff apart, as long as it fails on an unreachable or
+// starting server rather than e.g. on wrong credentials
+func (c *Configuration) waitForDB(ctx context.Context, db *pg.DB, logger hclog.Logger) error {
+	backoff := c.StartupConnectBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	for attempt := 0; ; attempt++ {
+		_, err := db.ExecContext(ctx, "SELECT 1")
+		var netErr net.Error
+		if err == nil || attempt >= c.StartupConnectRetries || (!isTransient(err) && !errors.As(err, &netErr)) {
+			return err
+		}
+		logger.Info("Database unreachable, retrying", "attempt", attempt+1, "err", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// isTransient tells the errors worth retrying, lost or refused connections
+// and connections timing out, from logical ones like a missing trace or a bad
+// query. A read timing out is a query too slow for the server already, running
+// it again only adds to the load.
+func isTransient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" && opErr.Timeout() {
+		return true
+	}
+	var pgErr pg.Error
+	if errors.As(err, &pgErr) {
+		// class 08 is connection exception, 57P01-57P03 a server shutting
+		// down or not accepting connections yet, e.g. during a failover
+		code := pgErr.Field('C')
+		return strings.HasPrefix(code, "08") || code == "57P01" || code == "57P02" || code == "57P03"
+	}
+	return false
+}
@@ -0,0 +1,191 @@
+package pgstore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"trace not found", spanstore.ErrTraceNotFound, false},
+		{"canceled", fmt.Errorf("GetTrace: %w", context.Canceled), false},
+		{"deadline", context.DeadlineExceeded, false},
+		{"EOF", io.EOF, true},
+		{"reset", &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, true},
+		{"refused", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, true},
+		{"dial timeout", &net.OpError{Op: "dial", Err: timeoutError{}}, true},
+		{"read timeout", &net.OpError{Op: "read", Err: timeoutError{}}, false},
+		{"connection failure", testPGError{'S': "FATAL", 'C': "08006"}, true},
+		{"admin shutdown", testPGError{'S': "FATAL", 'C': "57P01"}, true},
+		{"syntax error", testPGError{'S': "ERROR", 'C': "42601"}, false},
+		{"statement timeout", testPGError{'S': "ERROR", 'C': "57014"}, false},
+	}
+	for _, tt := range tests {
+		if got := isTransient(tt.err); got != tt.want {
+			t.Errorf("%s: isTransient(%v) = %v, want %v", tt.name, tt.err, got, tt.want)
+		}
+	}
+}
+
+// timeoutError is a net.Error timing out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// flakyHook fails the first failures queries of a db on a reset connection
+// and the later ones with errRecorded
+type flakyHook struct {
+	failures int
+	queries  int
+}
+
+func (h *flakyHook) BeforeQuery(ctx context.Context, _ *pg.QueryEvent) (context.Context, error) {
+	h.queries++
+	if h.queries <= h.failures {
+		return ctx, &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	}
+	return ctx, errRecorded
+}
+
+func (h *flakyHook) AfterQuery(context.Context, *pg.QueryEvent) error {
+	return nil
+}
+
+func TestReaderRetriesTransientErrors(t *testing.T) {
+	db := pg.Connect(&pg.Options{Addr: "127.0.0.1:1"})
+	defer db.Close()
+	hook := &flakyHook{failures: 2}
+	db.AddQueryHook(hook)
+	reader := NewReader(db, hclog.NewNullLogger(), WithConfiguration(&Configuration{ReadRetries: 3}))
+
+	// the lookup of the service aliases is retried with the rest of the
+	// call, the third attempt reaches the server, which fails it for good
+	_, err := reader.GetOperations(context.Background(), spanstore.OperationQueryParameters{ServiceName: "frontend"})
+	if !errors.Is(err, errRecorded) {
+		t.Errorf("GetOperations() error = %v, want the error of the third attempt", err)
+	}
+	if hook.queries != 3 {
+		t.Errorf("GetOperations() ran %d queries, want 3", hook.queries)
+	}
+
+	calls := 0
+	err = reader.retry(context.Background(), func() error {
+		if calls++; calls <= 2 {
+			return io.EOF
+		}
+		return nil
+	})
+	if err != nil || calls != 3 {
+		t.Errorf("retry() = %v after %d calls, want success on the third", err, calls)
+	}
+
+	calls = 0
+	err = reader.retry(context.Background(), func() error {
+		calls++
+		return spanstore.ErrTraceNotFound
+	})
+	if !errors.Is(err, spanstore.ErrTraceNotFound) || calls != 1 {
+		t.Errorf("retry() = %v after %d calls, want the logical error at once", err, calls)
+	}
+
+	// the statement cancelled for the context
+	ctx, cancel := context.WithCancel(context.Background())
+	calls = 0
+	err = reader.retry(ctx, func() error {
+		calls++
+		cancel()
+		return testPGError{'S': "ERROR", 'C': "57014", 'M': "canceling statement due to user request"}
+	})
+	if !errors.Is(err, context.Canceled) || calls != 1 {
+		t.Errorf("retry() = %v after %d calls, want context.Canceled at once", err, calls)
+	}
+
+	reader = NewReader(db, hclog.NewNullLogger(), WithConfiguration(&Configuration{ReadRetries: 1}))
+	calls = 0
+	err = reader.retry(context.Background(), func() error {
+		calls++
+		return io.EOF
+	})
+	if !errors.Is(err, io.EOF) || calls != 2 {
+		t.Errorf("retry() = %v after %d calls, want to give up after the retry", err, calls)
+	}
+}
+
+func TestWaitForDB(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		retries  int
+		queries  int
+		want     error
+	}{
+		{name: "reached after failures", failures: 2, retries: 3, queries: 3, want: errRecorded},
+		{name: "retries exhausted", failures: 5, retries: 2, queries: 3},
+		{name: "no retries", failures: 1, retries: 0, queries: 1},
+		{name: "reached at once", failures: 0, retries: 3, queries: 1, want: errRecorded},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db := pg.Connect(&pg.Options{Addr: "127.0.0.1:1"})
+			defer db.Close()
+			hook := &flakyHook{failures: tt.failures}
+			db.AddQueryHook(hook)
+			logger, out := newBufferLogger(hclog.Info)
+			conf := &Configuration{StartupConnectRetries: tt.retries, StartupConnectBackoff: 10 * time.Millisecond}
+
+			start := time.Now()
+			err := conf.waitForDB(context.Background(), db, logger)
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("waitForDB() = %v, want %v", err, tt.want)
+			}
+			if tt.want == nil && !isTransient(err) {
+				t.Errorf("waitForDB() = %v, want the last transient error", err)
+			}
+			if hook.queries != tt.queries {
+				t.Errorf("%d attempts, want %d", hook.queries, tt.queries)
+			}
+			if backoff := time.Duration(tt.queries-1) * 10 * time.Millisecond; time.Since(start) < backoff {
+				t.Errorf("waited %s, want the backoffs of %s", time.Since(start), backoff)
+			}
+			if logged := strings.Count(out.String(), "Database unreachable, retrying"); logged != tt.queries-1 {
+				t.Errorf("%d retries logged, want %d", logged, tt.queries-1)
+			}
+		})
+	}
+}
+
+func TestWaitForDBCanceled(t *testing.T) {
+	db := pg.Connect(&pg.Options{Addr: "127.0.0.1:1"})
+	defer db.Close()
+	hook := &flakyHook{failures: 5}
+	db.AddQueryHook(hook)
+	conf := &Configuration{StartupConnectRetries: 5, StartupConnectBackoff: time.Hour}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := conf.waitForDB(ctx, db, hclog.NewNullLogger()); !isTransient(err) {
+		t.Errorf("waitForDB() = %v, want the transient error of the attempt", err)
+	}
+	if hook.queries != 1 {
+		t.Errorf("%d attempts, want the backoff cut short by the context", hook.queries)
+	}
+}
@@ -0,0 +1,130 @@
+package pgstore
+
+import (
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	hclog "github.com/hashicorp/go-hclog"
+
+	"github.com/jaegertracing/jaeger/cmd/collector/app/sampling/model"
+	"github.com/jaegertracing/jaeger/storage/samplingstore"
+)
+
+var _ samplingstore.Store = (*SamplingStore)(nil)
+
+// SamplingStore keeps the throughput and the probabilities computed by the
+// adaptive sampling of the collector
+type SamplingStore struct {
+	db *pg.DB
+
+	logger hclog.Logger
+}
+
+// NewSamplingStore returns a SamplingStore for the sampling tables created by
+// Migrate
+func NewSamplingStore(db *pg.DB, logger hclog.Logger) *SamplingStore {
+	return &SamplingStore{
+		db:     db,
+		logger: logger,
+	}
+}
+
+// InsertThroughput saves the throughput aggregated per operation, stamped
+// with the current time
+func (s *SamplingStore) InsertThroughput(throughput []*model.Throughput) error {
+	if len(throughput) == 0 {
+		return nil
+	}
+	now := time.Now()
+	rows := make([]*SamplingThroughput, 0, len(throughput))
+	for _, t := range throughput {
+		probabilities := make([]string, 0, len(t.Probabilities))
+		for probability := range t.Probabilities {
+			probabilities = append(probabilities, probability)
+		}
+		rows = append(rows, &SamplingThroughput{
+			Ts:            now,
+			ServiceName:   t.Service,
+			OperationName: t.Operation,
+			Count:         t.Count,
+			Probabilities: probabilities,
+		})
+	}
+	_, err := s.db.Model(&rows).Insert()
+	return err
+}
+
+// GetThroughput returns the throughput saved between start inclusive and end
+// exclusive
+func (s *SamplingStore) GetThroughput(start, end time.Time) ([]*model.Throughput, error) {
+	var rows []SamplingThroughput
+	err := s.db.Model(&rows).Where("ts >= ? AND ts < ?", start, end).Order("ts ASC", "id ASC").Select()
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*model.Throughput, 0, len(rows))
+	for _, row := range rows {
+		probabilities := make(map[string]struct{}, len(row.Probabilities))
+		for _, probability := range row.Probabilities {
+			probabilities[probability] = struct{}{}
+		}
+		ret = append(ret, &model.Throughput{
+			Service:       row.ServiceName,
+			Operation:     row.OperationName,
+			Count:         row.Count,
+			Probabilities: probabilities,
+		})
+	}
+	return ret, nil
+}
+
+// InsertProbabilitiesAndQPS saves the probabilities and qps calculated by
+// hostname, stamped with the current time
+func (s *SamplingStore) InsertProbabilitiesAndQPS(hostname string, probabilities model.ServiceOperationProbabilities, qps model.ServiceOperationQPS) error {
+	_, err := s.db.Model(&SamplingProbabilities{
+		Ts:            time.Now(),
+		Hostname:      hostname,
+		Probabilities: probabilities,
+		QPS:           qps,
+	}).Insert()
+	return err
+}
+
+// GetProbabilitiesAndQPS returns the probabilities and qps saved between start
+// inclusive and end exclusive by hostname
+func (s *SamplingStore) GetProbabilitiesAndQPS(start, end time.Time) (map[string][]model.ServiceOperationData, error) {
+	var rows []SamplingProbabilities
+	err := s.db.Model(&rows).Where("ts >= ? AND ts < ?", start, end).Order("ts ASC", "id ASC").Select()
+	if err != nil {
+		return nil, err
+	}
+	ret := make(map[string][]model.ServiceOperationData)
+	for _, row := range rows {
+		data := make(model.ServiceOperationData, len(row.Probabilities))
+		for service, operations := range row.Probabilities {
+			data[service] = make(map[string]*model.ProbabilityAndQPS, len(operations))
+			for operation, probability := range operations {
+				data[service][operation] = &model.ProbabilityAndQPS{
+					Probability: probability,
+					QPS:         row.QPS[service][operation],
+				}
+			}
+		}
+		ret[row.Hostname] = append(ret[row.Hostname], data)
+	}
+	return ret, nil
+}
+
+// GetLatestProbabilities returns the probabilities saved last, none if the
+// table is empty
+func (s *SamplingStore) GetLatestProbabilities() (model.ServiceOperationProbabilities, error) {
+	var row SamplingProbabilities
+	err := s.db.Model(&row).Order("ts DESC", "id DESC").Limit(1).Select()
+	if err == pg.ErrNoRows {
+		return model.ServiceOperationProbabilities{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return row.Probabilities, nil
+}
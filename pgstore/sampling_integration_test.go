@@ -0,0 +1,85 @@
+//go:build integration
+// +build integration
+
+package pgstore
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/cmd/collector/app/sampling/model"
+)
+
+func TestSamplingStoreThroughput(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	store := NewSamplingStore(db, hclog.NewNullLogger())
+
+	before := time.Now().Add(-time.Second)
+	throughput := []*model.Throughput{
+		{Service: "frontend", Operation: "GET /", Count: 10, Probabilities: map[string]struct{}{"0.1": {}, "0.5": {}}},
+		{Service: "backend", Operation: "query", Count: 3, Probabilities: map[string]struct{}{}},
+	}
+	if err := store.InsertThroughput(throughput); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.InsertThroughput(nil); err != nil {
+		t.Errorf("InsertThroughput(nil) = %v", err)
+	}
+
+	got, err := store.GetThroughput(before, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, throughput) {
+		t.Errorf("GetThroughput() = %v, want %v", got, throughput)
+	}
+	// the end is exclusive
+	if got, err := store.GetThroughput(before.Add(-time.Hour), before); err != nil || len(got) != 0 {
+		t.Errorf("GetThroughput() before the insert = %v, %v, want none", got, err)
+	}
+}
+
+func TestSamplingStoreProbabilities(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	store := NewSamplingStore(db, hclog.NewNullLogger())
+
+	latest, err := store.GetLatestProbabilities()
+	if err != nil || len(latest) != 0 {
+		t.Errorf("GetLatestProbabilities() of an empty table = %v, %v, want none", latest, err)
+	}
+
+	before := time.Now().Add(-time.Second)
+	first := model.ServiceOperationProbabilities{"frontend": {"GET /": 0.5}}
+	second := model.ServiceOperationProbabilities{"frontend": {"GET /": 0.25}, "backend": {"query": 1}}
+	qps := model.ServiceOperationQPS{"frontend": {"GET /": 4}, "backend": {"query": 2}}
+	if err := store.InsertProbabilitiesAndQPS("host-1", first, model.ServiceOperationQPS{"frontend": {"GET /": 8}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.InsertProbabilitiesAndQPS("host-2", second, qps); err != nil {
+		t.Fatal(err)
+	}
+
+	latest, err = store.GetLatestProbabilities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(latest, second) {
+		t.Errorf("GetLatestProbabilities() = %v, want %v", latest, second)
+	}
+
+	byHost, err := store.GetProbabilitiesAndQPS(before, time.Now().Add(time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]model.ServiceOperationData{
+		"host-1": {{"frontend": {"GET /": {Probability: 0.5, QPS: 8}}}},
+		"host-2": {{"frontend": {"GET /": {Probability: 0.25, QPS: 4}}, "backend": {"query": {Probability: 1, QPS: 2}}}},
+	}
+	if !reflect.DeepEqual(byHost, want) {
+		t.Errorf("GetProbabilitiesAndQPS() = %v, want %v", byHost, want)
+	}
+}
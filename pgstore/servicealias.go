@@ -0,0 +1,84 @@
+package pgstore
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// AddServiceAlias makes the Reader treat the spans of service alias, e.g. the
+// name of a renamed service, as those of service canonical. GetServices lists
+// canonical only and a search for either name finds the spans of both.
+// canonical shouldn't be an alias itself, adding an alias twice replaces it.
+func (w *Writer) AddServiceAlias(ctx context.Context, alias, canonical string) error {
+	if len(alias) == 0 || len(canonical) == 0 || alias == canonical {
+		return fmt.Errorf("pgstore: invalid service alias %q of %q", alias, canonical)
+	}
+	_, err := w.db.ModelContext(ctx, &ServiceAlias{Alias: alias, ServiceName: canonical}).
+		OnConflict("(alias) DO UPDATE").Set("service_name = EXCLUDED.service_name").Insert()
+	return err
+}
+
+// serviceAliases maps the aliased service names onto their canonical name.
+// It runs within the retry of the calling Reader method.
+func (r *Reader) serviceAliases(ctx context.Context) (map[string]string, error) {
+	var aliases []ServiceAlias
+	if err := r.replica.ModelContext(ctx, &aliases).Select(); err != nil {
+		return nil, err
+	}
+	ret := make(map[string]string, len(aliases))
+	for _, alias := range aliases {
+		ret[alias.Alias] = alias.ServiceName
+	}
+	return ret, nil
+}
+
+// withServiceAliases returns the names of the services of names, each name
+// with its canonical name and the other aliases of that
+func withServiceAliases(names []string, aliases map[string]string) []string {
+	if len(aliases) == 0 {
+		return names
+	}
+	canonical := make(map[string]bool, len(names))
+	for _, name := range names {
+		if c, found := aliases[name]; found {
+			name = c
+		}
+		canonical[name] = true
+	}
+	ret := make([]string, 0, len(canonical))
+	for name := range canonical {
+		ret = append(ret, name)
+	}
+	for alias, c := range aliases {
+		if canonical[c] && !canonical[alias] {
+			ret = append(ret, alias)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// canonicalServiceNames replaces the aliases among the listed names by their
+// canonical name, keeping the first occurrence of each. Sorted by name, the
+// names are sorted again.
+func canonicalServiceNames(names []string, aliases map[string]string, byName bool) []string {
+	if len(aliases) == 0 {
+		return names
+	}
+	seen := make(map[string]bool, len(names))
+	ret := names[:0]
+	for _, name := range names {
+		if c, found := aliases[name]; found {
+			name = c
+		}
+		if !seen[name] {
+			seen[name] = true
+			ret = append(ret, name)
+		}
+	}
+	if byName {
+		sort.Strings(ret)
+	}
+	return ret
+}
@@ -0,0 +1,57 @@
+package pgstore
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestWithServiceAliases(t *testing.T) {
+	aliases := map[string]string{"shop-v1": "shop", "store": "shop", "ledger-v1": "ledger"}
+	tests := []struct {
+		name    string
+		names   []string
+		aliases map[string]string
+		want    []string
+	}{
+		{name: "no aliases", names: []string{"shop"}, want: []string{"shop"}},
+		{name: "canonical name", names: []string{"shop"}, aliases: aliases, want: []string{"shop", "shop-v1", "store"}},
+		{name: "alias", names: []string{"store"}, aliases: aliases, want: []string{"shop", "shop-v1", "store"}},
+		{name: "unaliased name", names: []string{"payments"}, aliases: aliases, want: []string{"payments"}},
+		{name: "several names", names: []string{"shop-v1", "ledger", "payments"}, aliases: aliases,
+			want: []string{"ledger", "ledger-v1", "payments", "shop", "shop-v1", "store"}},
+		{name: "aliases of one service", names: []string{"shop-v1", "store"}, aliases: aliases, want: []string{"shop", "shop-v1", "store"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := withServiceAliases(tt.names, tt.aliases); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("withServiceAliases(%v) = %v, want %v", tt.names, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCanonicalServiceNames(t *testing.T) {
+	aliases := map[string]string{"shop-v1": "shop", "store": "shop"}
+	tests := []struct {
+		name    string
+		names   []string
+		aliases map[string]string
+		byName  bool
+		want    []string
+	}{
+		{name: "no aliases", names: []string{"store", "payments"}, want: []string{"store", "payments"}},
+		{name: "aliases replaced", names: []string{"store", "payments"}, aliases: aliases, want: []string{"shop", "payments"}},
+		{name: "first occurrence kept", names: []string{"payments", "store", "shop", "shop-v1"}, aliases: aliases,
+			want: []string{"payments", "shop"}},
+		{name: "sorted again by name", names: []string{"payments", "store", "ledger"}, aliases: aliases, byName: true,
+			want: []string{"ledger", "payments", "shop"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			names := append([]string(nil), tt.names...)
+			if got := canonicalServiceNames(names, tt.aliases, tt.byName); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("canonicalServiceNames(%v) = %v, want %v", tt.names, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,179 @@
+package pgstore
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+// explainTimeout bounds the EXPLAIN of a slow query, it runs after the query
+// when the deadline of the caller may be gone already
+const explainTimeout = 5 * time.Second
+
+// explainQueueSize bounds the slow queries waiting for their EXPLAIN, those
+// beyond it are logged without a plan
+const explainQueueSize = 16
+
+// explainKey marks the context of an EXPLAIN so that it isn't explained itself
+type explainKey struct{}
+
+// slowQueryHook logs the plan of every SELECT of db taking longer than
+// threshold, used with Configuration.ExplainSlowQueries. The plans are read by
+// the explainer so that a slow query doesn't wait for its EXPLAIN too.
+type slowQueryHook struct {
+	db        *pg.DB
+	threshold time.Duration
+	explainer *explainer
+}
+
+var _ pg.QueryHook = slowQueryHook{}
+
+// addSlowQueryHook hooks the connections of the Reader, the replica too when it
+// is a distinct pool
+func (r *Reader) addSlowQueryHook() {
+	threshold := r.conf.SlowQueryThreshold
+	if threshold <= 0 {
+		threshold = time.Second
+	}
+	r.explainer = newExplainer(r.logger)
+	r.ownHandles()
+	r.db.AddQueryHook(slowQueryHook{db: r.db, threshold: threshold, explainer: r.explainer})
+	if r.replica != r.db {
+		r.replica.AddQueryHook(slowQueryHook{db: r.replica, threshold: threshold, explainer: r.explainer})
+	}
+}
+
+func (h slowQueryHook) BeforeQuery(ctx context.Context, _ *pg.QueryEvent) (context.Context, error) {
+	return ctx, nil
+}
+
+func (h slowQueryHook) AfterQuery(ctx context.Context, event *pg.QueryEvent) error {
+	elapsed := time.Since(event.StartTime)
+	if elapsed < h.threshold || event.DB == nil || ctx.Value(explainKey{}) != nil || h.explainer.closed() {
+		return nil
+	}
+	query, err := event.FormattedQuery()
+	if err != nil || !strings.HasPrefix(strings.ToUpper(strings.TrimSpace(query)), "SELECT") {
+		return nil
+	}
+
+	fields := []interface{}{"duration", elapsed, "query", query}
+	if method := methodFromContext(ctx); len(method) > 0 {
+		fields = append(fields, "method", method)
+	}
+	if event.Err == nil && event.Result != nil {
+		fields = append(fields, "rowsReturned", event.Result.RowsReturned())
+	}
+	h.explainer.enqueue(slowQuery{db: h.db, query: query, fields: fields})
+	return nil
+}
+
+// slowQuery is a slow query waiting for its EXPLAIN with the fields it is logged with
+type slowQuery struct {
+	db     *pg.DB
+	query  string
+	fields []interface{}
+}
+
+// explainer explains and logs the slow queries one at a time in a goroutine
+// of its own until Close
+type explainer struct {
+	logger  hclog.Logger
+	queue   chan slowQuery
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// newExplainer starts an explainer
+func newExplainer(logger hclog.Logger) *explainer {
+	e := &explainer{
+		logger:  logger,
+		queue:   make(chan slowQuery, explainQueueSize),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *explainer) run() {
+	defer close(e.stopped)
+	for {
+		select {
+		case <-e.stop:
+			return
+		case q := <-e.queue:
+			e.explain(q)
+		}
+	}
+}
+
+// enqueue hands q to the goroutine of the explainer without waiting, q is
+// logged without its plan when the queue is full
+func (e *explainer) enqueue(q slowQuery) {
+	if e.closed() {
+		return
+	}
+	select {
+	case e.queue <- q:
+	default:
+		e.logger.Warn("Slow query", append(q.fields, "plan", "not explained, too many slow queries")...)
+	}
+}
+
+func (e *explainer) explain(q slowQuery) {
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), explainKey{}, true), explainTimeout)
+	defer cancel()
+	var plan []string
+	if _, err := q.db.QueryContext(ctx, &plan, "EXPLAIN (ANALYZE false) "+q.query); err != nil {
+		e.logger.Debug("Couldn't explain a slow query", "query", q.query, "err", err)
+		return
+	}
+	fields := append(q.fields, "estimatedRowsScanned", estimatedRowsScanned(plan))
+	e.logger.Warn("Slow query", append(fields, "plan", strings.Join(plan, "\n"))...)
+}
+
+// closed tells whether Close was called, the hook of a closed explainer
+// doesn't look at the queries anymore
+func (e *explainer) closed() bool {
+	select {
+	case <-e.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Close stops the explainer once the EXPLAIN running is done, the slow
+// queries still queued aren't logged
+func (e *explainer) Close() {
+	close(e.stop)
+	<-e.stopped
+}
+
+// estimatedRowsScanned sums the rows the planner expects the scan nodes of
+// the plan to read, the loops of a nested scan aren't known without ANALYZE
+func estimatedRowsScanned(plan []string) int64 {
+	var ret int64
+	for _, line := range plan {
+		if !strings.Contains(line, " Scan ") {
+			continue
+		}
+		i := strings.Index(line, " rows=")
+		if i < 0 {
+			continue
+		}
+		digits := line[i+len(" rows="):]
+		if end := strings.IndexFunc(digits, func(c rune) bool { return c < '0' || c > '9' }); end >= 0 {
+			digits = digits[:end]
+		}
+		if rows, err := strconv.ParseInt(digits, 10, 64); err == nil {
+			ret += rows
+		}
+	}
+	return ret
+}
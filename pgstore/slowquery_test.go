@@ -0,0 +1,83 @@
+package pgstore
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	hclog "github.com/hashicorp/go-hclog"
+)
+
+func TestSlowQueryHookQueuesExplain(t *testing.T) {
+	db := pg.Connect(&pg.Options{Addr: "127.0.0.1:1"})
+	defer db.Close()
+	var logs bytes.Buffer
+	// no goroutine takes the queued queries
+	e := &explainer{
+		logger: hclog.New(&hclog.LoggerOptions{Output: &logs}),
+		queue:  make(chan slowQuery, 1),
+		stop:   make(chan struct{}),
+	}
+	hook := slowQueryHook{db: db, threshold: time.Second, explainer: e}
+
+	ctx := context.Background()
+	slow := time.Now().Add(-time.Minute)
+	events := []*pg.QueryEvent{
+		{StartTime: time.Now(), DB: db, Query: "SELECT 1"},
+		{StartTime: slow, DB: db, Query: "INSERT INTO spans DEFAULT VALUES"},
+		{StartTime: slow, DB: db, Query: "SELECT ?", Params: []interface{}{2}},
+		{StartTime: slow, DB: db, Query: "SELECT 3"},
+	}
+	for _, event := range events {
+		if err := hook.AfterQuery(ctx, event); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(e.queue) != 1 {
+		t.Fatalf("%d queries queued, want the first slow SELECT", len(e.queue))
+	}
+	if q := <-e.queue; q.query != "SELECT 2" || q.db != db {
+		t.Errorf("queued %q, want SELECT 2 of the hooked db", q.query)
+	}
+	if !strings.Contains(logs.String(), "SELECT 3") || !strings.Contains(logs.String(), "not explained") {
+		t.Errorf("the query beyond the queue logged %q, want it without a plan", logs.String())
+	}
+
+	// an EXPLAIN isn't explained
+	if err := hook.AfterQuery(context.WithValue(ctx, explainKey{}, true), events[3]); err != nil || len(e.queue) != 0 {
+		t.Errorf("queued the slow EXPLAIN: %v", err)
+	}
+	close(e.stop)
+	if hook.AfterQuery(ctx, events[3]); len(e.queue) != 0 {
+		t.Error("queued a query after Close")
+	}
+}
+
+func TestExplainerClose(t *testing.T) {
+	e := newExplainer(hclog.NewNullLogger())
+	closed := make(chan struct{})
+	go func() {
+		e.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("Close() didn't stop the explainer")
+	}
+}
+
+func TestEstimatedRowsScanned(t *testing.T) {
+	plan := []string{
+		"Limit  (cost=0.29..8.31 rows=20 width=16)",
+		"  ->  Nested Loop  (cost=0.29..8.31 rows=20 width=16)",
+		"        ->  Index Scan using idx_spans_start_time on spans span  (cost=0.29..8.30 rows=120 width=16)",
+		"        ->  Seq Scan on services service  (cost=0.00..1.01 rows=3 width=8)",
+	}
+	if got := estimatedRowsScanned(plan); got != 123 {
+		t.Errorf("estimatedRowsScanned() = %d, want 123", got)
+	}
+}
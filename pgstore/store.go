@@ -1,6 +1,7 @@
 package pgstore
 
 import (
+	"context"
 	"io"
 
 	"github.com/go-pg/pg/v9"
@@ -16,41 +17,95 @@ var (
 	_ io.Closer            = (*Store)(nil)
 )
 
+type spanWriteCloser interface {
+	spanstore.Writer
+	io.Closer
+}
+
 type Store struct {
-	db     *pg.DB
-	reader *Reader
-	writer *Writer
+	db         *pg.DB
+	replica    *pg.DB
+	reader     *Reader
+	writer     *Writer
+	spanWriter spanWriteCloser
 }
 
 func NewStore(conf *Configuration, logger hclog.Logger) (*Store, func() error, error) {
-	db := pg.Connect(&pg.Options{
-		Addr:     conf.Host,
-		User:     conf.Username,
-		Password: conf.Password,
-		Database: conf.Database,
-	})
+	if err := conf.validateTagStorage(); err != nil {
+		return nil, nil, err
+	}
+	if err := conf.validateServiceOrder(); err != nil {
+		return nil, nil, err
+	}
+	opts, err := conf.pgOptions()
+	if err != nil {
+		return nil, nil, err
+	}
+	replicaOpts, err := conf.replicaPgOptions()
+	if err != nil {
+		return nil, nil, err
+	}
+	db := pg.Connect(opts)
+	conf.logQueries(db, logger)
+	if err := conf.waitForDB(context.Background(), db, logger); err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	if len(conf.SchemaName) > 0 {
+		if _, err := db.Exec("CREATE SCHEMA IF NOT EXISTS ?", pg.Ident(conf.SchemaName)); err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+	}
+	if err := Migrate(context.Background(), db, logger); err != nil {
+		db.Close()
+		return nil, nil, err
+	}
+	if conf.TagStorage == TagStorageHstore {
+		if err := MigrateHstore(context.Background(), db); err != nil {
+			db.Close()
+			return nil, nil, err
+		}
+	}
+	replica := db
+	if replicaOpts != nil {
+		replica = pg.Connect(replicaOpts)
+		conf.logQueries(replica, logger)
+	}
 
-	reader := NewReader(db, logger)
-	writer := NewWriter(db, logger)
+	reader := NewReaderWithReplica(db, replica, logger, WithConfiguration(conf))
+	writer := NewWriter(db, logger, WithTagStorage(conf.TagStorage), WithMaxOperationNameLength(conf.MaxOperationNameLength),
+		WithDropInvalidSpans(conf.DropInvalidSpans), WithTenant(conf.Tenant))
 
 	store := &Store{
-		db:     db,
-		reader: reader,
-		writer: writer,
+		db:         db,
+		replica:    replica,
+		reader:     reader,
+		writer:     writer,
+		spanWriter: writer,
+	}
+	if conf.BatchSize > 1 {
+		store.spanWriter = NewBatchWriter(writer, conf.BatchSize, conf.BatchFlushInterval)
 	}
 
 	return store, store.Close, nil
 }
 
-// Close writer and DB
+// Close writer, reader and DB
 func (s *Store) Close() error {
-	err2 := s.writer.Close()
-	err1 := s.db.Close()
-	//s.reader.Close()
-	if err1 != nil {
+	err := s.spanWriter.Close()
+	if err1 := s.reader.Close(); err1 != nil {
+		err = err1
+	}
+	if s.replica != s.db {
+		if err1 := s.replica.Close(); err1 != nil {
+			err = err1
+		}
+	}
+	if err1 := s.db.Close(); err1 != nil {
 		return err1
 	}
-	return err2
+	return err
 }
 
 func (s *Store) SpanReader() spanstore.Reader {
@@ -58,7 +113,7 @@ func (s *Store) SpanReader() spanstore.Reader {
 }
 
 func (s *Store) SpanWriter() spanstore.Writer {
-	return s.writer
+	return s.spanWriter
 }
 
 func (s *Store) DependencyReader() dependencystore.Reader {
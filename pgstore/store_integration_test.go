@@ -0,0 +1,141 @@
+//go:build integration
+// +build integration
+
+package pgstore
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+)
+
+func TestNewReaderFromConfig(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	traceID := model.TraceID{Low: 1}
+	writeTestSpans(t, NewWriter(db, hclog.NewNullLogger()), testSpan(traceID, 1, "frontend", "GET /", time.Now()))
+
+	var conf Configuration
+	opts := db.Options()
+	conf.Host, conf.Username, conf.Password, conf.Database = opts.Addr, opts.User, opts.Password, opts.Database
+	conf.PoolSize = 3
+	conf.MaxSpansPerTrace = 10
+	reader, err := NewReaderFromConfig(&conf, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if poolSize := reader.db.Options().PoolSize; poolSize != 3 {
+		t.Errorf("the reader has a pool of %d connections, want the 3 of the configuration", poolSize)
+	}
+	if reader.conf.MaxSpansPerTrace != 10 {
+		t.Errorf("the reader has the settings %+v, want those of the configuration", reader.conf)
+	}
+	trace, err := reader.GetTrace(context.Background(), traceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trace.Spans) != 1 {
+		t.Errorf("GetTrace() = %v, want the span written", trace.Spans)
+	}
+
+	// the pool belongs to the reader
+	if err := reader.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := reader.GetServices(context.Background()); err == nil {
+		t.Error("GetServices() after Close() succeeded, want the pool closed")
+	}
+}
+
+func TestStoreInSchema(t *testing.T) {
+	conf, done := newTestConfiguration(t)
+	defer done()
+	conf.SchemaName = "myschema"
+	store, closeStore, err := NewStore(conf, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeStore()
+
+	traceID := model.TraceID{Low: 1}
+	writeTestSpans(t, store.SpanWriter(), testSpan(traceID, 1, "frontend", "GET /", time.Now()))
+	trace, err := store.SpanReader().GetTrace(context.Background(), traceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trace.Spans) != 1 {
+		t.Errorf("GetTrace() = %v, want the span written", trace.Spans)
+	}
+
+	opts, err := (&Configuration{Host: conf.Host, Username: conf.Username, Password: conf.Password, Database: conf.Database}).pgOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := pg.Connect(opts)
+	defer db.Close()
+	for table, want := range map[string]int{"myschema.spans": 1, "myschema.services": 1, "myschema.span_logs": 0} {
+		var count int
+		if _, err := db.QueryOne(pg.Scan(&count), "SELECT count(*) FROM ?", pg.Ident(table)); err != nil {
+			t.Errorf("%s: %v", table, err)
+		} else if count != want {
+			t.Errorf("%s has %d rows, want %d", table, count, want)
+		}
+	}
+	var public string
+	if _, err := db.QueryOne(pg.Scan(&public), "SELECT coalesce(to_regclass('public.spans')::text, '')"); err != nil {
+		t.Fatal(err)
+	}
+	if len(public) > 0 {
+		t.Errorf("the tables were created in public too")
+	}
+}
+
+func TestStatementTimeout(t *testing.T) {
+	conf, done := newTestConfiguration(t)
+	defer done()
+	conf.SchemaName = "myschema"
+	conf.StatementTimeout = 250 * time.Millisecond
+	opts, err := conf.pgOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	db := pg.Connect(opts)
+	defer db.Close()
+
+	var timeout string
+	if _, err := db.QueryOne(pg.Scan(&timeout), "SHOW statement_timeout"); err != nil {
+		t.Fatal(err)
+	}
+	if timeout != "250ms" {
+		t.Errorf("statement_timeout = %s, want 250ms", timeout)
+	}
+	var searchPath string
+	if _, err := db.QueryOne(pg.Scan(&searchPath), "SHOW search_path"); err != nil {
+		t.Fatal(err)
+	}
+	if searchPath != "myschema, public" {
+		t.Errorf("search_path = %s, want the schema kept along the timeout", searchPath)
+	}
+	_, err = db.Exec("SELECT pg_sleep(1)")
+	if pgErr, ok := err.(pg.Error); !ok || pgErr.Field('C') != "57014" {
+		t.Errorf("a statement running past the timeout failed with %v, want it cancelled", err)
+	}
+
+	conf.StatementTimeout = 0
+	opts, err = conf.pgOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defaultDB := pg.Connect(opts)
+	defer defaultDB.Close()
+	if _, err := defaultDB.QueryOne(pg.Scan(&timeout), "SHOW statement_timeout"); err != nil {
+		t.Fatal(err)
+	}
+	if timeout != "0" {
+		t.Errorf("statement_timeout = %s without a timeout configured, want the server default", timeout)
+	}
+}
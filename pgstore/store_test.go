@@ -0,0 +1,133 @@
+package pgstore
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+var errRecorded = errors.New("query recorded")
+
+// recordingHook counts the queries of a db and fails them before they reach
+// a connection, so that the db needs no server
+type recordingHook struct {
+	queries int
+}
+
+func (h *recordingHook) BeforeQuery(ctx context.Context, _ *pg.QueryEvent) (context.Context, error) {
+	h.queries++
+	return ctx, errRecorded
+}
+
+func (h *recordingHook) AfterQuery(context.Context, *pg.QueryEvent) error {
+	return nil
+}
+
+// newRecordingDB returns a db pointing at no server whose queries are
+// counted by the hook
+func newRecordingDB() (*pg.DB, *recordingHook) {
+	db := pg.Connect(&pg.Options{Addr: "127.0.0.1:1"})
+	hook := &recordingHook{}
+	db.AddQueryHook(hook)
+	return db, hook
+}
+
+func TestNewReaderFromConfigInvalid(t *testing.T) {
+	conf := &Configuration{Host: "127.0.0.1:1", SSLMode: SSLModeRequire, ClientCertPath: "missing.crt", ClientKeyPath: "missing.key"}
+	if reader, err := NewReaderFromConfig(conf, hclog.NewNullLogger()); err == nil {
+		reader.Close()
+		t.Error("NewReaderFromConfig() with a missing client certificate succeeded")
+	}
+}
+
+func TestReaderRoutesReadsToReplica(t *testing.T) {
+	db, primary := newRecordingDB()
+	defer db.Close()
+	replicaDB, replica := newRecordingDB()
+	defer replicaDB.Close()
+	reader := NewReaderWithReplica(db, replicaDB, hclog.NewNullLogger())
+
+	ctx := context.Background()
+	query := &spanstore.TraceQueryParameters{ServiceName: "frontend", NumTraces: 10,
+		StartTimeMin: time.Now().Add(-time.Hour), StartTimeMax: time.Now()}
+	reads := map[string]func() error{
+		"FindTraces": func() error {
+			_, err := reader.FindTraces(ctx, query)
+			return err
+		},
+		"FindTraceIDs": func() error {
+			_, err := reader.FindTraceIDs(ctx, query)
+			return err
+		},
+		"GetServices": func() error {
+			_, err := reader.GetServices(ctx)
+			return err
+		},
+		"GetOperations": func() error {
+			_, err := reader.GetOperations(ctx, spanstore.OperationQueryParameters{ServiceName: "frontend"})
+			return err
+		},
+		"GetDependencies": func() error {
+			_, err := reader.GetDependencies(time.Now(), time.Hour)
+			return err
+		},
+	}
+	for name, read := range reads {
+		primary.queries, replica.queries = 0, 0
+		if err := read(); !errors.Is(err, errRecorded) {
+			t.Errorf("%s() error = %v, want the recorded query", name, err)
+		}
+		if primary.queries != 0 || replica.queries == 0 {
+			t.Errorf("%s() sent %d queries to the primary and %d to the replica, want only the replica", name, primary.queries, replica.queries)
+		}
+	}
+
+	primary.queries, replica.queries = 0, 0
+	if _, err := reader.GetTrace(ctx, model.TraceID{Low: 1}); !errors.Is(err, errRecorded) {
+		t.Errorf("GetTrace() error = %v, want the recorded query", err)
+	}
+	if primary.queries == 0 || replica.queries != 0 {
+		t.Errorf("GetTrace() sent %d queries to the primary and %d to the replica, want only the primary", primary.queries, replica.queries)
+	}
+}
+
+func TestStoreCloseReportsReplicaError(t *testing.T) {
+	db := pg.Connect(&pg.Options{Addr: "127.0.0.1:1"})
+	replica := pg.Connect(&pg.Options{Addr: "127.0.0.1:1"})
+	// closing it again fails
+	replica.Close()
+	writer := NewWriter(db, hclog.NewNullLogger())
+	store := &Store{
+		db:         db,
+		replica:    replica,
+		reader:     NewReaderWithReplica(db, replica, hclog.NewNullLogger()),
+		writer:     writer,
+		spanWriter: writer,
+	}
+	if err := store.Close(); err == nil {
+		t.Error("Close() ignored the error closing the replica")
+	}
+}
+
+func TestReaderPing(t *testing.T) {
+	db, hook := newRecordingDB()
+	defer db.Close()
+	reader := NewReader(db, hclog.NewNullLogger())
+	err := reader.Ping(context.Background())
+	if !errors.Is(err, errRecorded) || hook.queries != 1 {
+		t.Errorf("Ping() = %v after %d queries, want the recorded query", err, hook.queries)
+	}
+
+	// unreachable without a hook failing first
+	unreachable := pg.Connect(&pg.Options{Addr: "127.0.0.1:1"})
+	defer unreachable.Close()
+	if err := NewReader(unreachable, hclog.NewNullLogger()).Ping(context.Background()); err == nil {
+		t.Error("Ping() of an unreachable database succeeded")
+	}
+}
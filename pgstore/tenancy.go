@@ -0,0 +1,32 @@
+package pgstore
+
+import (
+	"context"
+
+	"github.com/go-pg/pg/v9/orm"
+)
+
+// tenantKey is the context key of the tenant, Jaeger 1.17 has no tenancy
+// package to carry it
+type tenantKey struct{}
+
+// ContextWithTenant returns a copy of ctx whose reads are restricted to the
+// spans of tenant, an empty tenant reads the spans of every tenant
+func ContextWithTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// TenantFromContext returns the tenant set by ContextWithTenant, empty when
+// the storage is used single tenant
+func TenantFromContext(ctx context.Context) string {
+	tenant, _ := ctx.Value(tenantKey{}).(string)
+	return tenant
+}
+
+// whereTenant restricts a query on spans to the tenant of ctx, if any
+func whereTenant(ctx context.Context, q *orm.Query) *orm.Query {
+	if tenant := TenantFromContext(ctx); len(tenant) > 0 {
+		return q.Where("span.tenant_id = ?", tenant)
+	}
+	return q
+}
@@ -0,0 +1,227 @@
+//go:build integration
+// +build integration
+
+package pgstore
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+func TestTenantsReadOnlyTheirSpans(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	logger := hclog.NewNullLogger()
+	reader := NewReader(db, logger, WithConfiguration(&Configuration{DependencyCacheTTL: time.Minute}))
+
+	// both tenants use the same trace and span ids at the same time
+	traceID := model.TraceID{Low: 1}
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	services := map[string][2]string{"a": {"shop", "payments"}, "b": {"bank", "ledger"}}
+	for tenant, names := range services {
+		parent := testSpan(traceID, 1, names[0], "GET /", start)
+		child := testSpan(traceID, 2, names[1], "charge", start.Add(time.Millisecond))
+		child.References = []model.SpanRef{model.NewChildOfRef(traceID, 1)}
+		child.Logs = []model.Log{{Timestamp: child.StartTime, Fields: []model.KeyValue{model.String("tenant", tenant)}}}
+		writeTestSpans(t, NewWriter(db, logger, WithTenant(tenant)), parent, child)
+	}
+	if count := countRows(t, db, (*Span)(nil)); count != 4 {
+		t.Fatalf("%d spans stored, want the 2 of each tenant", count)
+	}
+
+	for tenant, names := range services {
+		ctx := ContextWithTenant(context.Background(), tenant)
+		other := services["a"]
+		if tenant == "a" {
+			other = services["b"]
+		}
+
+		trace, err := reader.GetTrace(ctx, traceID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(trace.Spans) != 2 {
+			t.Fatalf("tenant %s: GetTrace() returned %d spans, want its 2", tenant, len(trace.Spans))
+		}
+		for _, span := range trace.Spans {
+			if span.Process.ServiceName != names[0] && span.Process.ServiceName != names[1] {
+				t.Errorf("tenant %s: GetTrace() returned a span of %s", tenant, span.Process.ServiceName)
+			}
+			if span.SpanID == 2 && (len(span.References) != 1 || len(span.Logs) != 1 || span.Logs[0].Fields[0].VStr != tenant) {
+				t.Errorf("tenant %s: the child has the references %v and logs %v, want only its own", tenant, span.References, span.Logs)
+			}
+		}
+
+		traces, err := reader.FindTraces(ctx, &spanstore.TraceQueryParameters{ServiceName: other[0],
+			StartTimeMin: start.Add(-time.Minute), StartTimeMax: start.Add(time.Minute)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(traces) != 0 {
+			t.Errorf("tenant %s: FindTraces() found %d traces of %s", tenant, len(traces), other[0])
+		}
+
+		got, err := reader.GetServices(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(got)
+		want := []string{names[0], names[1]}
+		sort.Strings(want)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("tenant %s: GetServices() = %v, want %v", tenant, got, want)
+		}
+
+		links, err := reader.GetDependenciesContext(ctx, time.Now(), time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(links) != 1 || links[0].Parent != names[0] || links[0].Child != names[1] || links[0].CallCount != 1 {
+			t.Errorf("tenant %s: GetDependencies() = %v, want %s calling %s once", tenant, links, names[0], names[1])
+		}
+
+		metrics, err := reader.GetOperationMetrics(ctx, other[0], time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(metrics) != 0 {
+			t.Errorf("tenant %s: GetOperationMetrics(%s) = %v, want none", tenant, other[0], metrics)
+		}
+		metrics, err = reader.GetOperationMetrics(ctx, names[0], time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(metrics) != 1 || metrics[0].Count != 1 {
+			t.Errorf("tenant %s: GetOperationMetrics(%s) = %v, want its one span", tenant, names[0], metrics)
+		}
+	}
+}
+
+func TestTenantsDoNotSeeEachOthersSpansInPredicates(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	logger := hclog.NewNullLogger()
+	reader := NewReader(db, logger, WithConfiguration(&Configuration{ServiceLookback: time.Hour}))
+
+	// tenant a wrote shop long ago, tenant b recently
+	now := time.Now().Truncate(time.Microsecond)
+	writeTestSpans(t, NewWriter(db, logger, WithTenant("a")), testSpan(model.TraceID{Low: 1}, 1, "shop", "GET /", now.Add(-2*time.Hour)))
+	writeTestSpans(t, NewWriter(db, logger, WithTenant("b")), testSpan(model.TraceID{Low: 2}, 1, "shop", "GET /", now.Add(-time.Minute)))
+
+	services, err := reader.GetServices(ContextWithTenant(context.Background(), "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(services) != 0 {
+		t.Errorf("tenant a: GetServices() = %v, want none within the lookback", services)
+	}
+
+	// both tenants share a trace, only the span of tenant b is flagged
+	traceID := model.TraceID{Low: 3}
+	writeTestSpans(t, NewWriter(db, logger, WithTenant("a")), testSpan(traceID, 1, "cart", "add", now))
+	flagged := testSpan(traceID, 1, "cart", "add", now)
+	flagged.Tags = []model.KeyValue{model.String("flag", "on")}
+	writeTestSpans(t, NewWriter(db, logger, WithTenant("b")), flagged)
+
+	ids, err := reader.FindTraceIDs(ContextWithTenant(context.Background(), "a"), &spanstore.TraceQueryParameters{
+		ServiceName: "cart", Tags: map[string]string{"flag": "!"},
+		StartTimeMin: now.Add(-time.Minute), StartTimeMax: now.Add(time.Minute), NumTraces: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ids, []model.TraceID{traceID}) {
+		t.Errorf("tenant a: traces without the flag = %v, want %v", ids, traceID)
+	}
+}
+
+func TestStoreOfATenant(t *testing.T) {
+	conf, done := newTestConfiguration(t)
+	defer done()
+	conf.Tenant = "a"
+	store, closeStore, err := NewStore(conf, hclog.NewNullLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeStore()
+	db := store.db
+
+	// tenant b stores a trace with the same id beside the one of the store
+	traceID := model.TraceID{Low: 1}
+	start := time.Now().Add(-time.Minute)
+	writeTestSpans(t, store.SpanWriter(), testSpan(traceID, 1, "shop", "GET /", start))
+	writeTestSpans(t, NewWriter(db, hclog.NewNullLogger(), WithTenant("b")), testSpan(traceID, 1, "bank", "GET /", start))
+	var tenants []string
+	if err := db.Model((*Span)(nil)).Column("tenant_id").Order("tenant_id").Select(&tenants); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(tenants, []string{"a", "b"}) {
+		t.Fatalf("spans stored for the tenants %v, want a and b", tenants)
+	}
+
+	trace, err := store.SpanReader().GetTrace(context.Background(), traceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trace.Spans) != 1 || trace.Spans[0].Process.ServiceName != "shop" {
+		t.Errorf("GetTrace() = %v, want the span of tenant a", trace.Spans)
+	}
+	services, err := store.SpanReader().GetServices(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(services, []string{"shop"}) {
+		t.Errorf("GetServices() = %v, want the service of tenant a", services)
+	}
+	// the tenant of the context is read rather than the configured one
+	trace, err = store.SpanReader().GetTrace(ContextWithTenant(context.Background(), "b"), traceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trace.Spans) != 1 || trace.Spans[0].Process.ServiceName != "bank" {
+		t.Errorf("GetTrace() of tenant b = %v, want its span", trace.Spans)
+	}
+}
+
+func TestTenantsReadOnlyTheirPrecomputedDependencies(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	logger := hclog.NewNullLogger()
+	reader := NewReader(db, logger)
+
+	ts := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	links := map[string]model.DependencyLink{
+		"a": {Parent: "shop", Child: "payments", CallCount: 3},
+		"b": {Parent: "bank", Child: "ledger", CallCount: 5},
+	}
+	for tenant, link := range links {
+		if err := NewDependencyWriter(db, logger, WithDependencyTenant(tenant)).WriteDependencies(ts, []model.DependencyLink{link}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for tenant, link := range links {
+		got, err := reader.GetDependenciesContext(ContextWithTenant(context.Background(), tenant), time.Now(), time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		link.Source = model.JaegerDependencyLinkSource
+		if want := []model.DependencyLink{link}; !reflect.DeepEqual(got, want) {
+			t.Errorf("tenant %s: GetDependencies() = %v, want %v", tenant, got, want)
+		}
+	}
+	// every tenant without one
+	got, err := reader.GetDependencies(time.Now(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Errorf("GetDependencies() = %v, want the links of both tenants", got)
+	}
+}
@@ -0,0 +1,92 @@
+package pgstore
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jaegertracing/jaeger/model"
+)
+
+// FindTraceIDsByPrefix returns the ids of the traces whose hex representation
+// starts with hexPrefix, newest traces first. The prefix is matched against
+// the 32 zero padded digits of the full id, high word first, and for the 64
+// bit ids against the 16 zero padded digits of their low word as well.
+func (r *Reader) FindTraceIDsByPrefix(ctx context.Context, hexPrefix string, limit int) (ret []model.TraceID, err error) {
+	defer r.metrics.observe("FindTraceIDsByPrefix", time.Now(), &err)
+	ospan, ctx := r.startSpan(ctx, "FindTraceIDsByPrefix")
+	defer finishSpan(ospan, &err)
+	ctx, cancel := r.withQueryTimeout(ctx)
+	defer cancel()
+	ospan.SetTag("prefix", hexPrefix)
+
+	builder, err := traceIDPrefixWhere(hexPrefix)
+	if err != nil {
+		return nil, wrapError(err, "FindTraceIDsByPrefix(%s)", hexPrefix)
+	}
+	limit = r.numTraces(limit)
+	err = r.retry(ctx, func() error {
+		ret = nil
+		return whereTenant(ctx, r.replica.ModelContext(ctx, (*Span)(nil))).
+			ColumnExpr("trace_id_low as Low, trace_id_high as High").
+			Where(builder.where, builder.params...).
+			Group("trace_id_low", "trace_id_high").
+			OrderExpr(traceIDsOrder).
+			Limit(limit).Select(&ret)
+	})
+	ospan.SetTag("result_count", len(ret))
+
+	return ret, wrapError(err, "FindTraceIDsByPrefix(%s)", hexPrefix)
+}
+
+// traceIDPrefixWhere matches the trace ids starting with hexPrefix. A prefix
+// of up to 16 digits bounds the high word only, a longer one fixes the high
+// word and bounds the low word.
+func traceIDPrefixWhere(hexPrefix string) (*whereBuilder, error) {
+	prefix := strings.ToLower(hexPrefix)
+	if len(prefix) == 0 || len(prefix) > 32 {
+		return nil, fmt.Errorf("trace id prefix must have 1 to 32 hex digits, got %d", len(prefix))
+	}
+	if len(strings.TrimLeft(prefix, "0123456789abcdef")) > 0 {
+		return nil, fmt.Errorf("trace id prefix %q isn't hex", hexPrefix)
+	}
+
+	builder := &whereBuilder{}
+	if len(prefix) <= 16 {
+		from, to := hexPrefixRange(prefix)
+		builder.where, builder.params = uint64RangePredicate("trace_id_high", from, to)
+		// the same digits as the start of a 64 bit id
+		low, lowParams := uint64RangePredicate("trace_id_low", from, to)
+		builder.where = "(" + builder.where + " OR (trace_id_high = 0 AND " + low + "))"
+		builder.params = append(builder.params, lowParams...)
+		return builder, nil
+	}
+
+	high, _ := strconv.ParseUint(prefix[:16], 16, 64)
+	from, to := hexPrefixRange(prefix[16:])
+	low, lowParams := uint64RangePredicate("trace_id_low", from, to)
+	builder.andWhere(int64(high), "trace_id_high = ?")
+	builder.andWhereParams(low, lowParams...)
+	return builder, nil
+}
+
+// hexPrefixRange returns the smallest and the largest uint64 whose 16 hex
+// digits start with prefix
+func hexPrefixRange(prefix string) (uint64, uint64) {
+	from, _ := strconv.ParseUint(prefix+strings.Repeat("0", 16-len(prefix)), 16, 64)
+	to, _ := strconv.ParseUint(prefix+strings.Repeat("f", 16-len(prefix)), 16, 64)
+	return from, to
+}
+
+// uint64RangePredicate matches the unsigned range from..to on a column holding
+// the ids as signed bigint, a range crossing 2^63 wraps around and becomes two
+func uint64RangePredicate(column string, from, to uint64) (string, []interface{}) {
+	if (from > math.MaxInt64) == (to > math.MaxInt64) {
+		return column + " BETWEEN ? AND ?", []interface{}{int64(from), int64(to)}
+	}
+	return "(" + column + " BETWEEN ? AND ? OR " + column + " BETWEEN ? AND ?)",
+		[]interface{}{int64(from), int64(math.MaxInt64), int64(math.MinInt64), int64(to)}
+}
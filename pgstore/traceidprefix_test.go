@@ -0,0 +1,99 @@
+package pgstore
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+// inRanges evaluates the BETWEEN pairs of uint64RangePredicate for the id
+// stored as a signed bigint
+func inRanges(params []interface{}, id uint64) bool {
+	for i := 0; i+1 < len(params); i += 2 {
+		if v := int64(id); params[i].(int64) <= v && v <= params[i+1].(int64) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestUint64RangePredicate(t *testing.T) {
+	tests := []struct {
+		from, to uint64
+		where    string
+		params   []interface{}
+	}{
+		{1, 10, "id BETWEEN ? AND ?", []interface{}{int64(1), int64(10)}},
+		{1 << 63, math.MaxUint64, "id BETWEEN ? AND ?", []interface{}{int64(math.MinInt64), int64(-1)}},
+		{math.MaxInt64 - 1, 1<<63 + 1, "(id BETWEEN ? AND ? OR id BETWEEN ? AND ?)",
+			[]interface{}{int64(math.MaxInt64 - 1), int64(math.MaxInt64), int64(math.MinInt64), int64(math.MinInt64 + 1)}},
+	}
+	for _, tt := range tests {
+		where, params := uint64RangePredicate("id", tt.from, tt.to)
+		if where != tt.where || !reflect.DeepEqual(params, tt.params) {
+			t.Errorf("uint64RangePredicate(%d, %d) = %q %v, want %q %v", tt.from, tt.to, where, params, tt.where, tt.params)
+		}
+		for _, id := range []uint64{0, 1, 10, 11, math.MaxInt64 - 2, math.MaxInt64 - 1, math.MaxInt64, 1 << 63, 1<<63 + 1, 1<<63 + 2, math.MaxUint64} {
+			if want := tt.from <= id && id <= tt.to; inRanges(params, id) != want {
+				t.Errorf("uint64RangePredicate(%d, %d) matches %d: %v, want %v", tt.from, tt.to, id, !want, want)
+			}
+		}
+	}
+}
+
+func TestHexPrefixRange(t *testing.T) {
+	tests := []struct {
+		prefix   string
+		from, to uint64
+	}{
+		{"0", 0, 0x0fffffffffffffff},
+		{"8", 1 << 63, 0x8fffffffffffffff},
+		{"abc", 0xabc0000000000000, 0xabcfffffffffffff},
+		{"ffffffffffffffff", math.MaxUint64, math.MaxUint64},
+	}
+	for _, tt := range tests {
+		if from, to := hexPrefixRange(tt.prefix); from != tt.from || to != tt.to {
+			t.Errorf("hexPrefixRange(%q) = %x, %x, want %x, %x", tt.prefix, from, to, tt.from, tt.to)
+		}
+	}
+}
+
+func TestTraceIDPrefixWhere(t *testing.T) {
+	tests := []struct {
+		prefix string
+		where  string
+		params []interface{}
+	}{
+		{
+			prefix: "AB",
+			where:  "(trace_id_high BETWEEN ? AND ? OR (trace_id_high = 0 AND trace_id_low BETWEEN ? AND ?))",
+			params: []interface{}{int64(-0x5500000000000000), int64(-0x5400000000000001), int64(-0x5500000000000000), int64(-0x5400000000000001)},
+		},
+		{
+			prefix: "00000000000000010a",
+			where:  "trace_id_high = ? AND trace_id_low BETWEEN ? AND ?",
+			params: []interface{}{int64(1), int64(0x0a00000000000000), int64(0x0affffffffffffff)},
+		},
+		{
+			prefix: "000000000000000100000000000000ff",
+			where:  "trace_id_high = ? AND trace_id_low BETWEEN ? AND ?",
+			params: []interface{}{int64(1), int64(0xff), int64(0xff)},
+		},
+	}
+	for _, tt := range tests {
+		builder, err := traceIDPrefixWhere(tt.prefix)
+		if err != nil {
+			t.Errorf("traceIDPrefixWhere(%q): %v", tt.prefix, err)
+			continue
+		}
+		if builder.where != tt.where || !reflect.DeepEqual(builder.params, tt.params) {
+			t.Errorf("traceIDPrefixWhere(%q) = %q %v, want %q %v", tt.prefix, builder.where, builder.params, tt.where, tt.params)
+		}
+	}
+
+	for _, prefix := range []string{"", "xyz", "0x1f", "000000000000000000000000000000000"} {
+		if _, err := traceIDPrefixWhere(prefix); err == nil {
+			t.Errorf("traceIDPrefixWhere(%q) succeeded", prefix)
+		}
+	}
+}
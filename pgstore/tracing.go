@@ -0,0 +1,80 @@
+package pgstore
+
+import (
+	"context"
+
+	"github.com/go-pg/pg/v9"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/ext"
+	otlog "github.com/opentracing/opentracing-go/log"
+)
+
+// WithTracer makes the Reader trace every method and the SQL statements it
+// runs. Without it the Reader uses a no-op tracer.
+func WithTracer(tracer opentracing.Tracer) ReaderOption {
+	return func(r *Reader) {
+		r.tracer = tracer
+		r.ownHandles()
+		r.db.AddQueryHook(tracingHook{tracer: tracer})
+		if r.replica != r.db {
+			r.replica.AddQueryHook(tracingHook{tracer: tracer})
+		}
+	}
+}
+
+// startSpan starts the span of a Reader method. The context returned also
+// carries the Configuration.Tenant unless the caller set a tenant already.
+func (r *Reader) startSpan(ctx context.Context, method string) (opentracing.Span, context.Context) {
+	if len(r.conf.Tenant) > 0 && len(TenantFromContext(ctx)) == 0 {
+		ctx = ContextWithTenant(ctx, r.conf.Tenant)
+	}
+	span, ctx := opentracing.StartSpanFromContextWithTracer(ctx, r.tracer, "pgstore."+method)
+	ext.DBType.Set(span, "postgresql")
+	return span, context.WithValue(ctx, methodKey{}, method)
+}
+
+// finishSpan finishes the span of a Reader method, it is meant to be
+// deferred with a pointer to the named error result
+func finishSpan(span opentracing.Span, err *error) {
+	if *err != nil {
+		ext.Error.Set(span, true)
+		span.LogFields(otlog.Error(*err))
+	}
+	span.Finish()
+}
+
+// tracingHook records every statement issued within a traced Reader method
+// as a child span carrying the SQL
+type tracingHook struct {
+	tracer opentracing.Tracer
+}
+
+var _ pg.QueryHook = tracingHook{}
+
+func (h tracingHook) BeforeQuery(ctx context.Context, event *pg.QueryEvent) (context.Context, error) {
+	parent := opentracing.SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := h.tracer.StartSpan("pgstore.query", opentracing.ChildOf(parent.Context()))
+	ext.DBType.Set(span, "postgresql")
+	if statement, err := event.FormattedQuery(); err == nil {
+		ext.DBStatement.Set(span, statement)
+	}
+	return opentracing.ContextWithSpan(ctx, span), nil
+}
+
+func (h tracingHook) AfterQuery(ctx context.Context, event *pg.QueryEvent) error {
+	span := opentracing.SpanFromContext(ctx)
+	if span == nil {
+		return nil
+	}
+	if event.Err != nil {
+		ext.Error.Set(span, true)
+		span.LogFields(otlog.Error(event.Err))
+	} else if event.Result != nil {
+		span.SetTag("db.rows", event.Result.RowsReturned())
+	}
+	span.Finish()
+	return nil
+}
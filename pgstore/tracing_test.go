@@ -0,0 +1,114 @@
+package pgstore
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-pg/pg/v9"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+	"github.com/opentracing/opentracing-go"
+	"github.com/opentracing/opentracing-go/mocktracer"
+)
+
+func TestReaderMethodSpan(t *testing.T) {
+	db, _ := newRecordingDB()
+	defer db.Close()
+	tracer := mocktracer.New()
+	reader := NewReader(db, hclog.NewNullLogger(), WithTracer(tracer))
+
+	if _, err := reader.FindTraces(context.Background(), &spanstore.TraceQueryParameters{ServiceName: "frontend"}); !errors.Is(err, errRecorded) {
+		t.Fatalf("FindTraces() error = %v, want the recorded query", err)
+	}
+	// FindTraces looks the trace ids up within its own span
+	var span *mocktracer.MockSpan
+	for _, finished := range tracer.FinishedSpans() {
+		if finished.OperationName == "pgstore.FindTraces" {
+			span = finished
+		}
+	}
+	if span == nil {
+		t.Fatalf("finished spans %v, want the one of FindTraces", tracer.FinishedSpans())
+	}
+	tags := span.Tags()
+	for key, want := range map[string]interface{}{"db.type": "postgresql", "service_name": "frontend", "error": true} {
+		if tags[key] != want {
+			t.Errorf("tag %s = %v, want %v", key, tags[key], want)
+		}
+	}
+	if logs := span.Logs(); len(logs) != 1 {
+		t.Errorf("span logs %v, want the error", logs)
+	}
+}
+
+func TestTracingHook(t *testing.T) {
+	db := pg.Connect(&pg.Options{Addr: "127.0.0.1:1"})
+	defer db.Close()
+	tracer := mocktracer.New()
+	hook := tracingHook{tracer: tracer}
+
+	// statements outside of a traced method are not recorded
+	event := &pg.QueryEvent{DB: db, Query: "SELECT ?", Params: []interface{}{1}}
+	ctx, err := hook.BeforeQuery(context.Background(), event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := hook.AfterQuery(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+	if spans := tracer.FinishedSpans(); len(spans) != 0 {
+		t.Fatalf("finished spans %v without a parent, want none", spans)
+	}
+
+	parent := tracer.StartSpan("pgstore.GetTrace")
+	ctx, err = hook.BeforeQuery(opentracing.ContextWithSpan(context.Background(), parent), event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	event.Err = errors.New("boom")
+	if err := hook.AfterQuery(ctx, event); err != nil {
+		t.Fatal(err)
+	}
+	spans := tracer.FinishedSpans()
+	if len(spans) != 1 || spans[0].OperationName != "pgstore.query" {
+		t.Fatalf("finished spans %v, want the one of the statement", spans)
+	}
+	if want := parent.(*mocktracer.MockSpan).SpanContext.SpanID; spans[0].ParentID != want {
+		t.Errorf("statement span has the parent %d, want %d", spans[0].ParentID, want)
+	}
+	tags := spans[0].Tags()
+	for key, want := range map[string]interface{}{"db.type": "postgresql", "db.statement": "SELECT 1", "error": true} {
+		if tags[key] != want {
+			t.Errorf("tag %s = %v, want %v", key, tags[key], want)
+		}
+	}
+}
+
+func TestWithTracerHooksTheReaderOnly(t *testing.T) {
+	db := pg.Connect(&pg.Options{Addr: "127.0.0.1:1"})
+	defer db.Close()
+	tracer := mocktracer.New()
+	first := NewReader(db, hclog.NewNullLogger(), WithTracer(tracer))
+	NewReader(db, hclog.NewNullLogger(), WithTracer(tracer))
+
+	// a statement of the Writer within a traced request
+	parent := tracer.StartSpan("collector")
+	db.ExecContext(opentracing.ContextWithSpan(context.Background(), parent), "SELECT 1")
+	if spans := tracer.FinishedSpans(); len(spans) != 0 {
+		t.Fatalf("finished spans %v for a statement outside of the Readers, want none", spans)
+	}
+
+	// the statement of a Reader is traced once, not by each Reader
+	first.GetTrace(context.Background(), model.TraceID{Low: 1})
+	statements := 0
+	for _, span := range tracer.FinishedSpans() {
+		if span.OperationName == "pgstore.query" {
+			statements++
+		}
+	}
+	if statements != 1 {
+		t.Errorf("%d statement spans of GetTrace(), want 1", statements)
+	}
+}
@@ -1,7 +1,10 @@
 package pgstore
 
 import (
+	"context"
+	"fmt"
 	"io"
+	"unicode/utf8"
 
 	hclog "github.com/hashicorp/go-hclog"
 
@@ -17,158 +20,245 @@ var _ io.Closer = (*Writer)(nil)
 
 // Writer handles all writes to PostgreSQL 2.x for the Jaeger data model
 type Writer struct {
-	db                  *pg.DB
-	spanMeasurement     string
-	spanMetaMeasurement string
-	logMeasurement      string
-
-	// Points as line protocol
-	//writeCh chan string
-	//writeWG sync.WaitGroup
+	db *pg.DB
 
 	logger hclog.Logger
+
+	tagStorage string
+	// stored with every span, see WithTenant
+	tenant string
+
+	// see WithMaxOperationNameLength
+	maxOperationNameLength int
+	// see WithDropInvalidSpans
+	dropInvalidSpans bool
 }
 
-// NewWriter returns a Writer for PostgreSQL v2.x
-func NewWriter(db *pg.DB, logger hclog.Logger) *Writer {
-	w := &Writer{
-		db: db,
-		//writeCh: make(chan string),
-		logger: logger,
+// WriterOption customizes a Writer built by NewWriter
+type WriterOption func(*Writer)
+
+// WithTagStorage makes the Writer store tags in the given format, see
+// Configuration.TagStorage
+func WithTagStorage(tagStorage string) WriterOption {
+	return func(w *Writer) {
+		w.tagStorage = tagStorage
 	}
+}
 
-	db.CreateTable(&Service{}, &orm.CreateTableOptions{})
-	db.CreateTable(&Operation{}, &orm.CreateTableOptions{})
-	db.CreateTable(&Span{}, &orm.CreateTableOptions{})
-	if _, err := db.Exec("SELECT * from create_hypertable('spans', 'start_time');"); err != nil {
-		w.logger.Warn("Couldn't use Timescale, queries will be slower...", "err", err)
+// WithTenant makes the Writer store the spans as those of tenant, they are
+// read through a context made by ContextWithTenant. The trace and span ids
+// are only unique within a tenant, another tenant may use the same ones.
+func WithTenant(tenant string) WriterOption {
+	return func(w *Writer) {
+		w.tenant = tenant
 	}
-	db.CreateTable(&SpanRef{}, &orm.CreateTableOptions{})
+}
 
-	if _, err := db.Exec("CREATE INDEX IDX_SPAN_REFS_SOURCE_SPAN_ID ON span_refs USING btree (source_span_id ASC NULLS LAST)"); err != nil {
-		w.logger.Warn("Couldn't create SPAN_REFS index, queries will be slower...", "err", err)
+// WithMaxOperationNameLength makes the Writer truncate operation names to max
+// bytes, see Configuration.MaxOperationNameLength
+func WithMaxOperationNameLength(max int) WriterOption {
+	return func(w *Writer) {
+		w.maxOperationNameLength = max
 	}
-	db.CreateTable(&Log{}, &orm.CreateTableOptions{})
+}
+
+// WithDropInvalidSpans makes the Writer drop the spans failing validateSpan
+// with a warning rather than returning an error
+func WithDropInvalidSpans(drop bool) WriterOption {
+	return func(w *Writer) {
+		w.dropInvalidSpans = drop
+	}
+}
 
-	//w.writeWG.Add(1)
-	//go w.batchAndWrite()
+// NewWriter returns a Writer for PostgreSQL v2.x, the schema is expected to be
+// created by Migrate
+func NewWriter(db *pg.DB, logger hclog.Logger, opts ...WriterOption) *Writer {
+	w := &Writer{
+		db:         db,
+		logger:     logger,
+		tagStorage: TagStorageJSONB,
+	}
+	for _, opt := range opts {
+		opt(w)
+	}
 
 	return w
 }
 
 // Close triggers a graceful shutdown
 func (w *Writer) Close() error {
-	//close(w.writeCh)
-	//w.writeWG.Wait()
 	return nil
 }
 
-// WriteSpan saves the span into PostgreSQL
+// spanConflict skips a span whose trace and span id are stored already, which
+// keeps writes idempotent. The target is the unique index of migration 21, a
+// span delivered again has the same start time.
+const spanConflict = "(trace_id_low, trace_id_high, id, start_time, tenant_id) DO NOTHING"
+
+// WriteSpan saves the span into PostgreSQL, a span written before is ignored.
+// The span is stored in one transaction with its refs and logs, a failed
+// write leaves nothing behind for the retry to skip.
 func (w *Writer) WriteSpan(span *model.Span) error {
-	service := &Service{
-		ServiceName: span.Process.ServiceName,
-	}
-	if _, err := w.db.Model(service).Where("service_name = ?", span.Process.ServiceName).
-		OnConflict("(service_name) DO NOTHING").Returning("id").Limit(1).SelectOrInsert(); err != nil {
-		return err
-	}
-	operation := &Operation{
-		OperationName: span.OperationName,
-	}
-	if _, err := w.db.Model(operation).Where("operation_name = ?", span.OperationName).
-		OnConflict("(operation_name) DO NOTHING").Returning("id").Limit(1).SelectOrInsert(); err != nil {
-		return err
-	}
-	if _, err := w.db.Model(&Span{
-		ID:          span.SpanID,
-		TraceIDLow:  span.TraceID.Low,
-		TraceIDHigh: span.TraceID.High,
-		OperationID: operation.ID,
-		Flags:       span.Flags,
-		StartTime:   span.StartTime,
-		Duration:    span.Duration,
-		Tags:        mapModelKV(span.Tags),
-		ServiceID:   service.ID,
-		ProcessID:   span.ProcessID,
-		ProcessTags: mapModelKV(span.Process.Tags),
-		Warnings:    span.Warnings,
-	}).OnConflict("(id, start_time) DO UPDATE").Insert(); err != nil {
+	return w.WriteSpanContext(context.Background(), span)
+}
+
+// WriteSpanContext is WriteSpan with a context canceling the statements, the
+// spanstore.Writer of Jaeger 1.17 passes none
+func (w *Writer) WriteSpanContext(ctx context.Context, span *model.Span) error {
+	dbSpan, err := w.prepareSpan(ctx, span)
+	if err != nil || dbSpan == nil {
 		return err
 	}
+	refs, logs := w.spanDetails(span)
+	return w.writeSpan(ctx, dbSpan, refs, logs)
+}
 
-	insertRefs(w.db, span)
-	insertLogs(w.db, span)
+// writeSpan stores the converted span with its refs and logs in one
+// transaction, a span written before is ignored
+func (w *Writer) writeSpan(ctx context.Context, dbSpan *Span, refs []*SpanRef, logs []*Log) error {
+	return w.db.WithContext(ctx).RunInTransaction(func(tx *pg.Tx) error {
+		res, err := insertSpanColumns(tx.Model(dbSpan), w.tagStorage).
+			OnConflict(spanConflict).Insert()
+		if err != nil {
+			return err
+		}
+		if res.RowsAffected() == 0 {
+			// delivered again, e.g. by a retrying collector, the refs and
+			// logs are stored already
+			return nil
+		}
 
-	return nil
+		if err := insertRefs(tx, refs); err != nil {
+			return err
+		}
+		return insertLogs(tx, logs)
+	})
 }
 
-func insertLogs(db *pg.DB, input *model.Span) (ret []*Log, err error) {
-	ret = make([]*Log, 0, len(input.Logs))
-	if input.Logs == nil {
-		return ret, err
+// spanDetails converts the refs and logs of the span into their database
+// representation, of the tenant of the span
+func (w *Writer) spanDetails(span *model.Span) ([]*SpanRef, []*Log) {
+	refs, logs := toDBSpanRefs(span), toDBLogs(span)
+	for _, ref := range refs {
+		ref.TenantID = w.tenant
 	}
-	for _, log := range input.Logs {
-		itm := &Log{SpanID: input.SpanID, Timestamp: log.Timestamp, Fields: mapModelKV(log.Fields)}
-		ret = append(ret, itm)
+	for _, log := range logs {
+		log.TenantID = w.tenant
+	}
+	return refs, logs
+}
 
-		if _, err = db.Model(itm).Insert(); err != nil {
-			return ret, err
+// prepareSpan resolves the service and operation of the span and converts it
+// into its database representation, it returns nil for an invalid span dropped
+// with WithDropInvalidSpans
+func (w *Writer) prepareSpan(ctx context.Context, span *model.Span) (*Span, error) {
+	if err := validateSpan(span); err != nil {
+		if w.dropInvalidSpans {
+			w.logger.Warn("Dropping invalid span", "err", err)
+			return nil, nil
 		}
+		return nil, err
+	}
+	serviceID, err := w.getOrCreateService(ctx, span.Process.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+	spanKind, _ := span.GetSpanKind()
+	operationName, truncated := truncateName(span.OperationName, w.maxOperationNameLength)
+	operationID, err := w.getOrCreateOperation(ctx, serviceID, operationName, spanKind, truncated)
+	if err != nil {
+		return nil, err
+	}
+	service := &Service{ID: serviceID, ServiceName: span.Process.ServiceName}
+	operation := &Operation{ID: operationID, ServiceID: serviceID, OperationName: operationName, SpanKind: spanKind, Truncated: truncated}
+	dbSpan := fromModelSpan(span, service, operation)
+	dbSpan.TenantID = w.tenant
+	if truncated {
+		// a copy, the warnings of the model span belong to the caller
+		dbSpan.Warnings = append(append([]string(nil), dbSpan.Warnings...), fmt.Sprintf("operation name truncated from %d to %d bytes", len(span.OperationName), len(operationName)))
 	}
-	return ret, err
+	if w.tagStorage == TagStorageHstore {
+		dbSpan.Tags, dbSpan.ProcessTags = nil, nil
+		dbSpan.TagsHstore, dbSpan.TagTypes = hstoreModelKV(span.Tags)
+		dbSpan.ProcessTagsHstore, dbSpan.ProcessTagTypes = hstoreModelKV(span.Process.Tags)
+	}
+	return dbSpan, nil
 }
 
-func insertRefs(db *pg.DB, input *model.Span) (ret []*SpanRef, err error) {
-	ret = make([]*SpanRef, 0, len(input.References))
-	if input.References == nil {
-		return ret, err
+// getOrCreateService returns the id of the named service, concurrent writers
+// of a new service end up with the same row thanks to the unique constraint
+func (w *Writer) getOrCreateService(ctx context.Context, name string) (int64, error) {
+	service := &Service{ServiceName: name}
+	selectID := func() error {
+		return w.db.ModelContext(ctx, service).Column("id").Where("service_name = ?", name).Select()
 	}
-	for _, ref := range input.References {
-		if ref.SpanID > 0 {
-			itm := &SpanRef{SourceSpanID: input.SpanID, ChildSpanID: ref.SpanID, TraceIDLow: ref.TraceID.Low, TraceIDHigh: ref.TraceID.High, RefType: ref.RefType}
-			ret = append(ret, itm)
-
-			if _, err := db.Model(itm).Insert(); err != nil {
-				return ret, err
-			}
-		}
+	err := selectID()
+	if err != pg.ErrNoRows {
+		return service.ID, err
 	}
-	return ret, err
+	_, err = w.db.ModelContext(ctx, service).OnConflict("(service_name) DO NOTHING").Returning("id").Insert()
+	if err == pg.ErrNoRows {
+		err = selectID()
+	}
+	return service.ID, err
 }
 
-/*func (w *Writer) batchAndWrite() {
-	defer w.writeWG.Done()
-
-	batch := make([]string, 0, common.MaxFlushPoints)
-	var t <-chan time.Time
-
-	for {
-		select {
-		case point, ok := <-w.writeCh:
-			if !ok {
-				if len(batch) > 0 {
-					w.writeBatch(batch)
-					return
-				}
-			}
+// getOrCreateOperation returns the id of the operation of the given service
+// and span kind, inserting it when it's not known yet
+func (w *Writer) getOrCreateOperation(ctx context.Context, serviceID int64, name string, kind string, truncated bool) (int64, error) {
+	operation := &Operation{ServiceID: serviceID, OperationName: name, SpanKind: kind, Truncated: truncated}
+	selectID := func() error {
+		return w.db.ModelContext(ctx, operation).Column("id").
+			Where("service_id = ? AND operation_name = ? AND span_kind = ?", serviceID, name, kind).Select()
+	}
+	err := selectID()
+	if err != pg.ErrNoRows {
+		return operation.ID, err
+	}
+	_, err = w.db.ModelContext(ctx, operation).OnConflict("(service_id, operation_name, span_kind) DO NOTHING").Returning("id").Insert()
+	if err == pg.ErrNoRows {
+		err = selectID()
+	}
+	return operation.ID, err
+}
 
-			if t == nil {
-				t = time.After(common.MaxFlushInterval)
-			}
+// validateSpan rejects the spans which can't be stored or found again
+func validateSpan(span *model.Span) error {
+	switch {
+	case span.TraceID.Low == 0 && span.TraceID.High == 0:
+		return fmt.Errorf("pgstore: span %s has no trace id", span.SpanID)
+	case span.SpanID == 0:
+		return fmt.Errorf("pgstore: span of trace %s has no span id", span.TraceID)
+	case span.Process == nil:
+		return fmt.Errorf("pgstore: span %s of trace %s has no process", span.SpanID, span.TraceID)
+	}
+	return nil
+}
 
-			batch = append(batch, point)
+// truncateName cuts name to at most max bytes without splitting a UTF-8
+// sequence and reports whether it did, a max of 0 keeps it whole
+func truncateName(name string, max int) (string, bool) {
+	if max <= 0 || len(name) <= max {
+		return name, false
+	}
+	for max > 0 && !utf8.RuneStart(name[max]) {
+		max--
+	}
+	return name[:max], true
+}
 
-			if len(batch) == cap(batch) {
-				//w.writeBatch(batch)
-				batch = batch[:0]
-				t = nil
-			}
+func insertLogs(db orm.DB, logs []*Log) error {
+	if len(logs) == 0 {
+		return nil
+	}
+	_, err := db.Model(&logs).Insert()
+	return err
+}
 
-		case <-t:
-			//w.writeBatch(batch)
-			batch = batch[:0]
-			t = nil
-		}
+func insertRefs(db orm.DB, refs []*SpanRef) error {
+	if len(refs) == 0 {
+		return nil
 	}
+	_, err := db.Model(&refs).Insert()
+	return err
 }
-*/
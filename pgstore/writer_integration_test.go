@@ -0,0 +1,314 @@
+//go:build integration
+// +build integration
+
+package pgstore
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-pg/pg/v9"
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+	"github.com/jaegertracing/jaeger/storage/spanstore"
+)
+
+func TestWriteSpanRoundTrip(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	writer := NewWriter(db, hclog.NewNullLogger())
+	reader := NewReader(db, hclog.NewNullLogger())
+
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	traceID := model.TraceID{High: 7, Low: 1}
+	span := testSpan(traceID, 2, "backend", "query", start)
+	span.Duration = 150 * time.Millisecond
+	span.Tags = []model.KeyValue{model.String("db.statement", "SELECT 1")}
+	span.References = []model.SpanRef{model.NewChildOfRef(traceID, 1)}
+	writeTestSpans(t, writer, span)
+
+	trace, err := reader.GetTrace(context.Background(), traceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trace.Spans) != 1 {
+		t.Fatalf("GetTrace() returned %d spans, want 1", len(trace.Spans))
+	}
+	got := trace.Spans[0]
+	if got.TraceID != traceID || got.SpanID != 2 || got.OperationName != "query" ||
+		!got.StartTime.Equal(start) || got.Duration != span.Duration {
+		t.Errorf("GetTrace() = span %s/%s %q at %s for %s, want %s/2 %q at %s for %s", got.TraceID, got.SpanID,
+			got.OperationName, got.StartTime, got.Duration, traceID, "query", start, span.Duration)
+	}
+	if !reflect.DeepEqual(got.Tags, span.Tags) {
+		t.Errorf("GetTrace() tags = %v, want %v", got.Tags, span.Tags)
+	}
+	if !reflect.DeepEqual(got.References, span.References) {
+		t.Errorf("GetTrace() references = %v, want %v", got.References, span.References)
+	}
+	if got.Process == nil || got.Process.ServiceName != "backend" || !reflect.DeepEqual(got.Process.Tags, span.Process.Tags) {
+		t.Errorf("GetTrace() process = %v, want %v", got.Process, span.Process)
+	}
+}
+
+func TestWriteSpanContextCanceled(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	span := testSpan(model.TraceID{Low: 1}, 1, "frontend", "GET /", time.Now())
+	if err := writer.WriteSpanContext(ctx, span); err == nil {
+		t.Fatal("WriteSpanContext() succeeded with a canceled context")
+	}
+	if count := countRows(t, db, (*Span)(nil)); count != 0 {
+		t.Errorf("%d spans stored with a canceled context, want 0", count)
+	}
+}
+
+func TestWriteSpanNewServiceConcurrently(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	// the writers of a new service and operation race to create them
+	const writers = 20
+	start := time.Now()
+	ready := make(chan struct{})
+	errs := make(chan error, writers)
+	var wg sync.WaitGroup
+	for i := 1; i <= writers; i++ {
+		wg.Add(1)
+		go func(spanID model.SpanID) {
+			defer wg.Done()
+			<-ready
+			errs <- writer.WriteSpan(testSpan(model.TraceID{Low: 1}, spanID, "checkout", "pay", start))
+		}(model.SpanID(i))
+	}
+	close(ready)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if count := countRows(t, db, (*Service)(nil)); count != 1 {
+		t.Errorf("%d services, want 1", count)
+	}
+	if count := countRows(t, db, (*Operation)(nil)); count != 1 {
+		t.Errorf("%d operations, want 1", count)
+	}
+	var ids struct {
+		Spans      int
+		Services   int
+		Operations int
+	}
+	if _, err := db.QueryOne(&ids, `SELECT count(*) AS spans, count(DISTINCT service_id) AS services,
+	count(DISTINCT operation_id) AS operations FROM spans`); err != nil {
+		t.Fatal(err)
+	}
+	if ids.Spans != writers || ids.Services != 1 || ids.Operations != 1 {
+		t.Errorf("%d spans with %d service and %d operation ids, want %d spans sharing one of each", ids.Spans, ids.Services, ids.Operations, writers)
+	}
+}
+
+func TestWriteSpanWarnings(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	writer := NewWriter(db, hclog.NewNullLogger())
+	reader := NewReader(db, hclog.NewNullLogger())
+
+	traceID := model.TraceID{Low: 1}
+	span := testSpan(traceID, 1, "frontend", "GET /", time.Now().Add(-time.Minute))
+	span.Warnings = []string{"clock skew", "invalid parent span id"}
+	writeTestSpans(t, writer, span)
+
+	trace, err := reader.GetTrace(context.Background(), traceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"clock skew", "invalid parent span id"}; len(trace.Spans) != 1 || !reflect.DeepEqual(trace.Spans[0].Warnings, want) {
+		t.Errorf("GetTrace() = %v, want a span with the warnings %v", trace.Spans, want)
+	}
+}
+
+func TestWriteSpanFlags(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	writer := NewWriter(db, hclog.NewNullLogger())
+	reader := NewReader(db, hclog.NewNullLogger())
+
+	traceID := model.TraceID{Low: 1}
+	start := time.Now().Add(-time.Minute)
+	sampled := testSpan(traceID, 2, "frontend", "GET /", start)
+	sampled.Flags = model.SampledFlag | model.DebugFlag
+	writeTestSpans(t, writer, testSpan(traceID, 1, "frontend", "GET /", start), sampled)
+
+	nulls, err := db.Model((*Span)(nil)).Where("flags IS NULL").Count()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nulls != 0 {
+		t.Errorf("%d spans stored with NULL flags, want 0", nulls)
+	}
+	trace, err := reader.GetTrace(context.Background(), traceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, span := range trace.Spans {
+		want := model.Flags(0)
+		if span.SpanID == 2 {
+			want = sampled.Flags
+		}
+		if span.Flags != want {
+			t.Errorf("span %s has the flags %d, want %d", span.SpanID, span.Flags, want)
+		}
+	}
+}
+
+func TestWriteSpanTwice(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	writer := NewWriter(db, hclog.NewNullLogger())
+	reader := NewReader(db, hclog.NewNullLogger())
+
+	traceID := model.TraceID{Low: 1}
+	start := time.Now().Add(-time.Minute)
+	parent := testSpan(traceID, 1, "frontend", "GET /", start)
+	child := testSpan(traceID, 2, "backend", "query", start)
+	child.References = []model.SpanRef{model.NewChildOfRef(traceID, 1)}
+	child.Logs = []model.Log{{Timestamp: start, Fields: []model.KeyValue{model.String("event", "sent")}}}
+	// the collector retries the child
+	writeTestSpans(t, writer, parent, child, child)
+
+	for _, table := range []interface{}{(*Span)(nil), (*SpanRef)(nil), (*Log)(nil)} {
+		want := 1
+		if _, spans := table.(*Span); spans {
+			want = 2
+		}
+		if count := countRows(t, db, table); count != want {
+			t.Errorf("%d rows of %T, want %d", count, table, want)
+		}
+	}
+	deps, err := reader.GetDependencies(time.Now(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []model.DependencyLink{{Parent: "frontend", Child: "backend", CallCount: 1, Source: model.JaegerDependencyLinkSource}}
+	if !reflect.DeepEqual(deps, want) {
+		t.Errorf("GetDependencies() = %v, want %v", deps, want)
+	}
+}
+
+func TestWriteSpanRollsBack(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	writer := NewWriter(db, hclog.NewNullLogger())
+
+	traceID := model.TraceID{Low: 1}
+	start := time.Now()
+	span := testSpan(traceID, 2, "frontend", "GET /", start)
+	span.References = []model.SpanRef{model.NewChildOfRef(traceID, 1)}
+	span.Logs = []model.Log{{Timestamp: start, Fields: []model.KeyValue{model.String("event", "started")}}}
+	// the logs can't be inserted while their table is away
+	if _, err := db.Exec("ALTER TABLE span_logs RENAME TO span_logs_away"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.WriteSpan(span); err == nil {
+		t.Fatal("WriteSpan() succeeded without the span_logs table")
+	}
+	if _, err := db.Exec("ALTER TABLE span_logs_away RENAME TO span_logs"); err != nil {
+		t.Fatal(err)
+	}
+	if count := countRows(t, db, (*Span)(nil)); count != 0 {
+		t.Fatalf("%d spans stored by the failed write, want it rolled back", count)
+	}
+
+	writeTestSpans(t, writer, span)
+	if count := countRows(t, db, (*SpanRef)(nil)); count != 1 {
+		t.Errorf("%d refs stored by the retry, want 1", count)
+	}
+	if count := countRows(t, db, (*Log)(nil)); count != 1 {
+		t.Errorf("%d logs stored by the retry, want 1", count)
+	}
+}
+
+func TestWriteSpanReferencingMissingSpan(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	writer := NewWriter(db, hclog.NewNullLogger())
+	reader := NewReader(db, hclog.NewNullLogger())
+
+	// the parent never arrives, the link to another trace points nowhere
+	traceID := model.TraceID{Low: 1}
+	start := time.Now().Add(-time.Minute)
+	child := testSpan(traceID, 2, "backend", "query", start)
+	child.References = []model.SpanRef{model.NewChildOfRef(traceID, 1), model.NewFollowsFromRef(model.TraceID{Low: 9}, 7)}
+	writeTestSpans(t, writer, child)
+
+	trace, err := reader.GetTrace(context.Background(), traceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trace.Spans) != 1 || !reflect.DeepEqual(trace.Spans[0].References, child.References) {
+		t.Errorf("GetTrace() = %v, want the child with its references", trace.Spans)
+	}
+	deps, err := reader.GetDependencies(time.Now(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deps) != 0 {
+		t.Errorf("GetDependencies() = %v, want no call of a missing span", deps)
+	}
+}
+
+func TestWriteSpanTruncatesOperationName(t *testing.T) {
+	db, done := newTestDB(t)
+	defer done()
+	writer := NewWriter(db, hclog.NewNullLogger(), WithMaxOperationNameLength(9))
+	reader := NewReader(db, hclog.NewNullLogger(), WithConfiguration(&Configuration{MaxOperationNameLength: 9, DefaultNumTraces: 10}))
+
+	traceID := model.TraceID{Low: 1}
+	start := time.Now().Add(-time.Minute).Truncate(time.Microsecond)
+	span := testSpan(traceID, 1, "shop", "GET /café/items", start)
+	span.Warnings = []string{"clock skew"}
+	writeTestSpans(t, writer, span)
+	if !reflect.DeepEqual(span.Warnings, []string{"clock skew"}) {
+		t.Errorf("the warnings of the written span were changed to %v", span.Warnings)
+	}
+
+	trace, err := reader.GetTrace(context.Background(), traceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored := trace.Spans[0]
+	if stored.OperationName != "GET /caf" {
+		t.Errorf("stored operation name %q, want it cut before é", stored.OperationName)
+	}
+	if want := []string{"clock skew", "operation name truncated from 16 to 8 bytes"}; !reflect.DeepEqual(stored.Warnings, want) {
+		t.Errorf("stored warnings %v, want %v", stored.Warnings, want)
+	}
+
+	// searched by the full name, truncated like the stored one
+	traces, err := reader.FindTraces(context.Background(), &spanstore.TraceQueryParameters{ServiceName: "shop", OperationName: "GET /café/items",
+		StartTimeMin: start.Add(-time.Minute), StartTimeMax: start.Add(time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(traces) != 1 {
+		t.Errorf("FindTraces() by the full operation name found %d traces, want 1", len(traces))
+	}
+	var truncated bool
+	if _, err := db.QueryOne(pg.Scan(&truncated), "SELECT truncated FROM operations WHERE operation_name = ?", "GET /caf"); err != nil {
+		t.Fatal(err)
+	}
+	if !truncated {
+		t.Error("the operation isn't flagged as truncated")
+	}
+}
@@ -0,0 +1,89 @@
+package pgstore
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	hclog "github.com/hashicorp/go-hclog"
+	"github.com/jaegertracing/jaeger/model"
+)
+
+func TestTruncateName(t *testing.T) {
+	tests := []struct {
+		name      string
+		max       int
+		want      string
+		truncated bool
+	}{
+		{name: "GET /cart", max: 0, want: "GET /cart"},
+		{name: "GET /cart", max: 9, want: "GET /cart"},
+		{name: "GET /cart", max: 20, want: "GET /cart"},
+		{name: "GET /cart", max: 5, want: "GET /", truncated: true},
+		// é takes the 9th and 10th bytes
+		{name: "GET /café", max: 9, want: "GET /caf", truncated: true},
+		{name: "GET /café", max: 10, want: "GET /café"},
+		{name: "GET /café/items", max: 10, want: "GET /café", truncated: true},
+		// the 4 bytes of the emoji are cut before their first one
+		{name: "🛒 cart", max: 3, want: "", truncated: true},
+	}
+	for _, tt := range tests {
+		got, truncated := truncateName(tt.name, tt.max)
+		if got != tt.want || truncated != tt.truncated {
+			t.Errorf("truncateName(%q, %d) = %q, %t, want %q, %t", tt.name, tt.max, got, truncated, tt.want, tt.truncated)
+		}
+	}
+}
+
+// invalidSpans are spans validateSpan rejects, with the reason in its error
+var invalidSpans = []struct {
+	name   string
+	span   *model.Span
+	reason string
+}{
+	{name: "no trace id", span: &model.Span{SpanID: 1, Process: model.NewProcess("shop", nil)}, reason: "no trace id"},
+	{name: "no span id", span: &model.Span{TraceID: model.TraceID{Low: 1}, Process: model.NewProcess("shop", nil)}, reason: "no span id"},
+	{name: "no process", span: &model.Span{TraceID: model.TraceID{Low: 1}, SpanID: 1}, reason: "no process"},
+}
+
+func TestValidateSpan(t *testing.T) {
+	for _, tt := range invalidSpans {
+		if err := validateSpan(tt.span); err == nil || !strings.Contains(err.Error(), tt.reason) {
+			t.Errorf("%s: validateSpan() = %v, want an error about %s", tt.name, err, tt.reason)
+		}
+	}
+
+	valid := []*model.Span{
+		{TraceID: model.TraceID{Low: 1}, SpanID: 1, Process: model.NewProcess("shop", nil)},
+		{TraceID: model.TraceID{High: 1}, SpanID: 1, Process: model.NewProcess("shop", nil)},
+	}
+	for _, span := range valid {
+		if err := validateSpan(span); err != nil {
+			t.Errorf("validateSpan(%v) = %v, want it valid", span, err)
+		}
+	}
+}
+
+func TestWriteInvalidSpan(t *testing.T) {
+	db, hook := newRecordingDB()
+	defer db.Close()
+	logger, out := newBufferLogger(hclog.Warn)
+	strict := NewWriter(db, logger)
+	dropping := NewWriter(db, logger, WithDropInvalidSpans(true))
+
+	for _, tt := range invalidSpans {
+		out.Reset()
+		if err := strict.WriteSpan(tt.span); err == nil || errors.Is(err, errRecorded) {
+			t.Errorf("%s: WriteSpan() = %v, want the span rejected", tt.name, err)
+		}
+		if err := dropping.WriteSpan(tt.span); err != nil {
+			t.Errorf("%s: WriteSpan() dropping invalid spans = %v", tt.name, err)
+		}
+		if !strings.Contains(out.String(), "Dropping invalid span") || !strings.Contains(out.String(), tt.reason) {
+			t.Errorf("%s: the dropped span isn't logged: %s", tt.name, out)
+		}
+	}
+	if hook.queries != 0 {
+		t.Errorf("%d queries for invalid spans, want none", hook.queries)
+	}
+}